@@ -1,21 +1,27 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"market-api/db"
+	"market-api/middleware"
 	"market-api/models"
 	"market-api/utils"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/spf13/viper"
 	"gorm.io/gorm"
 )
 
-var allowedImageExtensions = []string{"jpg", "jpeg", "png", "webp"}
+func respondImageError(c *gin.Context, label string, err error) {
+	if errors.Is(err, utils.ErrInvalidImage) {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": label + "校验失败，请上传有效的 jpg, png, webp 图片: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "保存" + label + "失败: " + err.Error()})
+}
 
 func ListBanners(c *gin.Context) {
 	var banners []models.Banner
@@ -33,19 +39,13 @@ func CreateBanner(c *gin.Context) {
 		return
 	}
 
-	if !utils.ValidateFileExtension(file.Filename, allowedImageExtensions) {
-		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "不支持的图片格式，请上传 jpg, jpeg, png, webp 格式的图片"})
-		return
-	}
-
-	relativeBannerPath, err := utils.SaveUploadedFile(file, viper.GetString("storage.banner_path"))
+	image, err := utils.ProcessUploadedImage(file, mediaDir(mediaDirBanner), utils.PlainImageSpec())
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "保存图片失败: " + err.Error()})
+		respondImageError(c, "图片", err)
 		return
 	}
 
-	baseURL := viper.GetString("server.base_url")
-	fullBannerURL := fmt.Sprintf("%s/%s", baseURL, relativeBannerPath)
+	fullBannerURL := image.URL
 
 	banner := models.Banner{
 		BannerURL:  fullBannerURL,
@@ -58,6 +58,9 @@ func CreateBanner(c *gin.Context) {
 		return
 	}
 
+	retainMedia(mediaOwnerBanner, banner.ID, []string{image.Key})
+	recordAudit(c, "banner.create", "banner", banner.ID, nil, banner)
+
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "创建成功", "data": banner})
 }
 
@@ -72,6 +75,12 @@ func UpdateBanner(c *gin.Context) {
 		return
 	}
 
+	var banner models.Banner
+	if err := db.DB.First(&banner, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "头图不存在"})
+		return
+	}
+
 	updates := map[string]interface{}{
 		"actions":    req.Actions,
 		"visibility": req.Visibility,
@@ -81,6 +90,10 @@ func UpdateBanner(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "更新失败: " + err.Error()})
 		return
 	}
+
+	var updated models.Banner
+	db.DB.First(&updated, id)
+	recordAudit(c, "banner.update", "banner", id, banner, updated)
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "更新成功"})
 }
 
@@ -97,19 +110,17 @@ func DeleteBanner(c *gin.Context) {
 		return
 	}
 
-	baseURL := viper.GetString("server.base_url")
-	if banner.BannerURL != "" && strings.HasPrefix(banner.BannerURL, baseURL) {
-		relativePath := strings.TrimPrefix(banner.BannerURL, baseURL+"/")
-		if err := utils.DeleteFile(relativePath); err != nil {
-			fmt.Printf("Warning: failed to delete banner image file %s: %v\n", relativePath, err)
-		}
-	}
-
 	if err := db.DB.Delete(&models.Banner{}, id).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "删除数据库记录失败: " + err.Error()})
 		return
 	}
 
+	if relativePath, ok := utils.StorageKeyFromURL(banner.BannerURL); ok {
+		releaseMedia(mediaOwnerBanner, id, []string{relativePath})
+	}
+
+	recordAudit(c, "banner.delete", "banner", id, banner, nil)
+
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "删除成功"})
 }
 
@@ -121,26 +132,69 @@ func ListBannedIPs(c *gin.Context) {
 
 func CreateBannedIP(c *gin.Context) {
 	var req struct {
-		IP string `json:"ip" binding:"required"`
+		IP     string `json:"ip" binding:"required"`
+		Reason string `json:"reason"`
+		Hours  int    `json:"hours"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "参数错误: " + err.Error()})
 		return
 	}
-	bannedIP := models.BannedIP{IP: req.IP}
+
+	prefix, err := middleware.ParseIPOrCIDR(req.IP)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "无效的IP或CIDR: " + req.IP})
+		return
+	}
+
+	var expireTime int64
+	if req.Hours > 0 {
+		expireTime = time.Now().Add(time.Duration(req.Hours) * time.Hour).UnixMilli()
+	}
+
+	ip := prefix.String()
+	if prefix.IsSingleIP() {
+		ip = prefix.Addr().String()
+	}
+
+	bannedIP := models.BannedIP{
+		IP:         ip,
+		Reason:     req.Reason,
+		ExpireTime: expireTime,
+		CreateTime: time.Now().UnixMilli(),
+	}
 	if err := db.DB.Create(&bannedIP).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "添加失败: " + err.Error()})
 		return
 	}
+
+	recordAudit(c, "ip_ban.create", "banned_ip", bannedIP.ID, nil, bannedIP)
+
+	if err := middleware.ReloadBannedIPs(); err != nil {
+		fmt.Printf("Warning: failed to reload banned ip list: %v\n", err)
+	}
+
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "添加成功", "data": bannedIP})
 }
 
 func DeleteBannedIP(c *gin.Context) {
 	id, _ := strconv.Atoi(c.Param("id"))
+	var bannedIP models.BannedIP
+	if err := db.DB.First(&bannedIP, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "记录不存在"})
+		return
+	}
 	if err := db.DB.Delete(&models.BannedIP{}, id).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "删除失败: " + err.Error()})
 		return
 	}
+
+	recordAudit(c, "ip_ban.delete", "banned_ip", id, bannedIP, nil)
+
+	if err := middleware.ReloadBannedIPs(); err != nil {
+		fmt.Printf("Warning: failed to reload banned ip list: %v\n", err)
+	}
+
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "删除成功"})
 }
 
@@ -163,15 +217,22 @@ func CreateProhibitedWord(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "添加失败: " + err.Error()})
 		return
 	}
+	recordAudit(c, "prohibited_word.create", "prohibited_word", word.ID, nil, word)
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "添加成功", "data": word})
 }
 
 func DeleteProhibitedWord(c *gin.Context) {
 	id, _ := strconv.Atoi(c.Param("id"))
+	var word models.ProhibitedWord
+	if err := db.DB.First(&word, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "记录不存在"})
+		return
+	}
 	if err := db.DB.Delete(&models.ProhibitedWord{}, id).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "删除失败: " + err.Error()})
 		return
 	}
+	recordAudit(c, "prohibited_word.delete", "prohibited_word", id, word, nil)
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "删除成功"})
 }
 
@@ -194,15 +255,22 @@ func CreateUsernameBlacklist(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "添加失败: " + err.Error()})
 		return
 	}
+	recordAudit(c, "username_blacklist.create", "username_blacklist", blacklist.ID, nil, blacklist)
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "添加成功", "data": blacklist})
 }
 
 func DeleteUsernameBlacklist(c *gin.Context) {
 	id, _ := strconv.Atoi(c.Param("id"))
+	var blacklist models.UsernameBlacklist
+	if err := db.DB.First(&blacklist, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "记录不存在"})
+		return
+	}
 	if err := db.DB.Delete(&models.UsernameBlacklist{}, id).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "删除失败: " + err.Error()})
 		return
 	}
+	recordAudit(c, "username_blacklist.delete", "username_blacklist", id, blacklist, nil)
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "删除成功"})
 }
 
@@ -382,6 +450,19 @@ func AuditReport(c *gin.Context) {
 	}
 
 	tx.Commit()
+
+	var updatedReport models.Report
+	db.DB.First(&updatedReport, id)
+	recordAudit(c, "report.audit", "report", id, report, updatedReport)
+	if req.TakeAction {
+		switch report.ReportType {
+		case 1:
+			recordAudit(c, "app.takedown", "app", report.ReportID, nil, gin.H{"audit_status": 2, "report_id": id})
+		case 2:
+			recordAudit(c, "comment.hide", "comment", report.ReportID, nil, gin.H{"visibility": 0, "report_id": id})
+		}
+	}
+
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "举报处理成功"})
 }
 
@@ -409,11 +490,18 @@ func UpdateSetting(c *gin.Context) {
 		return
 	}
 
+	var before interface{}
+	var existing models.Setting
+	if err := db.DB.Where("setting_key = ?", key).First(&existing).Error; err == nil {
+		before = existing
+	}
+
 	setting := models.Setting{Key: key, Value: req.Value}
 	if err := db.DB.Save(&setting).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "更新设置失败: " + err.Error()})
 		return
 	}
+	recordAudit(c, "setting.update", "setting", 0, before, setting)
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "设置更新成功"})
 }
 
@@ -460,6 +548,7 @@ func CreateAppPage(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "创建专题失败: " + err.Error()})
 		return
 	}
+	recordAudit(c, "page.create", "page", page.ID, nil, page)
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "创建成功", "data": page})
 }
 
@@ -470,6 +559,11 @@ func UpdateAppPage(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "参数错误: " + err.Error()})
 		return
 	}
+	var before models.AppPage
+	if err := db.DB.First(&before, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "专题不存在"})
+		return
+	}
 	updates := map[string]interface{}{
 		"title":        page.Title,
 		"content":      page.Content,
@@ -481,12 +575,21 @@ func UpdateAppPage(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "更新专题失败: " + err.Error()})
 		return
 	}
+	var updated models.AppPage
+	db.DB.First(&updated, id)
+	recordAudit(c, "page.update", "page", id, before, updated)
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "更新成功"})
 }
 
 func DeleteAppPage(c *gin.Context) {
 	id, _ := strconv.Atoi(c.Param("id"))
 
+	var page models.AppPage
+	if err := db.DB.First(&page, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "专题不存在"})
+		return
+	}
+
 	tx := db.DB.Begin()
 	if tx.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "开启事务失败: " + tx.Error.Error()})
@@ -511,6 +614,7 @@ func DeleteAppPage(c *gin.Context) {
 	}
 
 	tx.Commit()
+	recordAudit(c, "page.delete", "page", id, page, nil)
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "删除成功"})
 }
 
@@ -538,6 +642,9 @@ func SyncAppsToPage(c *gin.Context) {
 	pageIDStr := strconv.Itoa(pageID)
 	searchStr := fmt.Sprintf("%s,", pageIDStr)
 
+	var previousAppIDs []int
+	tx.Model(&models.App{}).Where("app_pages LIKE ?", "%,"+searchStr+"%").Pluck("id", &previousAppIDs)
+
 	if err := tx.Model(&models.App{}).
 		Where("app_pages LIKE ?", "%,"+searchStr+"%").
 		Update("app_pages", gorm.Expr("REPLACE(app_pages, ?, ?)", searchStr, "")).Error; err != nil {
@@ -558,5 +665,6 @@ func SyncAppsToPage(c *gin.Context) {
 	}
 
 	tx.Commit()
+	recordAudit(c, "page.sync_apps", "page", pageID, gin.H{"app_ids": previousAppIDs}, gin.H{"app_ids": req.AppIDs})
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "应用关联同步成功"})
 }
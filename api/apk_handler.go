@@ -0,0 +1,441 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"market-api/db"
+	"market-api/middleware"
+	"market-api/models"
+	"market-api/utils"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+const (
+	signatureUnchecked = 0
+	signatureTrusted   = 1
+	signatureFirstSeen = 2
+	signatureMismatch  = 3
+)
+
+var (
+	errSignatureMismatch  = errors.New("signing certificate mismatch")
+	errVersionUninspected = errors.New("apk has not been inspected")
+)
+
+func fetchUploadedAPK(appID int, remotePath string) (string, error) {
+	tmp, err := os.CreateTemp("", fmt.Sprintf("app-%d-*.apk", appID))
+	if err != nil {
+		return "", err
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+
+	if apkStoredLocally(remotePath) {
+		err = utils.DownloadFromStorage(remotePath, tmpPath)
+	} else {
+		err = utils.DefaultFileServer.Download(remotePath, tmpPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return tmpPath, nil
+}
+
+func apkInfoUpdates(version models.AppVersion, info *utils.APKInfo) (map[string]interface{}, map[string][2]interface{}) {
+	isWearOS := 0
+	if info.IsWearOS {
+		isWearOS = 1
+	}
+
+	derived := map[string]interface{}{
+		"version_code":   info.VersionCode,
+		"version_name":   info.VersionName,
+		"app_sdk_min":    info.MinSDK,
+		"app_sdk_target": info.TargetSDK,
+		"app_abi":        info.ABIMask,
+		"app_is_wearos":  isWearOS,
+		"download_size":  utils.FormatSizeUnits(info.Size),
+	}
+	current := map[string]interface{}{
+		"version_code":   version.VersionCode,
+		"version_name":   version.VersionName,
+		"app_sdk_min":    version.AppSdkMin,
+		"app_sdk_target": version.AppSdkTarget,
+		"app_abi":        version.AppABI,
+		"app_is_wearos":  version.AppIsWearOS,
+		"download_size":  version.DownloadSize,
+	}
+
+	corrections := map[string][2]interface{}{}
+	for key, value := range derived {
+		if current[key] != value {
+			corrections[key] = [2]interface{}{current[key], value}
+		}
+	}
+
+	updates := derived
+	updates["apk_inspect_time"] = time.Now().UnixMilli()
+	return updates, corrections
+}
+
+func updateAppVersion(tx *gorm.DB, app *models.App, version *models.AppVersion, updates map[string]interface{}) error {
+	if err := tx.Model(version).Updates(updates).Error; err != nil {
+		return err
+	}
+	if version.IsCurrent == 1 {
+		return tx.Model(app).Updates(updates).Error
+	}
+	return nil
+}
+
+func blockSignatureMismatch() bool {
+	return viper.GetString("apk.signature_mismatch") == "block"
+}
+
+func signerFingerprints(signers []utils.APKSigner) []string {
+	seen := map[string]bool{}
+	var fingerprints []string
+	for _, signer := range signers {
+		if !seen[signer.Fingerprint] {
+			seen[signer.Fingerprint] = true
+			fingerprints = append(fingerprints, signer.Fingerprint)
+		}
+	}
+	return fingerprints
+}
+
+func versionFingerprints(version models.AppVersion) []string {
+	if version.SigningCerts != "" {
+		return strings.Split(version.SigningCerts, ",")
+	}
+	if version.SigningCert != "" {
+		return []string{version.SigningCert}
+	}
+	return nil
+}
+
+func signingKeyStatus(tx *gorm.DB, packageName string, fingerprints []string) int {
+	var pinned []string
+	tx.Model(&models.AppSigningKey{}).
+		Where("package_name = ? AND status = ?", packageName, 1).
+		Pluck("fingerprint", &pinned)
+	if len(pinned) == 0 {
+		return signatureFirstSeen
+	}
+	trusted := map[string]bool{}
+	for _, fp := range pinned {
+		trusted[fp] = true
+	}
+	for _, fp := range fingerprints {
+		if !trusted[fp] {
+			return signatureMismatch
+		}
+	}
+	return signatureTrusted
+}
+
+func pinSigningKey(tx *gorm.DB, app models.App, version models.AppVersion, source string, userID int, reason string) error {
+	var pinned []string
+	tx.Model(&models.AppSigningKey{}).
+		Where("package_name = ? AND status = ?", app.PackageName, 1).
+		Pluck("fingerprint", &pinned)
+	trusted := map[string]bool{}
+	for _, fp := range pinned {
+		trusted[fp] = true
+	}
+
+	for _, fp := range versionFingerprints(version) {
+		if trusted[fp] {
+			continue
+		}
+		key := models.AppSigningKey{
+			PackageName: app.PackageName,
+			Fingerprint: fp,
+			Status:      1,
+			Source:      source,
+			AppID:       app.ID,
+			ByUserID:    userID,
+			Reason:      reason,
+			CreateTime:  time.Now().UnixMilli(),
+		}
+		if fp == version.SigningCert {
+			key.Subject = version.SigningSubject
+		}
+		if err := tx.Create(&key).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func approveVersionSignature(tx *gorm.DB, app *models.App, version *models.AppVersion, userID int) error {
+	if version.ApkInspectTime == 0 || version.SigningCert == "" {
+		return errVersionUninspected
+	}
+
+	status := signingKeyStatus(tx, app.PackageName, versionFingerprints(*version))
+	switch status {
+	case signatureMismatch:
+		return errSignatureMismatch
+	case signatureFirstSeen:
+		if err := pinSigningKey(tx, *app, *version, "first_approval", userID, ""); err != nil {
+			return err
+		}
+	}
+
+	version.SignatureStatus = signatureTrusted
+	return updateAppVersion(tx, app, version, map[string]interface{}{"signature_status": signatureTrusted})
+}
+
+func CompleteAppUpload(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	currentUser := c.MustGet("user").(models.User)
+
+	var app models.App
+	if err := db.DB.First(&app, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "应用不存在"})
+		return
+	}
+
+	if app.ByUserID != currentUser.ID && !middleware.HasPermission(c, "app.edit_any") {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权操作此应用"})
+		return
+	}
+
+	var version models.AppVersion
+	if err := db.DB.Where("app_id = ?", app.ID).Order("id desc").First(&version).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "该应用没有待检查的APK"})
+		return
+	}
+
+	inspectAppVersion(c, &app, &version)
+}
+
+func inspectAppVersion(c *gin.Context, app *models.App, version *models.AppVersion) {
+	if version.ApkPath == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "该版本没有待检查的APK"})
+		return
+	}
+	if version.AuditStatus == 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "该版本已审核通过，不能重新上传"})
+		return
+	}
+	if version.UploadState == uploadExpired {
+		c.JSON(http.StatusGone, gin.H{"code": 410, "msg": "该上传已超时过期，请重新提交"})
+		return
+	}
+
+	apkPath, err := fetchUploadedAPK(app.ID, version.ApkPath)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"code": 502, "msg": "获取已上传的APK失败: " + err.Error()})
+		return
+	}
+	defer os.Remove(apkPath)
+
+	checksum, err := utils.FileSHA256(apkPath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "计算APK校验值失败: " + err.Error()})
+		return
+	}
+	if version.ApkSha256 != "" && version.ApkSha256 != checksum {
+		c.JSON(http.StatusConflict, gin.H{"code": 409, "msg": "APK校验值与文件服务器回调记录不一致，请稍后重试或重新上传"})
+		return
+	}
+
+	info, err := utils.InspectAPK(apkPath)
+	if err != nil {
+		if errors.Is(err, utils.ErrInvalidAPK) {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "无法解析上传的APK，请确认文件完整: " + err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "检查APK失败: " + err.Error()})
+		return
+	}
+
+	if app.PackageName != "" && info.PackageName != app.PackageName {
+		updateAppVersion(db.DB, app, version, map[string]interface{}{
+			"audit_status": 2,
+			"audit_reason": fmt.Sprintf("APK包名 %s 与填写的包名 %s 不一致", info.PackageName, app.PackageName),
+		})
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  fmt.Sprintf("APK包名 %s 与填写的包名 %s 不一致，请重新上传", info.PackageName, app.PackageName),
+			"data": gin.H{"apk": info},
+		})
+		return
+	}
+
+	if version.IsCurrent != 1 && info.VersionCode <= app.VersionCode {
+		updateAppVersion(db.DB, app, version, map[string]interface{}{
+			"audit_status": 2,
+			"audit_reason": fmt.Sprintf("APK版本号 %d 不高于当前版本 %d", info.VersionCode, app.VersionCode),
+		})
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  fmt.Sprintf("APK版本号 %d 必须高于当前已发布的版本号 %d", info.VersionCode, app.VersionCode),
+			"data": gin.H{"apk": info},
+		})
+		return
+	}
+
+	signers, err := utils.APKSigners(apkPath)
+	if errors.Is(err, utils.ErrAPKSignature) {
+		updateAppVersion(db.DB, app, version, map[string]interface{}{
+			"audit_status": 2,
+			"audit_reason": "APK签名校验失败",
+		})
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "APK签名校验失败，文件可能已被篡改: " + err.Error()})
+		return
+	}
+	if err != nil || len(signers) == 0 {
+		updateAppVersion(db.DB, app, version, map[string]interface{}{
+			"audit_status": 2,
+			"audit_reason": "APK未签名或签名无法解析",
+		})
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "APK未签名或签名无法解析，请使用正式签名后重新上传"})
+		return
+	}
+	signer := signers[0]
+	fingerprints := signerFingerprints(signers)
+	signatureStatus := signingKeyStatus(db.DB, info.PackageName, fingerprints)
+
+	if signatureStatus == signatureMismatch && blockSignatureMismatch() {
+		updateAppVersion(db.DB, app, version, map[string]interface{}{
+			"audit_status":     2,
+			"audit_reason":     "APK签名与已发布版本不一致",
+			"signing_cert":     signer.Fingerprint,
+			"signing_certs":    strings.Join(fingerprints, ","),
+			"signing_subject":  signer.Subject,
+			"signature_status": signatureMismatch,
+		})
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "APK签名与该包名已发布版本的签名不一致，已拒绝上传",
+			"data": gin.H{"signers": signers},
+		})
+		return
+	}
+
+	updates, corrections := apkInfoUpdates(*version, info)
+	updates["signing_cert"] = signer.Fingerprint
+	updates["signing_certs"] = strings.Join(fingerprints, ",")
+	updates["signing_subject"] = signer.Subject
+	updates["signature_status"] = signatureStatus
+	updates["upload_state"] = uploadPendingAudit
+	updates["audit_status"] = 0
+	updates["audit_reason"] = "APK已上传，等待审核"
+	if signatureStatus == signatureMismatch {
+		updates["audit_reason"] = "APK签名与已发布版本不一致，等待管理员复核"
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := updateAppVersion(tx, app, version, updates); err != nil {
+			return err
+		}
+		appUpdates := map[string]interface{}{}
+		if app.PackageName == "" {
+			appUpdates["package_name"] = info.PackageName
+		}
+		if app.AppName == "" && info.Label != "" {
+			appUpdates["app_name"] = info.Label
+		}
+		if len(appUpdates) == 0 {
+			return nil
+		}
+		return tx.Model(app).Updates(appUpdates).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "更新应用信息失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "APK检查通过",
+		"data": gin.H{
+			"apk":              info,
+			"corrections":      corrections,
+			"signers":          signers,
+			"signature_status": signatureStatus,
+			"version_id":       version.ID,
+		},
+	})
+}
+
+func ListAppSigningKeys(c *gin.Context) {
+	query := db.DB.Model(&models.AppSigningKey{})
+	if packageName := c.Query("package_name"); packageName != "" {
+		query = query.Where("package_name = ?", packageName)
+	}
+
+	var keys []models.AppSigningKey
+	query.Order("id desc").Find(&keys)
+	c.JSON(http.StatusOK, gin.H{"code": 200, "data": keys})
+}
+
+func ConfirmAppSigningRotation(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	var req struct {
+		Reason         string `json:"reason" binding:"required"`
+		RevokePrevious bool   `json:"revoke_previous"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "参数错误，必须填写轮换原因"})
+		return
+	}
+
+	var app models.App
+	if err := db.DB.First(&app, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "应用不存在"})
+		return
+	}
+	var version models.AppVersion
+	if err := db.DB.Where("app_id = ? AND signature_status = ? AND signing_cert <> ''", app.ID, signatureMismatch).
+		Order("id desc").First(&version).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "该应用的签名无需确认轮换"})
+		return
+	}
+
+	currentUser := c.MustGet("user").(models.User)
+	var previous []models.AppSigningKey
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		tx.Where("package_name = ? AND status = ?", app.PackageName, 1).Find(&previous)
+		if req.RevokePrevious {
+			if err := tx.Model(&models.AppSigningKey{}).
+				Where("package_name = ? AND status = ?", app.PackageName, 1).
+				Updates(map[string]interface{}{"status": 0, "revoke_time": time.Now().UnixMilli()}).Error; err != nil {
+				return err
+			}
+		}
+		if err := pinSigningKey(tx, app, version, "rotation", currentUser.ID, req.Reason); err != nil {
+			return err
+		}
+		return updateAppVersion(tx, &app, &version, map[string]interface{}{
+			"signature_status": signatureTrusted,
+			"audit_reason":     "签名轮换已确认，等待审核",
+		})
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "确认签名轮换失败: " + err.Error()})
+		return
+	}
+
+	previousFingerprints := make([]string, 0, len(previous))
+	for _, key := range previous {
+		previousFingerprints = append(previousFingerprints, key.Fingerprint)
+	}
+	recordAudit(c, "app.signing_rotate", "app", app.ID,
+		gin.H{"package_name": app.PackageName, "fingerprints": previousFingerprints},
+		gin.H{"package_name": app.PackageName, "version_id": version.ID, "fingerprints": versionFingerprints(version), "reason": req.Reason, "revoke_previous": req.RevokePrevious})
+
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "已确认签名轮换"})
+}
@@ -2,36 +2,51 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"market-api/db"
+	"market-api/middleware"
 	"market-api/models"
 	"market-api/utils"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/spf13/viper"
+	"gorm.io/gorm"
 )
 
 var allowedApkExtensions = []string{"apk"}
 
+var appEditableFields = []string{
+	"app_name", "keyword", "app_type_id", "app_version_type_id", "app_tags",
+	"app_describe", "app_developer", "app_source", "upload_message",
+}
+
 func GetAppTags(c *gin.Context) {
-	var tags []models.AppTag
-	db.DB.Find(&tags)
+	tags, err := cachedTaxonomy[models.AppTag](taxonomyTags)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "查询标签失败"})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"code": 200, "data": tags})
 }
 
 func GetAppTypes(c *gin.Context) {
-	var types []models.AppType
-	db.DB.Find(&types)
+	types, err := cachedTaxonomy[models.AppType](taxonomyTypes)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "查询应用类型失败"})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"code": 200, "data": types})
 }
 
 func GetAppVersionTypes(c *gin.Context) {
-	var versionTypes []models.AppVersionType
-	db.DB.Find(&versionTypes)
+	versionTypes, err := cachedTaxonomy[models.AppVersionType](taxonomyVersionTypes)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "查询版本类型失败"})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"code": 200, "data": versionTypes})
 }
 
@@ -41,13 +56,22 @@ func ListApps(c *gin.Context) {
 
 	scope := c.Query("scope")
 
-	if scope == "all" && currentUser.UserPermission >= 1 {
+	if scope == "all" && middleware.HasPermission(c, "app.view_all") {
 		if statusStr := c.Query("audit_status"); statusStr != "" {
 			status, err := strconv.Atoi(statusStr)
 			if err == nil {
 				query = query.Where("audit_status = ?", status)
+				if status == 0 {
+					query = query.Where("upload_state NOT IN ?", []string{uploadAwaitingBinary, uploadExpired})
+				}
 			}
 		}
+		if uploadState := c.Query("upload_state"); uploadState != "" {
+			query = query.Where("upload_state = ?", uploadState)
+		}
+		if c.Query("pending_revision") == "1" {
+			query = query.Where("id IN (?)", db.DB.Model(&models.AppRevision{}).Select("app_id").Where("status = ?", revisionPending))
+		}
 	} else {
 		query = query.Where("by_userid = ?", currentUser.ID)
 	}
@@ -102,7 +126,6 @@ func GetApp(c *gin.Context) {
 
 func PreUploadApp(c *gin.Context) {
 	currentUser := c.MustGet("user").(models.User)
-	baseURL := viper.GetString("server.base_url")
 
 	form, err := c.MultipartForm()
 	if err != nil {
@@ -115,37 +138,40 @@ func PreUploadApp(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "必须上传应用图标"})
 		return
 	}
-	if !utils.ValidateFileExtension(iconFile[0].Filename, allowedImageExtensions) {
-		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "不支持的图标格式，请上传 jpg, jpeg, png, webp 格式的图片"})
-		return
-	}
-	relativeIconPath, err := utils.SaveUploadedFile(iconFile[0], viper.GetString("storage.icon_path"))
+	icon, err := utils.ProcessUploadedImage(iconFile[0], mediaDir(mediaDirIcon), utils.IconImageSpec())
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "保存图标失败: " + err.Error()})
+		respondImageError(c, "图标", err)
 		return
 	}
-	fullIconURL := fmt.Sprintf("%s/%s", baseURL, relativeIconPath)
+	relativeIconPath := icon.Key
+	fullIconURL := icon.URL
+	iconVariantsJSON, _ := json.Marshal(icon.Variants)
 
 	var screenshotURLs []string
+	screenshotVariants := map[string][]utils.ImageVariant{}
 	screenshotFiles := form.File["screenshots"]
 	for _, file := range screenshotFiles {
-		if !utils.ValidateFileExtension(file.Filename, allowedImageExtensions) {
-			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "包含不支持的截图格式，请上传 jpg, jpeg, png, webp 格式的图片"})
+		shot, err := utils.ProcessUploadedImage(file, mediaDir(mediaDirPreview), utils.ScreenshotImageSpec())
+		if errors.Is(err, utils.ErrInvalidImage) {
+			previewsJSON, _ := json.Marshal(screenshotURLs)
+			previewVariantsJSON, _ := json.Marshal(screenshotVariants)
+			releaseAppMedia(0, appMediaPaths(relativeIconPath, string(previewsJSON), string(iconVariantsJSON), string(previewVariantsJSON)))
+			respondImageError(c, "截图", err)
 			return
 		}
-		relativePath, err := utils.SaveUploadedFile(file, viper.GetString("storage.preview_path"))
 		if err != nil {
 			fmt.Printf("Warning: could not save screenshot %s: %v\n", file.Filename, err)
 			continue
 		}
-		fullScreenshotURL := fmt.Sprintf("%s/%s", baseURL, relativePath)
-		screenshotURLs = append(screenshotURLs, fullScreenshotURL)
+		screenshotURLs = append(screenshotURLs, shot.URL)
+		screenshotVariants[shot.URL] = shot.Variants
 	}
 
 	if screenshotURLs == nil {
 		screenshotURLs = make([]string, 0)
 	}
 	screenshotsJSON, _ := json.Marshal(screenshotURLs)
+	screenshotVariantsJSON, _ := json.Marshal(screenshotVariants)
 
 	versionCode, _ := strconv.Atoi(c.PostForm("version_code"))
 	appTypeID, _ := strconv.Atoi(c.PostForm("app_type_id"))
@@ -157,33 +183,36 @@ func PreUploadApp(c *gin.Context) {
 	appIsWearOS, _ := strconv.Atoi(c.PostForm("app_is_wearos"))
 
 	app := models.App{
-		PackageName:      c.PostForm("package_name"),
-		AppName:          c.PostForm("app_name"),
-		Keyword:          c.PostForm("keyword"),
-		VersionCode:      versionCode,
-		VersionName:      c.PostForm("version_name"),
-		AppIcon:          fullIconURL,
-		ByUserID:         currentUser.ID,
-		AppTypeID:        appTypeID,
-		AppVersionTypeID: appVersionTypeID,
-		AppABI:           appABI,
-		AppTags:          c.PostForm("app_tags"),
-		AppPages:         ",",
-		AppPreviews:      string(screenshotsJSON),
-		AppDescribe:      c.PostForm("app_describe"),
-		AppUpdateLog:     c.PostForm("app_update_log"),
-		AppDeveloper:     c.PostForm("app_developer"),
-		AppSource:        c.PostForm("app_source"),
-		UploadMessage:    c.PostForm("upload_message"),
-		AuditStatus:      0,
-		AuditReason:      "应用还在审核中",
-		AppSdkMin:        appSdkMin,
-		AppSdkTarget:     appSdkTarget,
-		AppIsWearOS:      appIsWearOS,
-		DownloadSize:     utils.FormatSizeUnits(downloadSize),
-		UploadTime:       time.Now().UnixMilli(),
-		UpdateTime:       time.Now().UnixMilli(),
-		LocalIconPath:    relativeIconPath,
+		PackageName:        c.PostForm("package_name"),
+		AppName:            c.PostForm("app_name"),
+		Keyword:            c.PostForm("keyword"),
+		VersionCode:        versionCode,
+		VersionName:        c.PostForm("version_name"),
+		AppIcon:            fullIconURL,
+		ByUserID:           currentUser.ID,
+		AppTypeID:          appTypeID,
+		AppVersionTypeID:   appVersionTypeID,
+		AppABI:             appABI,
+		AppTags:            c.PostForm("app_tags"),
+		AppPages:           ",",
+		AppPreviews:        string(screenshotsJSON),
+		AppPreviewVariants: screenshotVariantsJSON,
+		AppDescribe:        c.PostForm("app_describe"),
+		AppUpdateLog:       c.PostForm("app_update_log"),
+		AppDeveloper:       c.PostForm("app_developer"),
+		AppSource:          c.PostForm("app_source"),
+		UploadMessage:      c.PostForm("upload_message"),
+		AuditStatus:        0,
+		AuditReason:        "应用还在审核中",
+		AppSdkMin:          appSdkMin,
+		AppSdkTarget:       appSdkTarget,
+		AppIsWearOS:        appIsWearOS,
+		DownloadSize:       utils.FormatSizeUnits(downloadSize),
+		UploadTime:         time.Now().UnixMilli(),
+		UpdateTime:         time.Now().UnixMilli(),
+		LocalIconPath:      relativeIconPath,
+		AppIconVariants:    iconVariantsJSON,
+		UploadState:        uploadAwaitingBinary,
 	}
 
 	tx := db.DB.Begin()
@@ -209,27 +238,58 @@ func PreUploadApp(c *gin.Context) {
 		return
 	}
 
-	uploadToken, err := utils.GetUploadToken(remoteApkPath)
-	if err != nil {
+	if err := tx.Model(&app).Update("local_apk_path", remoteApkPath).Error; err != nil {
 		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "获取文件上传凭证失败: " + err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "更新应用APK路径失败: " + err.Error()})
 		return
 	}
 
-	if err := tx.Model(&app).Update("local_apk_path", remoteApkPath).Error; err != nil {
+	version := models.AppVersion{
+		AppID:        app.ID,
+		VersionCode:  app.VersionCode,
+		VersionName:  app.VersionName,
+		UpdateLog:    app.AppUpdateLog,
+		ApkPath:      remoteApkPath,
+		DownloadSize: app.DownloadSize,
+		AppSdkMin:    app.AppSdkMin,
+		AppSdkTarget: app.AppSdkTarget,
+		AppABI:       app.AppABI,
+		AppIsWearOS:  app.AppIsWearOS,
+		AuditStatus:  0,
+		AuditReason:  app.AuditReason,
+		UploadState:  uploadAwaitingBinary,
+		IsCurrent:    1,
+		ByUserID:     currentUser.ID,
+		UploadTime:   app.UploadTime,
+	}
+	if err := tx.Create(&version).Error; err != nil {
 		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "更新应用APK路径失败: " + err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "创建版本记录失败: " + err.Error()})
 		return
 	}
 
 	tx.Commit()
 
+	uploadToken, err := apkUploadToken(remoteApkPath)
+	if err != nil {
+		db.DB.Transaction(func(tx *gorm.DB) error {
+			tx.Delete(&version)
+			tx.Delete(&defaultDownload)
+			return tx.Delete(&app).Error
+		})
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "获取文件上传凭证失败: " + err.Error()})
+		return
+	}
+	retainMedia(mediaOwnerApp, app.ID, liveMediaPaths(app))
+
 	c.JSON(http.StatusOK, gin.H{
 		"code": 200,
 		"msg":  "元数据上传成功，请继续上传APK文件",
 		"data": gin.H{
 			"upload_token": uploadToken,
+			"upload_url":   resumableUploadURL,
 			"app_id":       app.ID,
+			"version_id":   version.ID,
 		},
 	})
 }
@@ -237,7 +297,6 @@ func PreUploadApp(c *gin.Context) {
 func UpdateApp(c *gin.Context) {
 	id, _ := strconv.Atoi(c.Param("id"))
 	currentUser := c.MustGet("user").(models.User)
-	baseURL := viper.GetString("server.base_url")
 
 	var app models.App
 	if err := db.DB.First(&app, id).Error; err != nil {
@@ -245,7 +304,7 @@ func UpdateApp(c *gin.Context) {
 		return
 	}
 
-	if app.ByUserID != currentUser.ID && currentUser.UserPermission < 3 {
+	if app.ByUserID != currentUser.ID && !middleware.HasPermission(c, "app.edit_any") {
 		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权修改此应用"})
 		return
 	}
@@ -257,82 +316,77 @@ func UpdateApp(c *gin.Context) {
 	}
 
 	updates := make(map[string]interface{})
-	for key, values := range form.Value {
-		if len(values) > 0 {
-			updates[key] = values[0]
+	for _, field := range appEditableFields {
+		if values := form.Value[field]; len(values) > 0 {
+			updates[field] = values[0]
 		}
 	}
 
 	iconFileHeader, ok := form.File["icon"]
 	if ok && len(iconFileHeader) > 0 {
-		if !utils.ValidateFileExtension(iconFileHeader[0].Filename, allowedImageExtensions) {
-			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "不支持的图标格式，请上传 jpg, jpeg, png, webp 格式的图片"})
-			return
-		}
-		if app.LocalIconPath != "" {
-			if err := utils.DeleteFile(app.LocalIconPath); err != nil {
-				fmt.Printf("Warning: failed to delete old icon %s: %v\n", app.LocalIconPath, err)
-			}
-		}
-		relativeNewIconPath, err := utils.SaveUploadedFile(iconFileHeader[0], viper.GetString("storage.icon_path"))
+		icon, err := utils.ProcessUploadedImage(iconFileHeader[0], mediaDir(mediaDirIcon), utils.IconImageSpec())
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "保存新图标失败: " + err.Error()})
+			respondImageError(c, "新图标", err)
 			return
 		}
-		updates["app_icon"] = fmt.Sprintf("%s/%s", baseURL, relativeNewIconPath)
-		updates["local_icon_path"] = relativeNewIconPath
+		iconVariantsJSON, _ := json.Marshal(icon.Variants)
+		updates["app_icon"] = icon.URL
+		updates["local_icon_path"] = icon.Key
+		updates["app_icon_variants"] = string(iconVariantsJSON)
+	}
+
+	keepMedia := liveMediaPaths(app)
+	knownVariants := map[string][]utils.ImageVariant{}
+	json.Unmarshal(app.AppPreviewVariants, &knownVariants)
+	if revision, ok := pendingAppRevision(db.DB, id); ok {
+		data := revisionData(revision)
+		keepMedia = append(keepMedia, pendingMediaPaths(app, data)...)
+		if raw, ok := data["app_preview_variants"].(string); ok {
+			json.Unmarshal([]byte(raw), &knownVariants)
+		}
 	}
 
 	var finalScreenshotURLs []string
+	screenshotVariants := map[string][]utils.ImageVariant{}
 	existingScreenshotsJSON := c.PostForm("existing_screenshots")
 	var keptScreenshotURLs []string
 	if err := json.Unmarshal([]byte(existingScreenshotsJSON), &keptScreenshotURLs); err == nil {
 		finalScreenshotURLs = append(finalScreenshotURLs, keptScreenshotURLs...)
-	}
-
-	var currentScreenshotURLs []string
-	if app.AppPreviews != "" {
-		json.Unmarshal([]byte(app.AppPreviews), &currentScreenshotURLs)
-	}
-
-	keptScreenshotsMap := make(map[string]bool)
-	for _, url := range keptScreenshotURLs {
-		keptScreenshotsMap[url] = true
-	}
-
-	for _, url := range currentScreenshotURLs {
-		if !keptScreenshotsMap[url] {
-			relativePath := strings.TrimPrefix(url, baseURL+"/")
-			if err := utils.DeleteFile(relativePath); err != nil {
-				fmt.Printf("Warning: failed to delete screenshot %s: %v\n", relativePath, err)
+		for _, url := range keptScreenshotURLs {
+			if variants, ok := knownVariants[url]; ok {
+				screenshotVariants[url] = variants
 			}
 		}
 	}
 
 	newScreenshotFiles := form.File["screenshots"]
 	for _, file := range newScreenshotFiles {
-		if !utils.ValidateFileExtension(file.Filename, allowedImageExtensions) {
-			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "包含不支持的截图格式，请上传 jpg, jpeg, png, webp 格式的图片"})
+		shot, err := utils.ProcessUploadedImage(file, mediaDir(mediaDirPreview), utils.ScreenshotImageSpec())
+		if errors.Is(err, utils.ErrInvalidImage) {
+			newVariantsJSON, _ := json.Marshal(screenshotVariants)
+			newIconVariants, _ := updates["app_icon_variants"].(string)
+			newIconPath, _ := updates["local_icon_path"].(string)
+			newScreenshotsJSON, _ := json.Marshal(finalScreenshotURLs)
+			releaseAppMedia(id, appMediaPaths(newIconPath, string(newScreenshotsJSON), newIconVariants, string(newVariantsJSON)), keepMedia)
+			respondImageError(c, "截图", err)
 			return
 		}
-		relativePath, err := utils.SaveUploadedFile(file, viper.GetString("storage.preview_path"))
 		if err != nil {
 			fmt.Printf("Warning: could not save new screenshot %s: %v\n", file.Filename, err)
 			continue
 		}
-		fullNewURL := fmt.Sprintf("%s/%s", baseURL, relativePath)
-		finalScreenshotURLs = append(finalScreenshotURLs, fullNewURL)
+		finalScreenshotURLs = append(finalScreenshotURLs, shot.URL)
+		screenshotVariants[shot.URL] = shot.Variants
 	}
 
 	if finalScreenshotURLs == nil {
 		finalScreenshotURLs = make([]string, 0)
 	}
 	newScreenshotsJSON, _ := json.Marshal(finalScreenshotURLs)
+	newVariantsJSON, _ := json.Marshal(screenshotVariants)
 	updates["app_previews"] = string(newScreenshotsJSON)
+	updates["app_preview_variants"] = string(newVariantsJSON)
 
-	if val, ok := updates["version_code"]; ok {
-		updates["version_code"], _ = strconv.Atoi(val.(string))
-	}
 	if val, ok := updates["app_type_id"]; ok {
 		updates["app_type"], _ = strconv.Atoi(val.(string))
 		delete(updates, "app_type_id")
@@ -344,31 +398,47 @@ func UpdateApp(c *gin.Context) {
 	if val, ok := updates["app_tags"]; ok {
 		updates["app_tags"] = fmt.Sprintf(",%s,", val.(string))
 	}
-	if val, ok := updates["app_sdk_min"]; ok {
-		updates["app_sdk_min"], _ = strconv.Atoi(val.(string))
-	}
-	if val, ok := updates["app_sdk_target"]; ok {
-		updates["app_sdk_target"], _ = strconv.Atoi(val.(string))
-	}
-	if val, ok := updates["app_abi"]; ok {
-		updates["app_abi"], _ = strconv.Atoi(val.(string))
-	}
-	if val, ok := updates["app_is_wearos"]; ok {
-		updates["app_is_wearos"], _ = strconv.Atoi(val.(string))
+
+	if app.AuditStatus == 1 {
+		revision, err := saveAppRevision(app, currentUser.ID, updates)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "保存修改失败: " + err.Error()})
+			return
+		}
+		if app.ByUserID != currentUser.ID {
+			recordAudit(c, "app.update", "app", id, nil, gin.H{"revision_id": revision.ID, "data": updates})
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"code": 200,
+			"msg":  "修改已提交审核，审核通过前将继续展示当前资料",
+			"data": gin.H{"revision_id": revision.ID},
+		})
+		return
 	}
 
 	updates["audit_status"] = 0
 	updates["audit_reason"] = "资料已更新，等待重新审核"
 	updates["update_time"] = time.Now().UnixMilli()
 
-	delete(updates, "package_name")
-	delete(updates, "existing_screenshots")
-	delete(updates, "uploader")
-
+	obsoleteMedia := liveMediaPaths(app)
+	before := app
 	if err := db.DB.Model(&app).Updates(updates).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "更新应用失败: " + err.Error()})
 		return
 	}
+	if revision, ok := pendingAppRevision(db.DB, id); ok {
+		db.DB.Model(&revision).Updates(map[string]interface{}{"status": revisionDiscarded, "update_time": time.Now().UnixMilli()})
+		obsoleteMedia = append(obsoleteMedia, pendingMediaPaths(before, revisionData(revision))...)
+	}
+	newMedia := pendingMediaPaths(before, updates)
+	retainMedia(mediaOwnerApp, id, newMedia)
+	releaseAppMedia(id, obsoleteMedia, newMedia)
+
+	if before.ByUserID != currentUser.ID {
+		var updated models.App
+		db.DB.First(&updated, id)
+		recordAudit(c, "app.update", "app", id, before, updated)
+	}
 
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "应用更新成功，已提交审核"})
 }
@@ -383,31 +453,16 @@ func DeleteApp(c *gin.Context) {
 		return
 	}
 
-	if app.ByUserID != currentUser.ID && currentUser.UserPermission < 3 {
+	if app.ByUserID != currentUser.ID && !middleware.HasPermission(c, "app.delete_any") {
 		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权删除此应用"})
 		return
 	}
 
-	if app.LocalIconPath != "" {
-		if err := utils.DeleteFile(app.LocalIconPath); err != nil {
-			fmt.Printf("Warning: failed to delete icon file %s for app ID %d: %v\n", app.LocalIconPath, app.ID, err)
-		}
-	}
-
-	if app.AppPreviews != "" {
-		var screenshotURLs []string
-		if err := json.Unmarshal([]byte(app.AppPreviews), &screenshotURLs); err == nil {
-			baseURL := viper.GetString("server.base_url")
-			for _, url := range screenshotURLs {
-				if strings.HasPrefix(url, baseURL) {
-					relativePath := strings.TrimPrefix(url, baseURL+"/")
-					if err := utils.DeleteFile(relativePath); err != nil {
-						fmt.Printf("Warning: failed to delete screenshot file %s for app ID %d: %v\n", relativePath, app.ID, err)
-					}
-				}
-			}
-		}
+	media := liveMediaPaths(app)
+	if revision, ok := pendingAppRevision(db.DB, app.ID); ok {
+		media = append(media, pendingMediaPaths(app, revisionData(revision))...)
 	}
+	releaseAppMedia(app.ID, media)
 
 	tx := db.DB.Begin()
 	if err := tx.Where("app_id = ?", id).Delete(&models.AppDownload{}).Error; err != nil {
@@ -415,6 +470,16 @@ func DeleteApp(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "删除应用下载链接失败"})
 		return
 	}
+	if err := tx.Where("app_id = ?", id).Delete(&models.AppVersion{}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "删除应用版本记录失败"})
+		return
+	}
+	if err := tx.Where("app_id = ?", id).Delete(&models.AppRevision{}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "删除应用修改记录失败"})
+		return
+	}
 	if err := tx.Delete(&app).Error; err != nil {
 		tx.Rollback()
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "删除应用失败"})
@@ -423,13 +488,17 @@ func DeleteApp(c *gin.Context) {
 
 	tx.Commit()
 
+	if app.ByUserID != currentUser.ID {
+		recordAudit(c, "app.delete", "app", id, app, nil)
+	}
+
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "应用删除成功"})
 }
 
 func ListAppDownloads(c *gin.Context) {
 	appID, _ := strconv.Atoi(c.Param("id"))
 	var downloads []models.AppDownload
-	if err := db.DB.Where("app_id = ?", appID).Order("id asc").Find(&downloads).Error; err != nil {
+	if err := db.DB.Where("app_id = ?", appID).Order("sort_order asc, id asc").Find(&downloads).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "查询下载路线失败"})
 		return
 	}
@@ -437,8 +506,11 @@ func ListAppDownloads(c *gin.Context) {
 }
 
 type AddDownloadRequest struct {
-	Name string `json:"name" binding:"required"`
-	URL  string `json:"url" binding:"required"`
+	Name    string `json:"name" binding:"required"`
+	URL     string `json:"url" binding:"required"`
+	Weight  int    `json:"weight" binding:"omitempty,min=1,max=1000"`
+	Regions string `json:"regions"`
+	ABIMask int    `json:"abi_mask" binding:"omitempty,min=0"`
 }
 
 func AddAppDownload(c *gin.Context) {
@@ -456,13 +528,13 @@ func AddAppDownload(c *gin.Context) {
 		return
 	}
 
-	if app.ByUserID != currentUser.ID && currentUser.UserPermission < 1 {
+	if app.ByUserID != currentUser.ID && !middleware.HasPermission(c, "app.download.audit") {
 		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权为该应用添加路线"})
 		return
 	}
 
 	auditStatus := 0
-	if currentUser.UserPermission >= 1 {
+	if middleware.HasPermission(c, "app.download.audit") {
 		auditStatus = 1
 	}
 
@@ -472,6 +544,10 @@ func AddAppDownload(c *gin.Context) {
 		URL:         req.URL,
 		IsExtra:     -1,
 		AuditStatus: auditStatus,
+		SortOrder:   nextDownloadSortOrder(appID),
+		Weight:      req.Weight,
+		Regions:     normalizeRegions(req.Regions),
+		ABIMask:     req.ABIMask,
 	}
 
 	if err := db.DB.Create(&download).Error; err != nil {
@@ -492,7 +568,7 @@ func DeleteAppDownload(c *gin.Context) {
 		return
 	}
 
-	if download.App.ByUserID != currentUser.ID && currentUser.UserPermission < 3 {
+	if download.App.ByUserID != currentUser.ID && !middleware.HasPermission(c, "app.delete_any") {
 		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权删除该路线"})
 		return
 	}
@@ -502,6 +578,10 @@ func DeleteAppDownload(c *gin.Context) {
 		return
 	}
 
+	if download.App.ByUserID != currentUser.ID {
+		recordAudit(c, "app_download.delete", "app_download", downloadID, download, nil)
+	}
+
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "删除成功"})
 }
 
@@ -535,16 +615,57 @@ func AuditApp(c *gin.Context) {
 		return
 	}
 
+	if req.Success && (app.UploadState == uploadAwaitingBinary || app.UploadState == uploadExpired) {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "应用APK尚未上传完成，无法审核通过"})
+		return
+	}
+
+	if app.AuditStatus == 1 {
+		if revision, ok := pendingAppRevision(db.DB, app.ID); ok {
+			auditAppRevision(c, app, revision, req)
+			return
+		}
+	}
+
 	updates := map[string]interface{}{
 		"audit_status": newStatus,
 		"audit_reason": req.Reason,
 		"audit_user":   currentUser.ID,
 	}
 
-	if err := db.DB.Model(&app).Updates(updates).Error; err != nil {
+	before := gin.H{"audit_status": app.AuditStatus, "audit_reason": app.AuditReason, "audit_user": app.AuditUser}
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		var version models.AppVersion
+		if err := tx.Where("app_id = ? AND is_current = ?", app.ID, 1).First(&version).Error; err == nil && version.AuditStatus != 1 {
+			if newStatus == 1 {
+				if err := approveVersionSignature(tx, &app, &version, currentUser.ID); err != nil {
+					return err
+				}
+			}
+			if err := tx.Model(&version).Updates(map[string]interface{}{
+				"audit_status": newStatus,
+				"audit_reason": req.Reason,
+				"audit_user":   currentUser.ID,
+				"audit_time":   time.Now().UnixMilli(),
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&app).Updates(updates).Error
+	})
+	if errors.Is(err, errSignatureMismatch) {
+		c.JSON(http.StatusConflict, gin.H{"code": 409, "msg": "APK签名与该包名已发布版本不一致，需管理员先确认签名轮换"})
+		return
+	}
+	if errors.Is(err, errVersionUninspected) {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "应用APK尚未通过检查，无法审核通过"})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "审核操作失败: " + err.Error()})
 		return
 	}
+	recordAudit(c, "app.audit", "app", app.ID, before, updates)
 
 	var title, content string
 	if newStatus == 1 {
@@ -581,34 +702,43 @@ func GetAppDownloadTestURL(c *gin.Context) {
 	}
 
 	var downloads []models.AppDownload
-	if err := db.DB.Where("app_id = ? AND audit_status = 1", appID).Order("id asc").Find(&downloads).Error; err != nil {
+	if err := db.DB.Where("app_id = ? AND audit_status = 1", appID).Order("sort_order asc, id asc").Find(&downloads).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "查询下载链接失败: " + err.Error()})
 		return
 	}
 
-	fileServerApiURL := viper.GetString("file_server.api_url")
-	if fileServerApiURL == "" {
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "文件服务器地址未配置"})
-		return
+	var remotePaths []string
+	localPaths := map[string]bool{}
+	for _, download := range downloads {
+		if download.IsExtra != 1 {
+			continue
+		}
+		if apkStoredLocally(download.URL) {
+			localPaths[download.URL] = true
+		} else {
+			remotePaths = append(remotePaths, download.URL)
+		}
+	}
+	var tokens map[string]string
+	if len(remotePaths) > 0 {
+		tokens, err = utils.DefaultFileServer.DownloadTokens(remotePaths)
+		if err != nil {
+			fmt.Printf("Error getting download tokens for app %d: %v\n", appID, err)
+		}
 	}
 
 	var processedDownloads []DownloadLinkResponse
 
 	for _, download := range downloads {
-		var finalURL string
-
+		finalURL := download.URL
 		if download.IsExtra == 1 {
-			apkPath := fmt.Sprintf("apks/%d.apk", download.AppID)
-
-			token, err := utils.GetDownloadToken(apkPath)
-			if err != nil {
-				fmt.Printf("Error getting download token for path %s: %v\n", apkPath, err)
+			if localPaths[download.URL] {
+				finalURL = utils.DefaultStorage.URL(download.URL)
+			} else if token, ok := tokens[download.URL]; ok {
+				finalURL = utils.DefaultFileServer.DownloadURL(token)
+			} else {
 				continue
 			}
-
-			finalURL = fmt.Sprintf("%s/download?token=%s", fileServerApiURL, token)
-		} else {
-			finalURL = download.URL
 		}
 
 		processedDownloads = append(processedDownloads, DownloadLinkResponse{
@@ -655,11 +785,20 @@ func AuditAppDownload(c *gin.Context) {
 		newStatus = 1
 	}
 
+	var download models.AppDownload
+	if err := db.DB.First(&download, downloadID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "下载路线不存在"})
+		return
+	}
+
 	if err := db.DB.Model(&models.AppDownload{}).Where("id = ?", downloadID).Update("audit_status", newStatus).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "审核操作失败"})
 		return
 	}
 
+	recordAudit(c, "app_download.audit", "app_download", downloadID,
+		gin.H{"audit_status": download.AuditStatus}, gin.H{"audit_status": newStatus, "reason": req.Reason})
+
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "审核成功"})
 }
 
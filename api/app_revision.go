@@ -0,0 +1,319 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"market-api/db"
+	"market-api/middleware"
+	"market-api/models"
+	"market-api/utils"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	revisionPending   = 0
+	revisionApplied   = 1
+	revisionRejected  = 2
+	revisionDiscarded = 3
+)
+
+type AppRevisionDiff struct {
+	Field   string      `json:"field"`
+	Live    interface{} `json:"live"`
+	Pending interface{} `json:"pending"`
+}
+
+func revisionData(revision models.AppRevision) map[string]interface{} {
+	data := map[string]interface{}{}
+	decoder := json.NewDecoder(strings.NewReader(revision.Data))
+	decoder.UseNumber()
+	decoder.Decode(&data)
+	return data
+}
+
+func imageVariantURLs(raw string) []string {
+	var urls []string
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch value := v.(type) {
+		case map[string]interface{}:
+			if url, ok := value["url"].(string); ok {
+				urls = append(urls, url)
+			}
+			for _, item := range value {
+				walk(item)
+			}
+		case []interface{}:
+			for _, item := range value {
+				walk(item)
+			}
+		}
+	}
+	var parsed interface{}
+	if json.Unmarshal([]byte(raw), &parsed) == nil {
+		walk(parsed)
+	}
+	return urls
+}
+
+func appMediaPaths(iconPath, previews string, variants ...string) []string {
+	var paths []string
+	if iconPath != "" {
+		paths = append(paths, iconPath)
+	}
+	var urls []string
+	json.Unmarshal([]byte(previews), &urls)
+	for _, url := range urls {
+		if path, ok := utils.StorageKeyFromURL(url); ok {
+			paths = append(paths, path)
+		}
+	}
+	for _, raw := range variants {
+		for _, url := range imageVariantURLs(raw) {
+			if path, ok := utils.StorageKeyFromURL(url); ok {
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths
+}
+
+func liveMediaPaths(app models.App) []string {
+	return appMediaPaths(app.LocalIconPath, app.AppPreviews, string(app.AppIconVariants), string(app.AppPreviewVariants))
+}
+
+func pendingMediaPaths(app models.App, data map[string]interface{}) []string {
+	iconPath, previews := app.LocalIconPath, app.AppPreviews
+	iconVariants, previewVariants := string(app.AppIconVariants), string(app.AppPreviewVariants)
+	if value, ok := data["local_icon_path"].(string); ok {
+		iconPath = value
+	}
+	if value, ok := data["app_previews"].(string); ok {
+		previews = value
+	}
+	if value, ok := data["app_icon_variants"].(string); ok {
+		iconVariants = value
+	}
+	if value, ok := data["app_preview_variants"].(string); ok {
+		previewVariants = value
+	}
+	return appMediaPaths(iconPath, previews, iconVariants, previewVariants)
+}
+
+func releaseAppMedia(appID int, candidates []string, keep ...[]string) {
+	referenced := map[string]bool{}
+	for _, paths := range keep {
+		for _, path := range paths {
+			referenced[path] = true
+		}
+	}
+	var obsolete []string
+	for _, path := range candidates {
+		if referenced[path] {
+			continue
+		}
+		referenced[path] = true
+		obsolete = append(obsolete, path)
+	}
+	releaseMedia(mediaOwnerApp, appID, obsolete)
+}
+
+func pendingAppRevision(tx *gorm.DB, appID int) (models.AppRevision, bool) {
+	var revision models.AppRevision
+	err := tx.Where("app_id = ? AND status = ?", appID, revisionPending).Order("id desc").First(&revision).Error
+	return revision, err == nil
+}
+
+func saveAppRevision(app models.App, userID int, updates map[string]interface{}) (models.AppRevision, error) {
+	now := time.Now().UnixMilli()
+	revision, exists := pendingAppRevision(db.DB, app.ID)
+
+	data := map[string]interface{}{}
+	var previousMedia []string
+	if exists {
+		data = revisionData(revision)
+		previousMedia = pendingMediaPaths(app, data)
+	}
+	for key, value := range updates {
+		data[key] = value
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return revision, err
+	}
+
+	if exists {
+		err = db.DB.Model(&revision).Updates(map[string]interface{}{
+			"data":        string(raw),
+			"by_userid":   userID,
+			"update_time": now,
+		}).Error
+	} else {
+		revision = models.AppRevision{
+			AppID:      app.ID,
+			ByUserID:   userID,
+			Data:       string(raw),
+			Status:     revisionPending,
+			CreateTime: now,
+			UpdateTime: now,
+		}
+		err = db.DB.Create(&revision).Error
+	}
+	if err != nil {
+		return revision, err
+	}
+
+	pendingMedia := pendingMediaPaths(app, data)
+	retainMedia(mediaOwnerApp, app.ID, pendingMedia)
+	releaseAppMedia(app.ID, previousMedia, pendingMedia, liveMediaPaths(app))
+	return revision, nil
+}
+
+func appColumnValues(app models.App) map[string]interface{} {
+	values := map[string]interface{}{}
+	stmt := &gorm.Statement{DB: db.DB}
+	if err := stmt.Parse(&models.App{}); err != nil {
+		return values
+	}
+	rv := reflect.ValueOf(app)
+	for _, field := range stmt.Schema.Fields {
+		if field.DBName == "" {
+			continue
+		}
+		values[field.DBName], _ = field.ValueOf(context.Background(), rv)
+	}
+	return values
+}
+
+func appRevisionDiff(app models.App, data map[string]interface{}) []AppRevisionDiff {
+	live := appColumnValues(app)
+
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	diff := make([]AppRevisionDiff, 0, len(keys))
+	for _, key := range keys {
+		if fmt.Sprint(live[key]) == fmt.Sprint(data[key]) {
+			continue
+		}
+		diff = append(diff, AppRevisionDiff{Field: key, Live: live[key], Pending: data[key]})
+	}
+	return diff
+}
+
+func GetAppRevision(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	currentUser := c.MustGet("user").(models.User)
+
+	var app models.App
+	if err := db.DB.First(&app, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "应用不存在"})
+		return
+	}
+
+	if app.ByUserID != currentUser.ID && !middleware.HasPermission(c, "app.audit") && !middleware.HasPermission(c, "app.view_all") {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权查看此应用的修改"})
+		return
+	}
+
+	revision, ok := pendingAppRevision(db.DB, app.ID)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "该应用没有待审核的修改"})
+		return
+	}
+
+	data := revisionData(revision)
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"data": gin.H{
+			"revision": revision,
+			"pending":  data,
+			"diff":     appRevisionDiff(app, data),
+		},
+	})
+}
+
+func auditAppRevision(c *gin.Context, app models.App, revision models.AppRevision, req AuditRequest) {
+	currentUser := c.MustGet("user").(models.User)
+	now := time.Now().UnixMilli()
+	data := revisionData(revision)
+	diff := appRevisionDiff(app, data)
+	liveMedia := liveMediaPaths(app)
+	pendingMedia := pendingMediaPaths(app, data)
+
+	status := revisionRejected
+	if req.Success {
+		status = revisionApplied
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if req.Success {
+			updates := map[string]interface{}{}
+			for key, value := range data {
+				updates[key] = value
+			}
+			updates["audit_user"] = currentUser.ID
+			updates["update_time"] = now
+			if err := tx.Model(&app).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&revision).Updates(map[string]interface{}{
+			"status":       status,
+			"audit_user":   currentUser.ID,
+			"audit_reason": req.Reason,
+			"audit_time":   now,
+		}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "审核操作失败: " + err.Error()})
+		return
+	}
+
+	if req.Success {
+		releaseAppMedia(app.ID, liveMedia, pendingMedia)
+	} else {
+		releaseAppMedia(app.ID, pendingMedia, liveMedia)
+	}
+
+	before := gin.H{}
+	after := gin.H{"revision_id": revision.ID, "revision_status": status, "reason": req.Reason}
+	for _, change := range diff {
+		before[change.Field] = change.Live
+		after[change.Field] = change.Pending
+	}
+	recordAudit(c, "app.revision_audit", "app", app.ID, before, after)
+
+	var title, content string
+	if req.Success {
+		title = "应用资料修改审核通过"
+		content = fmt.Sprintf("您对「%s」提交的资料修改已由审核员【%s】审核通过。", app.AppName, currentUser.DisplayName)
+	} else {
+		title = "应用资料修改审核不通过"
+		content = fmt.Sprintf("您对「%s」提交的资料修改被审核员【%s】驳回，应用仍展示原有资料，原因：%s", app.AppName, currentUser.DisplayName, req.Reason)
+	}
+
+	notice := models.Notice{
+		ByUserID:     app.ByUserID,
+		SenderUserID: -1,
+		Title:        title,
+		Content:      content,
+		Time:         now,
+		Actions:      "[]",
+	}
+	db.DB.Create(&notice)
+
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "审核操作成功"})
+}
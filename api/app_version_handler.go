@@ -0,0 +1,340 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"market-api/db"
+	"market-api/middleware"
+	"market-api/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func InitAppVersions() error {
+	return db.DB.Exec(`INSERT INTO market_app_version_list
+		(app_id, version_code, version_name, update_log, apk_path, download_size, app_sdk_min, app_sdk_target, app_abi, app_is_wearos,
+		apk_inspect_time, signing_cert, signing_certs, signing_subject, signature_status, upload_state, audit_status, audit_reason, audit_user, audit_time, is_current, by_userid, upload_time)
+		SELECT id, version_code, version_name, app_update_log, local_apk_path, download_size, app_sdk_min, app_sdk_target, app_abi, app_is_wearos,
+		apk_inspect_time, signing_cert, signing_certs, signing_subject, signature_status, upload_state, audit_status, audit_reason, audit_user, update_time, 1, by_userid, update_time
+		FROM market_app_list WHERE id NOT IN (SELECT app_id FROM market_app_version_list)`).Error
+}
+
+func publishAppVersion(tx *gorm.DB, app *models.App, version *models.AppVersion) error {
+	if err := tx.Model(&models.AppVersion{}).Where("app_id = ? AND id <> ?", app.ID, version.ID).Update("is_current", 0).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(version).Update("is_current", 1).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&models.AppDownload{}).Where("app_id = ? AND is_extra = ?", app.ID, 1).Update("url", version.ApkPath).Error; err != nil {
+		return err
+	}
+	return tx.Model(app).Updates(map[string]interface{}{
+		"version_code":     version.VersionCode,
+		"version_name":     version.VersionName,
+		"app_update_log":   version.UpdateLog,
+		"download_size":    version.DownloadSize,
+		"app_sdk_min":      version.AppSdkMin,
+		"app_sdk_target":   version.AppSdkTarget,
+		"app_abi":          version.AppABI,
+		"app_is_wearos":    version.AppIsWearOS,
+		"local_apk_path":   version.ApkPath,
+		"apk_inspect_time": version.ApkInspectTime,
+		"signing_cert":     version.SigningCert,
+		"signing_certs":    version.SigningCerts,
+		"signing_subject":  version.SigningSubject,
+		"signature_status": version.SignatureStatus,
+		"update_time":      time.Now().UnixMilli(),
+	}).Error
+}
+
+func loadAppVersion(c *gin.Context) (models.App, models.AppVersion, bool) {
+	appID, _ := strconv.Atoi(c.Param("id"))
+	versionID, _ := strconv.Atoi(c.Param("version_id"))
+
+	var app models.App
+	var version models.AppVersion
+	if err := db.DB.First(&app, appID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "应用不存在"})
+		return app, version, false
+	}
+	if err := db.DB.Where("id = ? AND app_id = ?", versionID, app.ID).First(&version).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "版本不存在"})
+		return app, version, false
+	}
+	return app, version, true
+}
+
+func ListAppVersions(c *gin.Context) {
+	appID, _ := strconv.Atoi(c.Param("id"))
+	currentUser := c.MustGet("user").(models.User)
+
+	var app models.App
+	if err := db.DB.First(&app, appID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "应用不存在"})
+		return
+	}
+
+	query := db.DB.Where("app_id = ?", app.ID)
+	if app.ByUserID != currentUser.ID && !middleware.HasPermission(c, "app.view_all") {
+		query = query.Where("audit_status = ?", 1)
+	}
+
+	var versions []models.AppVersion
+	if err := query.Order("id desc").Find(&versions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "查询版本记录失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 200, "data": versions})
+}
+
+type CreateAppVersionRequest struct {
+	VersionCode int    `json:"version_code"`
+	VersionName string `json:"version_name"`
+	UpdateLog   string `json:"update_log" binding:"required"`
+}
+
+func CreateAppVersion(c *gin.Context) {
+	appID, _ := strconv.Atoi(c.Param("id"))
+	currentUser := c.MustGet("user").(models.User)
+	var req CreateAppVersionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "参数错误，必须填写更新日志"})
+		return
+	}
+
+	var app models.App
+	if err := db.DB.First(&app, appID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "应用不存在"})
+		return
+	}
+
+	if app.ByUserID != currentUser.ID && !middleware.HasPermission(c, "app.edit_any") {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权为此应用发布新版本"})
+		return
+	}
+
+	var current models.AppVersion
+	if err := db.DB.Where("app_id = ? AND is_current = ?", app.ID, 1).First(&current).Error; err != nil || current.AuditStatus != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "应用尚未有审核通过的版本，请先等待首个版本审核"})
+		return
+	}
+
+	var pending int64
+	db.DB.Model(&models.AppVersion{}).Where("app_id = ? AND audit_status = ? AND is_current = ?", app.ID, 0, 0).Count(&pending)
+	if pending > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "该应用已有待审核的新版本，请等待审核完成"})
+		return
+	}
+
+	if req.VersionCode != 0 && req.VersionCode <= app.VersionCode {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": fmt.Sprintf("版本号必须高于当前已发布的版本号 %d", app.VersionCode)})
+		return
+	}
+
+	tx := db.DB.Begin()
+
+	version := models.AppVersion{
+		AppID:       app.ID,
+		VersionCode: req.VersionCode,
+		VersionName: req.VersionName,
+		UpdateLog:   req.UpdateLog,
+		AuditStatus: 0,
+		AuditReason: "等待上传APK",
+		UploadState: uploadAwaitingBinary,
+		ByUserID:    currentUser.ID,
+		UploadTime:  time.Now().UnixMilli(),
+	}
+	if err := tx.Create(&version).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "创建版本记录失败: " + err.Error()})
+		return
+	}
+
+	remoteApkPath := fmt.Sprintf("apks/%d/%d.apk", app.ID, version.ID)
+	if err := tx.Model(&version).Update("apk_path", remoteApkPath).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "更新版本APK路径失败: " + err.Error()})
+		return
+	}
+
+	tx.Commit()
+
+	uploadToken, err := apkUploadToken(remoteApkPath)
+	if err != nil {
+		db.DB.Delete(&version)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "获取文件上传凭证失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "版本信息已创建，请继续上传APK文件",
+		"data": gin.H{
+			"upload_token": uploadToken,
+			"upload_url":   resumableUploadURL,
+			"app_id":       app.ID,
+			"version_id":   version.ID,
+		},
+	})
+}
+
+func CompleteAppVersionUpload(c *gin.Context) {
+	app, version, ok := loadAppVersion(c)
+	if !ok {
+		return
+	}
+
+	currentUser := c.MustGet("user").(models.User)
+	if app.ByUserID != currentUser.ID && !middleware.HasPermission(c, "app.edit_any") {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权操作此应用"})
+		return
+	}
+
+	inspectAppVersion(c, &app, &version)
+}
+
+func AuditAppVersion(c *gin.Context) {
+	var req AuditRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "参数错误: " + err.Error()})
+		return
+	}
+
+	app, version, ok := loadAppVersion(c)
+	if !ok {
+		return
+	}
+
+	if version.AuditStatus != 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "该版本不在待审核状态"})
+		return
+	}
+	if !req.Success && req.Reason == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "驳回版本必须填写原因"})
+		return
+	}
+	if req.Success && (version.ApkInspectTime == 0 || version.SigningCert == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "该版本的APK尚未上传或未通过检查"})
+		return
+	}
+
+	currentUser := c.MustGet("user").(models.User)
+	newStatus := 2
+	if req.Success {
+		newStatus = 1
+	}
+
+	updates := map[string]interface{}{
+		"audit_status": newStatus,
+		"audit_reason": req.Reason,
+		"audit_user":   currentUser.ID,
+		"audit_time":   time.Now().UnixMilli(),
+	}
+
+	before := gin.H{"audit_status": version.AuditStatus, "audit_reason": version.AuditReason, "version_code": app.VersionCode}
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if newStatus == 1 {
+			if err := approveVersionSignature(tx, &app, &version, currentUser.ID); err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(&version).Updates(updates).Error; err != nil {
+			return err
+		}
+		if newStatus == 1 {
+			return publishAppVersion(tx, &app, &version)
+		}
+		return nil
+	})
+	if errors.Is(err, errSignatureMismatch) {
+		c.JSON(http.StatusConflict, gin.H{"code": 409, "msg": "APK签名与该包名已发布版本不一致，需管理员先确认签名轮换"})
+		return
+	}
+	if errors.Is(err, errVersionUninspected) {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "该版本的APK尚未上传或未通过检查"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "审核操作失败: " + err.Error()})
+		return
+	}
+	recordAudit(c, "app_version.audit", "app_version", version.ID, before,
+		gin.H{"audit_status": newStatus, "audit_reason": req.Reason, "version_code": version.VersionCode})
+
+	var title, content string
+	if newStatus == 1 {
+		title = "新版本审核通过"
+		content = fmt.Sprintf("您提交的「%s」%s 版本已由审核员【%s】审核通过并发布。", app.AppName, version.VersionName, currentUser.DisplayName)
+	} else {
+		title = "新版本审核不通过"
+		content = fmt.Sprintf("您提交的「%s」%s 版本被审核员【%s】驳回，原因：%s", app.AppName, version.VersionName, currentUser.DisplayName, req.Reason)
+	}
+
+	notice := models.Notice{
+		ByUserID:     app.ByUserID,
+		SenderUserID: -1,
+		Title:        title,
+		Content:      content,
+		Time:         time.Now().UnixMilli(),
+		Actions:      "[]",
+	}
+	db.DB.Create(&notice)
+
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "审核操作成功"})
+}
+
+func RollbackAppVersion(c *gin.Context) {
+	var req struct {
+		Reason string `json:"reason" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "参数错误，必须填写回滚原因"})
+		return
+	}
+
+	app, version, ok := loadAppVersion(c)
+	if !ok {
+		return
+	}
+
+	if version.AuditStatus != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "只能回滚到审核通过的版本"})
+		return
+	}
+	if version.IsCurrent == 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "该版本已是当前版本"})
+		return
+	}
+	if version.SigningCert != "" && signingKeyStatus(db.DB, app.PackageName, versionFingerprints(version)) != signatureTrusted {
+		c.JSON(http.StatusConflict, gin.H{"code": 409, "msg": "该版本的签名证书已被撤销，无法回滚"})
+		return
+	}
+
+	before := gin.H{"version_code": app.VersionCode, "version_name": app.VersionName, "apk_path": app.LocalApkPath}
+	if err := db.DB.Transaction(func(tx *gorm.DB) error {
+		return publishAppVersion(tx, &app, &version)
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "回滚版本失败: " + err.Error()})
+		return
+	}
+	recordAudit(c, "app_version.rollback", "app", app.ID, before,
+		gin.H{"version_code": version.VersionCode, "version_name": version.VersionName, "apk_path": version.ApkPath, "version_id": version.ID, "reason": req.Reason})
+
+	currentUser := c.MustGet("user").(models.User)
+	notice := models.Notice{
+		ByUserID:     app.ByUserID,
+		SenderUserID: -1,
+		Title:        "应用版本已回滚",
+		Content:      fmt.Sprintf("您上传的「%s」已由管理员【%s】回滚至 %s 版本，原因：%s", app.AppName, currentUser.DisplayName, version.VersionName, req.Reason),
+		Time:         time.Now().UnixMilli(),
+		Actions:      "[]",
+	}
+	db.DB.Create(&notice)
+
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "版本回滚成功"})
+}
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"market-api/db"
+	"market-api/models"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func auditMap(v interface{}) map[string]interface{} {
+	if v == nil {
+		return nil
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		var value interface{}
+		json.Unmarshal(raw, &value)
+		return map[string]interface{}{"value": value}
+	}
+	return m
+}
+
+func auditJSON(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(raw)
+}
+
+func auditChanges(before, after map[string]interface{}) map[string][2]interface{} {
+	changes := map[string][2]interface{}{}
+	for key, old := range before {
+		if value, ok := after[key]; !ok || !reflect.DeepEqual(old, value) {
+			changes[key] = [2]interface{}{old, after[key]}
+		}
+	}
+	for key, value := range after {
+		if _, ok := before[key]; !ok {
+			changes[key] = [2]interface{}{nil, value}
+		}
+	}
+	return changes
+}
+
+func recordAudit(c *gin.Context, action, targetType string, targetID int, before, after interface{}) {
+	beforeMap := auditMap(before)
+	afterMap := auditMap(after)
+
+	entry := models.AuditLog{
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Before:     auditJSON(beforeMap),
+		After:      auditJSON(afterMap),
+		Changes:    auditJSON(auditChanges(beforeMap, afterMap)),
+		IP:         c.ClientIP(),
+		UserAgent:  c.GetHeader("User-Agent"),
+		CreateTime: time.Now().UnixMilli(),
+	}
+	if actor, ok := c.Get("user"); ok {
+		entry.ActorID = actor.(models.User).ID
+		entry.ActorName = actor.(models.User).DisplayName
+	}
+
+	if err := db.DB.Create(&entry).Error; err != nil {
+		fmt.Printf("Warning: failed to write audit log %s %s#%d: %v\n", action, targetType, targetID, err)
+	}
+}
+
+func auditLogQuery(c *gin.Context) *gorm.DB {
+	query := db.DB.Model(&models.AuditLog{})
+
+	if actorID := c.Query("actor_id"); actorID != "" {
+		query = query.Where("actor_id = ?", actorID)
+	}
+	if action := c.Query("action"); action != "" {
+		query = query.Where("action = ?", action)
+	}
+	if targetType := c.Query("target_type"); targetType != "" {
+		query = query.Where("target_type = ?", targetType)
+	}
+	if targetID := c.Query("target_id"); targetID != "" {
+		query = query.Where("target_id = ?", targetID)
+	}
+	if startTime, _ := strconv.ParseInt(c.Query("start_time"), 10, 64); startTime > 0 {
+		query = query.Where("create_time >= ?", startTime)
+	}
+	if endTime, _ := strconv.ParseInt(c.Query("end_time"), 10, 64); endTime > 0 {
+		query = query.Where("create_time <= ?", endTime)
+	}
+	if keyword := c.Query("keyword"); keyword != "" {
+		query = query.Where("actor_name LIKE ? OR ip LIKE ? OR changes LIKE ?",
+			"%"+keyword+"%", "%"+keyword+"%", "%"+keyword+"%")
+	}
+
+	return query
+}
+
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+func ListAuditLogs(c *gin.Context) {
+	query := auditLogQuery(c)
+
+	var total int64
+	query.Count(&total)
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("pageSize", "10"))
+	offset := (page - 1) * pageSize
+
+	var logs []models.AuditLog
+	query.Order("id desc").Offset(offset).Limit(pageSize).Find(&logs)
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"data": gin.H{
+			"list":  logs,
+			"total": total,
+		},
+	})
+}
+
+func ExportAuditLogs(c *gin.Context) {
+	filename := fmt.Sprintf("audit-log-%s.csv", time.Now().Format("20060102-150405"))
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", "attachment; filename="+filename)
+	c.Status(http.StatusOK)
+
+	c.Writer.Write([]byte("\xEF\xBB\xBF"))
+	writer := csv.NewWriter(c.Writer)
+	writer.Write([]string{"id", "time", "actor_id", "actor_name", "action", "target_type", "target_id", "changes", "before", "after", "ip", "user_agent"})
+
+	var logs []models.AuditLog
+	auditLogQuery(c).FindInBatches(&logs, 500, func(tx *gorm.DB, batch int) error {
+		for _, l := range logs {
+			writer.Write([]string{
+				strconv.Itoa(l.ID),
+				time.UnixMilli(l.CreateTime).Format("2006-01-02 15:04:05"),
+				strconv.Itoa(l.ActorID),
+				csvSafe(l.ActorName),
+				l.Action,
+				l.TargetType,
+				strconv.Itoa(l.TargetID),
+				csvSafe(l.Changes),
+				csvSafe(l.Before),
+				csvSafe(l.After),
+				l.IP,
+				csvSafe(l.UserAgent),
+			})
+		}
+		writer.Flush()
+		return writer.Error()
+	})
+	writer.Flush()
+}
@@ -69,19 +69,33 @@ func UpdateComment(c *gin.Context) {
 		return
 	}
 
+	var comment models.AppReply
+	if err := db.DB.First(&comment, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "评论不存在"})
+		return
+	}
+
 	if err := db.DB.Model(&models.AppReply{}).Where("id = ?", id).Update("visibility", req.Visibility).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "更新失败: " + err.Error()})
 		return
 	}
 
+	recordAudit(c, "comment.update", "comment", id, gin.H{"visibility": comment.Visibility}, gin.H{"visibility": req.Visibility})
+
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "更新成功"})
 }
 
 func DeleteComment(c *gin.Context) {
 	id, _ := strconv.Atoi(c.Param("id"))
+	var comment models.AppReply
+	if err := db.DB.First(&comment, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "评论不存在"})
+		return
+	}
 	if err := db.DB.Delete(&models.AppReply{}, id).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "删除失败: " + err.Error()})
 		return
 	}
+	recordAudit(c, "comment.delete", "comment", id, comment, nil)
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "删除成功"})
 }
@@ -0,0 +1,252 @@
+package api
+
+import (
+	"fmt"
+	"market-api/db"
+	"market-api/middleware"
+	"market-api/models"
+	"market-api/utils"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+const (
+	routeUnchecked  = 0
+	routeHealthy    = 1
+	routeSuspicious = 2
+	routeDead       = 3
+)
+
+type DownloadCheckSummary struct {
+	Checked    int `json:"checked"`
+	Healthy    int `json:"healthy"`
+	Suspicious int `json:"suspicious"`
+	Dead       int `json:"dead"`
+}
+
+var downloadCheckClient = func() *http.Client {
+	seconds := viper.GetInt("download_check.timeout_seconds")
+	if seconds <= 0 {
+		seconds = 15
+	}
+	redirects := viper.GetInt("download_check.max_redirects")
+	if redirects <= 0 {
+		redirects = 5
+	}
+	return utils.NewProbeClient(time.Duration(seconds)*time.Second, redirects)
+}
+
+func downloadDeadAfter() int {
+	if n := viper.GetInt("download_check.dead_after"); n > 0 {
+		return n
+	}
+	return 2
+}
+
+func expectedAPKSize(app models.App) int64 {
+	var version models.AppVersion
+	if err := db.DB.Select("apk_size").Where("app_id = ? AND is_current = ?", app.ID, 1).First(&version).Error; err == nil && version.ApkSize > 0 {
+		return version.ApkSize
+	}
+	size, _ := utils.ParseSizeUnits(app.DownloadSize)
+	return size
+}
+
+func evaluateProbe(probe utils.ProbeResult, expected int64) (int, string) {
+	switch {
+	case probe.Err != nil:
+		return routeDead, "请求失败: " + probe.Err.Error()
+	case !probe.OK():
+		return routeDead, fmt.Sprintf("返回状态码 %d", probe.StatusCode)
+	case probe.LooksHTML:
+		return routeSuspicious, "返回的是网页而不是APK文件"
+	case expected > 0 && probe.ContentLength > 0 && sizeMismatch(probe.ContentLength, expected):
+		return routeSuspicious, fmt.Sprintf("文件大小 %s 与应用大小 %s 不一致",
+			utils.FormatSizeUnits(probe.ContentLength), utils.FormatSizeUnits(expected))
+	}
+	return routeHealthy, ""
+}
+
+func sizeMismatch(actual, expected int64) bool {
+	diff := actual - expected
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff*100 > expected
+}
+
+func checkAppDownload(client *http.Client, download models.AppDownload, expected int64) models.AppDownloadCheck {
+	var probe utils.ProbeResult
+	if url, err := resolveDownloadURL(download); err != nil {
+		probe = utils.ProbeResult{Err: err}
+	} else {
+		probe = utils.ProbeDownloadURL(client, url)
+	}
+	health, message := evaluateProbe(probe, expected)
+
+	now := time.Now().UnixMilli()
+	check := models.AppDownloadCheck{
+		DownloadID:    download.ID,
+		AppID:         download.AppID,
+		StatusCode:    probe.StatusCode,
+		ContentLength: probe.ContentLength,
+		ContentType:   probe.ContentType,
+		LatencyMs:     probe.Latency.Milliseconds(),
+		Health:        health,
+		Message:       message,
+		Time:          now,
+	}
+	if err := db.DB.Create(&check).Error; err != nil {
+		fmt.Printf("Warning: failed to save check for download %d: %v\n", download.ID, err)
+	}
+
+	failCount := 0
+	routeHealth := health
+	if health == routeDead {
+		failCount = download.FailCount + 1
+		if failCount < downloadDeadAfter() {
+			routeHealth = download.Health
+		}
+	}
+	db.DB.Model(&models.AppDownload{}).Where("id = ?", download.ID).Updates(map[string]interface{}{
+		"health":     routeHealth,
+		"health_msg": message,
+		"fail_count": failCount,
+		"check_time": now,
+	})
+
+	if routeHealth == routeDead && download.Health != routeDead {
+		notice := models.Notice{
+			ByUserID:     download.App.ByUserID,
+			SenderUserID: -1,
+			Title:        "下载路线失效",
+			Content: fmt.Sprintf("您的应用「%s」的下载路线「%s」已连续 %d 次检测失败（%s），请及时更新或删除该路线。",
+				download.App.AppName, download.Name, failCount, message),
+			Time:    now,
+			Actions: "[]",
+		}
+		db.DB.Create(&notice)
+	}
+	return check
+}
+
+func RunDownloadChecks() DownloadCheckSummary {
+	var summary DownloadCheckSummary
+	var downloads []models.AppDownload
+	if err := db.DB.Preload("App").Where("audit_status = ?", 1).Find(&downloads).Error; err != nil {
+		fmt.Printf("Warning: failed to load download routes: %v\n", err)
+		return summary
+	}
+
+	concurrency := viper.GetInt("download_check.concurrency")
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	client := downloadCheckClient()
+	expected := map[int]int64{}
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	sem := make(chan struct{}, concurrency)
+	for _, download := range downloads {
+		if download.App.AuditStatus != 1 {
+			continue
+		}
+		if _, ok := expected[download.AppID]; !ok {
+			expected[download.AppID] = expectedAPKSize(download.App)
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(download models.AppDownload, size int64) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			check := checkAppDownload(client, download, size)
+			mu.Lock()
+			defer mu.Unlock()
+			summary.Checked++
+			switch check.Health {
+			case routeHealthy:
+				summary.Healthy++
+			case routeSuspicious:
+				summary.Suspicious++
+			case routeDead:
+				summary.Dead++
+			}
+		}(download, expected[download.AppID])
+	}
+	wg.Wait()
+
+	days := viper.GetInt("download_check.history_days")
+	if days <= 0 {
+		days = 30
+	}
+	db.DB.Where("time < ?", time.Now().AddDate(0, 0, -days).UnixMilli()).Delete(&models.AppDownloadCheck{})
+	return summary
+}
+
+func StartDownloadCheckJob() {
+	if !viper.GetBool("download_check.enabled") {
+		return
+	}
+	minutes := viper.GetInt("download_check.interval_minutes")
+	if minutes <= 0 {
+		minutes = 360
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(minutes) * time.Minute)
+		defer ticker.Stop()
+		for {
+			summary := RunDownloadChecks()
+			fmt.Printf("Download route check finished: checked=%d healthy=%d suspicious=%d dead=%d\n",
+				summary.Checked, summary.Healthy, summary.Suspicious, summary.Dead)
+			<-ticker.C
+		}
+	}()
+}
+
+func loadDownloadForCheck(c *gin.Context) (models.AppDownload, bool) {
+	downloadID, _ := strconv.Atoi(c.Param("download_id"))
+	currentUser := c.MustGet("user").(models.User)
+
+	var download models.AppDownload
+	if err := db.DB.Preload("App").First(&download, downloadID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "下载路线不存在"})
+		return download, false
+	}
+	if download.App.ByUserID != currentUser.ID && !middleware.HasPermission(c, "app.download.audit") {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权查看该路线"})
+		return download, false
+	}
+	return download, true
+}
+
+func CheckAppDownloadNow(c *gin.Context) {
+	download, ok := loadDownloadForCheck(c)
+	if !ok {
+		return
+	}
+	if download.AuditStatus != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "只能检测已通过审核的下载路线"})
+		return
+	}
+	check := checkAppDownload(downloadCheckClient(), download, expectedAPKSize(download.App))
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "检测完成", "data": check})
+}
+
+func ListAppDownloadChecks(c *gin.Context) {
+	download, ok := loadDownloadForCheck(c)
+	if !ok {
+		return
+	}
+	var checks []models.AppDownloadCheck
+	db.DB.Where("download_id = ?", download.ID).Order("id desc").Limit(100).Find(&checks)
+	c.JSON(http.StatusOK, gin.H{"code": 200, "data": checks})
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"market-api/db"
+	"market-api/models"
+	"market-api/utils"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestEvaluateProbe(t *testing.T) {
+	cases := []struct {
+		name     string
+		probe    utils.ProbeResult
+		expected int64
+		health   int
+	}{
+		{"request error", utils.ProbeResult{Err: errors.New("timeout")}, 0, routeDead},
+		{"not found", utils.ProbeResult{StatusCode: http.StatusNotFound}, 0, routeDead},
+		{"html page", utils.ProbeResult{StatusCode: http.StatusOK, LooksHTML: true}, 0, routeSuspicious},
+		{"size mismatch", utils.ProbeResult{StatusCode: http.StatusOK, ContentLength: 5000, LooksAPK: true}, 10000, routeSuspicious},
+		{"size within tolerance", utils.ProbeResult{StatusCode: http.StatusOK, ContentLength: 9950, LooksAPK: true}, 10000, routeHealthy},
+		{"unknown size", utils.ProbeResult{StatusCode: http.StatusOK, ContentLength: -1, LooksAPK: true}, 10000, routeHealthy},
+		{"no expected size", utils.ProbeResult{StatusCode: http.StatusOK, ContentLength: 5000, LooksAPK: true}, 0, routeHealthy},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			health, message := evaluateProbe(tc.probe, tc.expected)
+			if health != tc.health {
+				t.Fatalf("evaluateProbe() = %d (%s), want %d", health, message, tc.health)
+			}
+			if (health == routeHealthy) != (message == "") {
+				t.Fatalf("evaluateProbe() message = %q for health %d", message, health)
+			}
+		})
+	}
+}
+
+func TestRunDownloadChecksTracksRouteHealth(t *testing.T) {
+	setupTestDB(t, &models.App{}, &models.AppVersion{}, &models.AppDownload{}, &models.AppDownloadCheck{}, &models.Notice{})
+
+	apk := append([]byte("PK\x03\x04"), make([]byte, 4092)...)
+	var (
+		mu   sync.Mutex
+		mode = "apk"
+	)
+	setMode := func(m string) {
+		mu.Lock()
+		defer mu.Unlock()
+		mode = m
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		current := mode
+		mu.Unlock()
+		switch current {
+		case "apk":
+			w.Header().Set("Content-Type", "application/vnd.android.package-archive")
+			w.Header().Set("Content-Length", fmt.Sprint(len(apk)))
+			if r.Method == http.MethodGet {
+				w.Write(apk)
+			}
+		case "html":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte("<html><body>下载页</body></html>"))
+		default:
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	previous := downloadCheckClient
+	downloadCheckClient = server.Client
+	defer func() { downloadCheckClient = previous }()
+
+	db.DB.Create(&models.App{ID: 1, AppName: "测试应用", AuditStatus: 1, ByUserID: 7})
+	db.DB.Create(&models.AppVersion{AppID: 1, IsCurrent: 1, ApkSize: int64(len(apk))})
+	db.DB.Create(&models.AppDownload{ID: 1, AppID: 1, Name: "主线路", URL: server.URL + "/app.apk", AuditStatus: 1, Enabled: 1})
+
+	route := func() models.AppDownload {
+		var download models.AppDownload
+		db.DB.First(&download, 1)
+		return download
+	}
+	notices := func() int64 {
+		var count int64
+		db.DB.Model(&models.Notice{}).Where("by_userid = ?", 7).Count(&count)
+		return count
+	}
+
+	steps := []struct {
+		mode      string
+		checked   int
+		health    int
+		failCount int
+		notices   int64
+	}{
+		{"apk", routeHealthy, routeHealthy, 0, 0},
+		{"down", routeDead, routeHealthy, 1, 0},
+		{"down", routeDead, routeDead, 2, 1},
+		{"down", routeDead, routeDead, 3, 1},
+		{"apk", routeHealthy, routeHealthy, 0, 1},
+		{"html", routeSuspicious, routeSuspicious, 0, 1},
+		{"down", routeDead, routeSuspicious, 1, 1},
+		{"down", routeDead, routeDead, 2, 2},
+	}
+	for i, step := range steps {
+		setMode(step.mode)
+		summary := RunDownloadChecks()
+		if summary.Checked != 1 {
+			t.Fatalf("step %d: checked %d routes, want 1", i, summary.Checked)
+		}
+		var check models.AppDownloadCheck
+		db.DB.Order("id desc").First(&check)
+		download := route()
+		if check.Health != step.checked || download.Health != step.health || download.FailCount != step.failCount {
+			t.Fatalf("step %d (%s): check health %d, route health %d, fail_count %d; want %d, %d, %d",
+				i, step.mode, check.Health, download.Health, download.FailCount, step.checked, step.health, step.failCount)
+		}
+		if n := notices(); n != step.notices {
+			t.Fatalf("step %d (%s): %d notices, want %d", i, step.mode, n, step.notices)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"market-api/db"
+	"market-api/middleware"
+	"market-api/models"
+	"market-api/utils"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type RouteDownloadCount struct {
+	DownloadID int    `json:"download_id"`
+	Name       string `json:"name"`
+	Count      int64  `json:"count"`
+}
+
+type AppDownloadCount struct {
+	AppID   int    `json:"app_id"`
+	AppName string `json:"app_name"`
+	Count   int64  `json:"count"`
+}
+
+func downloadDedupeWindow() time.Duration {
+	minutes := viper.GetInt("download.dedupe_minutes")
+	if minutes <= 0 {
+		minutes = 30
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+func resolveDownloadURL(download models.AppDownload) (string, error) {
+	if download.IsExtra != 1 {
+		return download.URL, nil
+	}
+	if apkStoredLocally(download.URL) {
+		return utils.DefaultStorage.URL(download.URL), nil
+	}
+	token, err := utils.DefaultFileServer.DownloadToken(download.URL)
+	if err != nil {
+		return "", err
+	}
+	return utils.DefaultFileServer.DownloadURL(token), nil
+}
+
+func downloadClientHash(c *gin.Context) string {
+	sum := sha256.Sum256([]byte(c.ClientIP() + "|" + c.GetHeader("User-Agent")))
+	return hex.EncodeToString(sum[:])
+}
+
+func recordAppDownload(c *gin.Context, app models.App, download models.AppDownload) {
+	now := time.Now()
+	event := models.AppDownloadEvent{
+		AppID:      app.ID,
+		DownloadID: download.ID,
+		ClientHash: downloadClientHash(c),
+		Bucket:     now.UnixMilli() / downloadDedupeWindow().Milliseconds(),
+		Time:       now.UnixMilli(),
+	}
+	result := db.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&event)
+	if result.Error != nil {
+		fmt.Printf("Warning: failed to record download event for app %d: %v\n", app.ID, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		return
+	}
+
+	year, month, day := now.Date()
+	stat := models.AppDownloadStat{
+		AppID:       app.ID,
+		DownloadID:  download.ID,
+		Day:         time.Date(year, month, day, 0, 0, 0, 0, now.Location()).Unix(),
+		DeveloperID: app.ByUserID,
+		Count:       1,
+	}
+	err := db.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "app_id"}, {Name: "download_id"}, {Name: "day"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"count": gorm.Expr("count + 1")}),
+	}).Create(&stat).Error
+	if err != nil {
+		fmt.Printf("Warning: failed to update download stats for app %d: %v\n", app.ID, err)
+	}
+}
+
+func RedirectAppDownload(c *gin.Context) {
+	appID, _ := strconv.Atoi(c.Param("id"))
+	downloadID, _ := strconv.Atoi(c.Param("download_id"))
+
+	var app models.App
+	if err := db.DB.Where("id = ? AND audit_status = ?", appID, 1).First(&app).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "应用不存在"})
+		return
+	}
+	var download models.AppDownload
+	if err := db.DB.Where("id = ? AND app_id = ? AND audit_status = ?", downloadID, app.ID, 1).First(&download).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "下载路线不存在"})
+		return
+	}
+	if download.Enabled != 1 {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "该下载路线已停用"})
+		return
+	}
+
+	url, err := resolveDownloadURL(download)
+	if err != nil {
+		fmt.Printf("Error resolving download %d for app %d: %v\n", download.ID, app.ID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"code": 502, "msg": "获取下载地址失败，请稍后重试"})
+		return
+	}
+
+	recordAppDownload(c, app, download)
+	c.Redirect(http.StatusFound, url)
+}
+
+func downloadStatsSince(c *gin.Context) int64 {
+	days, _ := strconv.Atoi(c.DefaultQuery("days", "30"))
+	if days <= 0 || days > 365 {
+		days = 30
+	}
+	now := time.Now()
+	year, month, day := now.AddDate(0, 0, -(days - 1)).Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, now.Location()).Unix()
+}
+
+func dailyDownloadCounts(query *gorm.DB) []HistoryData {
+	var results []HistoryData
+	query.Select("FROM_UNIXTIME(day, '%Y-%m-%d') as date, SUM(count) as count").
+		Group("date").
+		Order("date ASC").
+		Scan(&results)
+	return results
+}
+
+func GetAppDownloadStats(c *gin.Context) {
+	appID, _ := strconv.Atoi(c.Param("id"))
+	currentUser := c.MustGet("user").(models.User)
+
+	var app models.App
+	if err := db.DB.First(&app, appID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "应用不存在"})
+		return
+	}
+	if app.ByUserID != currentUser.ID && !middleware.HasPermission(c, "app.view_all") {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权查看此应用的下载统计"})
+		return
+	}
+
+	since := downloadStatsSince(c)
+	scope := func() *gorm.DB {
+		return db.DB.Model(&models.AppDownloadStat{}).Where("app_id = ? AND day >= ?", app.ID, since)
+	}
+
+	var routes []RouteDownloadCount
+	scope().Select("download_id, SUM(count) as count").Group("download_id").Order("count desc").Scan(&routes)
+	var downloads []models.AppDownload
+	db.DB.Where("app_id = ?", app.ID).Find(&downloads)
+	names := map[int]string{}
+	for _, download := range downloads {
+		names[download.ID] = download.Name
+	}
+	var total int64
+	for i := range routes {
+		routes[i].Name = names[routes[i].DownloadID]
+		total += routes[i].Count
+	}
+
+	c.JSON(http.StatusOK, gin.H{"code": 200, "data": gin.H{
+		"total":  total,
+		"daily":  dailyDownloadCounts(scope()),
+		"routes": routes,
+	}})
+}
+
+func developerDownloadStats(c *gin.Context, developerID int) {
+	since := downloadStatsSince(c)
+	scope := func() *gorm.DB {
+		return db.DB.Model(&models.AppDownloadStat{}).Where("developer_id = ? AND day >= ?", developerID, since)
+	}
+
+	var apps []AppDownloadCount
+	scope().Select("app_id, SUM(count) as count").Group("app_id").Order("count desc").Scan(&apps)
+	var appIDs []int
+	for _, app := range apps {
+		appIDs = append(appIDs, app.AppID)
+	}
+	names := map[int]string{}
+	if len(appIDs) > 0 {
+		var rows []models.App
+		db.DB.Select("id", "app_name").Where("id IN ?", appIDs).Find(&rows)
+		for _, row := range rows {
+			names[row.ID] = row.AppName
+		}
+	}
+	var total int64
+	for i := range apps {
+		apps[i].AppName = names[apps[i].AppID]
+		total += apps[i].Count
+	}
+
+	c.JSON(http.StatusOK, gin.H{"code": 200, "data": gin.H{
+		"total": total,
+		"daily": dailyDownloadCounts(scope()),
+		"apps":  apps,
+	}})
+}
+
+func GetMyDownloadStats(c *gin.Context) {
+	currentUser := c.MustGet("user").(models.User)
+	developerDownloadStats(c, currentUser.ID)
+}
+
+func GetUserDownloadStats(c *gin.Context) {
+	userID, _ := strconv.Atoi(c.Param("id"))
+	developerDownloadStats(c, userID)
+}
+
+func StartDownloadEventCleanupJob() {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			cutoff := time.Now().Add(-downloadDedupeWindow()).UnixMilli()
+			if err := db.DB.Where("time < ?", cutoff).Delete(&models.AppDownloadEvent{}).Error; err != nil {
+				fmt.Printf("Warning: failed to prune download events: %v\n", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
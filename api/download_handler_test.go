@@ -0,0 +1,133 @@
+package api
+
+import (
+	"io"
+	"market-api/db"
+	"market-api/models"
+	"market-api/utils"
+	"market-api/utils/filetest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func TestRedirectAppDownloadIssuesFileServerToken(t *testing.T) {
+	setupTestDB(t, &models.App{}, &models.AppDownload{}, &models.AppDownloadEvent{}, &models.AppDownloadStat{}, &models.UploadSession{})
+
+	fake := filetest.StartServer()
+	defer fake.Close()
+	fake.Put("apks/1.apk", []byte("apk contents"))
+	previous := utils.DefaultFileServer
+	utils.DefaultFileServer = utils.NewFileServerClient(utils.FileServerConfig{BaseURL: fake.URL, Retries: 0})
+	defer func() { utils.DefaultFileServer = previous }()
+
+	db.DB.Create(&models.App{ID: 1, AuditStatus: 1, ByUserID: 7})
+	db.DB.Create(&models.AppDownload{ID: 1, AppID: 1, URL: "apks/1.apk", IsExtra: 1, AuditStatus: 1, Enabled: 1})
+	db.DB.Create(&models.AppDownload{ID: 2, AppID: 1, URL: "apks/2.apk", IsExtra: 1, AuditStatus: 1, Enabled: 1})
+	db.DB.Create(&models.AppDownload{ID: 3, AppID: 1, URL: "https://example.com/app.apk", IsExtra: 0, AuditStatus: 1, Enabled: 1})
+	db.DB.Model(&models.AppDownload{}).Where("id = ?", 3).Update("enabled", 0)
+
+	router := gin.New()
+	router.GET("/app/:id/download/:download_id", RedirectAppDownload)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("User-Agent", "market-test")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		w := get("/app/1/download/1")
+		if w.Code != http.StatusFound {
+			t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+		}
+		location := w.Header().Get("Location")
+		if !strings.HasPrefix(location, fake.URL+"/download?token=") {
+			t.Fatalf("Location = %s", location)
+		}
+		resp, err := http.Get(location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "apk contents" {
+			t.Fatalf("download body = %q", body)
+		}
+	}
+
+	var stat models.AppDownloadStat
+	if err := db.DB.Where("app_id = ? AND download_id = ?", 1, 1).First(&stat).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stat.Count != 1 || stat.DeveloperID != 7 {
+		t.Fatalf("stat = %+v, want a single deduplicated download", stat)
+	}
+
+	fake.FailNext(1)
+	if w := get("/app/1/download/2"); w.Code != http.StatusBadGateway {
+		t.Fatalf("status with failing file server = %d, want 502", w.Code)
+	}
+	var events int64
+	db.DB.Model(&models.AppDownloadEvent{}).Where("download_id = ?", 2).Count(&events)
+	if events != 0 {
+		t.Fatalf("recorded %d events for a failed redirect", events)
+	}
+
+	if w := get("/app/1/download/3"); w.Code != http.StatusNotFound {
+		t.Fatalf("status for disabled route = %d, want 404", w.Code)
+	}
+}
+
+func TestRecordAppDownloadCountsOncePerWindow(t *testing.T) {
+	setupTestDB(t, &models.AppDownloadEvent{}, &models.AppDownloadStat{})
+
+	app := models.App{ID: 1, ByUserID: 7}
+	download := models.AppDownload{ID: 3, AppID: 1}
+	record := func(userAgent string) {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/app/1/download/3", nil)
+		c.Request.Header.Set("User-Agent", userAgent)
+		recordAppDownload(c, app, download)
+	}
+	count := func() int64 {
+		var stat models.AppDownloadStat
+		db.DB.Where("app_id = ? AND download_id = ?", 1, 3).First(&stat)
+		return stat.Count
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			record("client-a")
+		}()
+	}
+	wg.Wait()
+	if n := count(); n != 1 {
+		t.Fatalf("count after concurrent downloads = %d, want 1", n)
+	}
+
+	record("client-b")
+	if n := count(); n != 2 {
+		t.Fatalf("count after a second client = %d, want 2", n)
+	}
+
+	db.DB.Model(&models.AppDownloadEvent{}).Where("1 = 1").Update("bucket", gorm.Expr("bucket - 1"))
+	record("client-a")
+	if n := count(); n != 3 {
+		t.Fatalf("count in the next window = %d, want 3", n)
+	}
+	var events int64
+	db.DB.Model(&models.AppDownloadEvent{}).Count(&events)
+	if events != 3 {
+		t.Fatalf("events = %d, want 3", events)
+	}
+}
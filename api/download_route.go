@@ -0,0 +1,262 @@
+package api
+
+import (
+	"fmt"
+	"market-api/db"
+	"market-api/middleware"
+	"market-api/models"
+	"market-api/utils"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type UpdateDownloadRequest struct {
+	Weight  *int    `json:"weight" binding:"omitempty,min=1,max=1000"`
+	Enabled *int    `json:"enabled" binding:"omitempty,oneof=0 1"`
+	Regions *string `json:"regions"`
+	ABIMask *int    `json:"abi_mask" binding:"omitempty,min=0"`
+}
+
+type ReorderDownloadsRequest struct {
+	IDs []int `json:"ids" binding:"required"`
+}
+
+func nextDownloadSortOrder(appID int) int {
+	var max int
+	db.DB.Model(&models.AppDownload{}).Where("app_id = ?", appID).Select("COALESCE(MAX(sort_order), 0)").Scan(&max)
+	return max + 1
+}
+
+func normalizeRegions(regions string) string {
+	seen := map[string]bool{}
+	var list []string
+	for _, region := range strings.Split(regions, ",") {
+		region = strings.ToUpper(strings.TrimSpace(region))
+		if region == "" || seen[region] {
+			continue
+		}
+		seen[region] = true
+		list = append(list, region)
+	}
+	return strings.Join(list, ",")
+}
+
+func routeMatchesClient(download models.AppDownload, region string, abiMask int) bool {
+	if download.ABIMask != 0 && abiMask != 0 && download.ABIMask&abiMask == 0 {
+		return false
+	}
+	if download.Regions == "" || region == "" {
+		return true
+	}
+	for _, allowed := range strings.Split(download.Regions, ",") {
+		if allowed == region {
+			return true
+		}
+	}
+	return false
+}
+
+func pickWeightedRoute(routes []models.AppDownload) models.AppDownload {
+	total := 0
+	for _, route := range routes {
+		total += max(route.Weight, 1)
+	}
+	n := rand.IntN(total)
+	for _, route := range routes {
+		n -= max(route.Weight, 1)
+		if n < 0 {
+			return route
+		}
+	}
+	return routes[len(routes)-1]
+}
+
+func pickDownloadRoute(downloads []models.AppDownload, region string, abiMask int) (models.AppDownload, bool) {
+	var healthy, suspicious []models.AppDownload
+	for _, download := range downloads {
+		if download.Enabled != 1 || download.AuditStatus != 1 || !routeMatchesClient(download, region, abiMask) {
+			continue
+		}
+		switch download.Health {
+		case routeHealthy, routeUnchecked:
+			healthy = append(healthy, download)
+		case routeSuspicious:
+			suspicious = append(suspicious, download)
+		}
+	}
+	if len(healthy) > 0 {
+		return pickWeightedRoute(healthy), true
+	}
+	if len(suspicious) > 0 {
+		return pickWeightedRoute(suspicious), true
+	}
+	return models.AppDownload{}, false
+}
+
+func RedirectPrimaryAppDownload(c *gin.Context) {
+	appID, _ := strconv.Atoi(c.Param("id"))
+
+	var app models.App
+	if err := db.DB.Where("id = ? AND audit_status = ?", appID, 1).First(&app).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "应用不存在"})
+		return
+	}
+	var downloads []models.AppDownload
+	db.DB.Where("app_id = ? AND audit_status = ? AND enabled = ?", app.ID, 1, 1).Order("sort_order asc, id asc").Find(&downloads)
+
+	region := c.Query("region")
+	if region == "" {
+		region = c.GetHeader("X-Region")
+	}
+	region = strings.ToUpper(strings.TrimSpace(region))
+	abiMask := utils.ParseABIMask(c.Query("abi"))
+
+	for len(downloads) > 0 {
+		download, ok := pickDownloadRoute(downloads, region, abiMask)
+		if !ok {
+			break
+		}
+		url, err := resolveDownloadURL(download)
+		if err != nil {
+			fmt.Printf("Error resolving download %d for app %d: %v\n", download.ID, app.ID, err)
+			remaining := downloads[:0]
+			for _, other := range downloads {
+				if other.ID != download.ID {
+					remaining = append(remaining, other)
+				}
+			}
+			downloads = remaining
+			continue
+		}
+		recordAppDownload(c, app, download)
+		c.Redirect(http.StatusFound, url)
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "暂无可用的下载路线"})
+}
+
+func canManageDownloads(c *gin.Context, app models.App) bool {
+	currentUser := c.MustGet("user").(models.User)
+	return app.ByUserID == currentUser.ID || middleware.HasPermission(c, "app.download.audit")
+}
+
+func UpdateAppDownload(c *gin.Context) {
+	downloadID, _ := strconv.Atoi(c.Param("download_id"))
+	currentUser := c.MustGet("user").(models.User)
+	var req UpdateDownloadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "参数错误: " + err.Error()})
+		return
+	}
+
+	var download models.AppDownload
+	if err := db.DB.Preload("App").First(&download, downloadID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "下载路线不存在"})
+		return
+	}
+	if !canManageDownloads(c, download.App) {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权修改该路线"})
+		return
+	}
+
+	updates := map[string]interface{}{}
+	if req.Weight != nil {
+		updates["weight"] = *req.Weight
+	}
+	if req.Enabled != nil {
+		updates["enabled"] = *req.Enabled
+	}
+	if req.Regions != nil {
+		updates["regions"] = normalizeRegions(*req.Regions)
+	}
+	if req.ABIMask != nil {
+		updates["abi_mask"] = *req.ABIMask
+	}
+	if len(updates) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "没有需要修改的内容"})
+		return
+	}
+
+	if err := db.DB.Model(&models.AppDownload{}).Where("id = ?", download.ID).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "修改下载路线失败: " + err.Error()})
+		return
+	}
+
+	var updated models.AppDownload
+	db.DB.First(&updated, download.ID)
+	if download.App.ByUserID != currentUser.ID {
+		download.App = models.App{}
+		recordAudit(c, "app_download.update", "app_download", download.ID, download, updated)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "修改成功", "data": updated})
+}
+
+func ReorderAppDownloads(c *gin.Context) {
+	appID, _ := strconv.Atoi(c.Param("id"))
+	currentUser := c.MustGet("user").(models.User)
+	var req ReorderDownloadsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "参数错误: " + err.Error()})
+		return
+	}
+
+	var app models.App
+	if err := db.DB.First(&app, appID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "应用不存在"})
+		return
+	}
+	if !canManageDownloads(c, app) {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权调整该应用的路线"})
+		return
+	}
+
+	var downloads []models.AppDownload
+	db.DB.Where("app_id = ?", app.ID).Order("sort_order asc, id asc").Find(&downloads)
+	existing := map[int]bool{}
+	for _, download := range downloads {
+		existing[download.ID] = true
+	}
+	seen := map[int]bool{}
+	for _, id := range req.IDs {
+		if !existing[id] || seen[id] {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "路线列表与应用现有路线不一致"})
+			return
+		}
+		seen[id] = true
+	}
+	if len(seen) != len(existing) {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "路线列表与应用现有路线不一致"})
+		return
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		for i, id := range req.IDs {
+			if err := tx.Model(&models.AppDownload{}).Where("id = ?", id).Update("sort_order", i+1).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "调整路线顺序失败: " + err.Error()})
+		return
+	}
+
+	if app.ByUserID != currentUser.ID {
+		before := make([]int, 0, len(downloads))
+		for _, download := range downloads {
+			before = append(before, download.ID)
+		}
+		recordAudit(c, "app_download.reorder", "app", app.ID, before, req.IDs)
+	}
+
+	var reordered []models.AppDownload
+	db.DB.Where("app_id = ?", app.ID).Order("sort_order asc, id asc").Find(&reordered)
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "调整成功", "data": reordered})
+}
@@ -0,0 +1,301 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"market-api/db"
+	"market-api/models"
+	"market-api/utils"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+const (
+	emailTokenPasswordReset = "password_reset"
+	emailTokenVerifyEmail   = "verify_email"
+)
+
+var errEmailTokenInvalid = errors.New("email token invalid")
+
+func emailTokenInt(key string, def int) int {
+	if v := viper.GetInt("email_token." + key); v > 0 {
+		return v
+	}
+	return def
+}
+
+func emailTokenLink(path, token string) string {
+	webURL := strings.TrimRight(viper.GetString("server.web_url"), "/")
+	return fmt.Sprintf("%s/%s?token=%s", webURL, path, url.QueryEscape(token))
+}
+
+func findUserByAccount(account string) (models.User, error) {
+	var user models.User
+	account = strings.TrimSpace(account)
+	err := db.DB.Where("username = ? OR (bind_email = ? AND bind_email <> '')", account, account).First(&user).Error
+	return user, err
+}
+
+func createEmailToken(user models.User, purpose string, lifetime time.Duration, ip string) (string, bool, error) {
+	now := time.Now()
+	resendInterval := time.Duration(emailTokenInt("resend_interval_seconds", 60)) * time.Second
+
+	var recent int64
+	db.DB.Model(&models.UserEmailToken{}).
+		Where("by_userid = ? AND purpose = ? AND create_time > ?", user.ID, purpose, now.Add(-resendInterval).UnixMilli()).
+		Count(&recent)
+	if recent > 0 {
+		return "", false, nil
+	}
+
+	token, tokenHash, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return "", false, err
+	}
+
+	record := models.UserEmailToken{
+		ByUserID:   user.ID,
+		Purpose:    purpose,
+		Email:      user.BindEmail,
+		TokenHash:  tokenHash,
+		CreateTime: now.UnixMilli(),
+		ExpireTime: now.Add(lifetime).UnixMilli(),
+		RequestIP:  ip,
+	}
+	if err := db.DB.Create(&record).Error; err != nil {
+		return "", false, err
+	}
+	return token, true, nil
+}
+
+func consumeEmailToken(tx *gorm.DB, token, purpose string) (models.UserEmailToken, error) {
+	var record models.UserEmailToken
+	if err := tx.Where("token_hash = ? AND purpose = ?", utils.HashOpaqueToken(token), purpose).First(&record).Error; err != nil {
+		return record, errEmailTokenInvalid
+	}
+	if record.UsedTime != 0 || record.ExpireTime <= time.Now().UnixMilli() {
+		return record, errEmailTokenInvalid
+	}
+
+	result := tx.Model(&models.UserEmailToken{}).
+		Where("id = ? AND used_time = ?", record.ID, 0).
+		Update("used_time", time.Now().UnixMilli())
+	if result.Error != nil {
+		return record, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return record, errEmailTokenInvalid
+	}
+	return record, nil
+}
+
+func sendEmailTokenMail(userID int, to, subject, templateName string, data interface{}) {
+	go func() {
+		body, err := utils.ParseTemplate(templateName, data)
+		if err != nil {
+			fmt.Printf("Warning: failed to render %s for user %d: %v\n", templateName, userID, err)
+			return
+		}
+		if err := utils.SendEmail(to, subject, body); err != nil {
+			fmt.Printf("Warning: failed to send %s to user %d: %v\n", templateName, userID, err)
+		}
+	}()
+}
+
+type ForgotPasswordRequest struct {
+	Account string `json:"account" binding:"required"`
+}
+
+func ForgotPassword(c *gin.Context) {
+	var req ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "参数错误"})
+		return
+	}
+
+	okResponse := gin.H{"code": 200, "msg": "如果该账号已绑定并验证邮箱，重置链接将发送至对应邮箱"}
+
+	user, err := findUserByAccount(req.Account)
+	if err != nil || user.BindEmail == "" || user.VerifyEmail != 1 {
+		c.JSON(http.StatusOK, okResponse)
+		return
+	}
+
+	expireMinutes := emailTokenInt("reset_expire_minutes", 30)
+	token, created, err := createEmailToken(user, emailTokenPasswordReset, time.Duration(expireMinutes)*time.Minute, c.ClientIP())
+	if err != nil {
+		fmt.Printf("Warning: failed to create password reset token for user %d: %v\n", user.ID, err)
+	}
+	if err != nil || !created {
+		c.JSON(http.StatusOK, okResponse)
+		return
+	}
+
+	emailData := struct {
+		DisplayName   string
+		Link          string
+		ExpireMinutes int
+	}{
+		DisplayName:   user.DisplayName,
+		Link:          emailTokenLink("reset-password", token),
+		ExpireMinutes: expireMinutes,
+	}
+	sendEmailTokenMail(user.ID, user.BindEmail, "【弦-应用商店】重置密码", "password_reset.html", emailData)
+
+	c.JSON(http.StatusOK, okResponse)
+}
+
+type ResetPasswordByEmailRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required,min=6"`
+}
+
+func ResetPasswordByEmail(c *gin.Context) {
+	var req ResetPasswordByEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "参数错误，新密码至少 6 位"})
+		return
+	}
+
+	newHash, err := utils.HashPassword(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "重置密码失败"})
+		return
+	}
+
+	var user models.User
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		record, err := consumeEmailToken(tx, req.Token, emailTokenPasswordReset)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.First(&user, record.ByUserID).Error; err != nil {
+			return errEmailTokenInvalid
+		}
+		if user.BindEmail != record.Email {
+			return errEmailTokenInvalid
+		}
+
+		if err := tx.Model(&user).Update("password", newHash).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&models.UserEmailToken{}).
+			Where("by_userid = ? AND purpose = ? AND used_time = ?", user.ID, emailTokenPasswordReset, 0).
+			Update("used_time", time.Now().UnixMilli()).Error; err != nil {
+			return err
+		}
+
+		var tokenIDs []int
+		tx.Model(&models.UserToken{}).Where("by_userid = ? AND status = ?", user.ID, 1).Pluck("id", &tokenIDs)
+		for _, tokenID := range tokenIDs {
+			if err := revokeTokenFamily(tx, tokenID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if errors.Is(err, errEmailTokenInvalid) {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "链接无效或已过期，请重新申请"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "重置密码失败: " + err.Error()})
+		return
+	}
+
+	clearLoginFailures(user.Username)
+
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "密码已重置，请使用新密码登录"})
+}
+
+type RequestEmailVerificationRequest struct {
+	Account string `json:"account" binding:"required"`
+}
+
+func RequestEmailVerification(c *gin.Context) {
+	var req RequestEmailVerificationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "参数错误"})
+		return
+	}
+
+	okResponse := gin.H{"code": 200, "msg": "如果该账号已绑定邮箱且尚未验证，验证链接将发送至对应邮箱"}
+
+	user, err := findUserByAccount(req.Account)
+	if err != nil || user.BindEmail == "" || user.VerifyEmail == 1 {
+		c.JSON(http.StatusOK, okResponse)
+		return
+	}
+
+	expireHours := emailTokenInt("verify_expire_hours", 24)
+	token, created, err := createEmailToken(user, emailTokenVerifyEmail, time.Duration(expireHours)*time.Hour, c.ClientIP())
+	if err != nil {
+		fmt.Printf("Warning: failed to create email verification token for user %d: %v\n", user.ID, err)
+	}
+	if err != nil || !created {
+		c.JSON(http.StatusOK, okResponse)
+		return
+	}
+
+	emailData := struct {
+		DisplayName string
+		Link        string
+		ExpireHours int
+	}{
+		DisplayName: user.DisplayName,
+		Link:        emailTokenLink("verify-email", token),
+		ExpireHours: expireHours,
+	}
+	sendEmailTokenMail(user.ID, user.BindEmail, "【弦-应用商店】验证邮箱", "verify_email.html", emailData)
+
+	c.JSON(http.StatusOK, okResponse)
+}
+
+type ConfirmEmailVerificationRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+func ConfirmEmailVerification(c *gin.Context) {
+	var req ConfirmEmailVerificationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "参数错误"})
+		return
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		record, err := consumeEmailToken(tx, req.Token, emailTokenVerifyEmail)
+		if err != nil {
+			return err
+		}
+
+		var user models.User
+		if err := tx.First(&user, record.ByUserID).Error; err != nil {
+			return errEmailTokenInvalid
+		}
+		if user.BindEmail != record.Email {
+			return errEmailTokenInvalid
+		}
+
+		return tx.Model(&user).Update("verify_email", 1).Error
+	})
+
+	if errors.Is(err, errEmailTokenInvalid) {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "链接无效或已过期，请重新申请"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "验证失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "邮箱验证成功，请重新登录"})
+}
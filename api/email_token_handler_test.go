@@ -0,0 +1,64 @@
+package api
+
+import (
+	"market-api/db"
+	"market-api/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestEmailTokenRequestsDoNotRevealAccounts(t *testing.T) {
+	setupTestDB(t, &models.User{}, &models.UserEmailToken{})
+
+	db.DB.Create(&[]models.User{
+		{ID: 1, Username: "verified", BindEmail: "verified@example.com", VerifyEmail: 1},
+		{ID: 2, Username: "unverified", BindEmail: "unverified@example.com"},
+		{ID: 3, Username: "noemail"},
+	})
+
+	router := gin.New()
+	router.POST("/forgot", ForgotPassword)
+	router.POST("/verify", RequestEmailVerification)
+	post := func(path, account string) (int, string) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"account":"`+account+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	cases := []struct {
+		path    string
+		purpose string
+		sends   string
+	}{
+		{"/forgot", emailTokenPasswordReset, "verified"},
+		{"/verify", emailTokenVerifyEmail, "unverified"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.purpose, func(t *testing.T) {
+			var first string
+			for _, account := range []string{"missing", "verified", "unverified", "noemail", tc.sends} {
+				status, body := post(tc.path, account)
+				if status != http.StatusOK {
+					t.Fatalf("%s for %s = %d %s", tc.path, account, status, body)
+				}
+				if first == "" {
+					first = body
+				} else if body != first {
+					t.Fatalf("%s for %s = %s, want %s", tc.path, account, body, first)
+				}
+			}
+
+			var tokens []models.UserEmailToken
+			db.DB.Where("purpose = ?", tc.purpose).Find(&tokens)
+			if len(tokens) != 1 || tokens[0].Email != tc.sends+"@example.com" {
+				t.Fatalf("tokens = %+v, want one for %s", tokens, tc.sends)
+			}
+		})
+	}
+}
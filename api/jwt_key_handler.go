@@ -0,0 +1,149 @@
+package api
+
+import (
+	"fmt"
+	"market-api/db"
+	"market-api/middleware"
+	"market-api/models"
+	"market-api/utils"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+func ListJWTKeys(c *gin.Context) {
+	var keys []models.JWTKey
+	db.DB.Order("id desc").Find(&keys)
+	c.JSON(http.StatusOK, gin.H{"code": 200, "data": keys})
+}
+
+func CreateJWTKey(c *gin.Context) {
+	var req struct {
+		Algorithm string `json:"algorithm" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "参数错误: " + err.Error()})
+		return
+	}
+
+	privateKey, publicKey, err := utils.GenerateJWTKeyMaterial(req.Algorithm)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "不支持的签名算法，可选 HS256, EdDSA, RS256"})
+		return
+	}
+
+	key := models.JWTKey{
+		Kid:        uuid.New().String(),
+		Algorithm:  req.Algorithm,
+		PrivateKey: privateKey,
+		PublicKey:  publicKey,
+		Status:     2,
+		CreateTime: time.Now().UnixMilli(),
+	}
+	if err := db.DB.Create(&key).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "创建密钥失败: " + err.Error()})
+		return
+	}
+
+	if err := middleware.ReloadJWTKeys(); err != nil {
+		fmt.Printf("Warning: failed to reload jwt keys: %v\n", err)
+	}
+
+	recordAudit(c, "jwt_key.create", "jwt_key", key.ID, nil, key)
+
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "密钥已创建，启用前仅用于校验", "data": key})
+}
+
+func ActivateJWTKey(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	var key models.JWTKey
+	if err := db.DB.First(&key, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "密钥不存在"})
+		return
+	}
+
+	if key.Status == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "已退役的密钥无法重新启用"})
+		return
+	}
+	if key.Status == 1 {
+		c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "该密钥已是当前签名密钥"})
+		return
+	}
+
+	before := key
+	now := time.Now()
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.JWTKey{}).Where("status = ?", 1).Updates(map[string]interface{}{
+			"status":       2,
+			"retire_after": now.Add(utils.MaxSignedTokenLifetime()).UnixMilli(),
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&key).Updates(map[string]interface{}{
+			"status":       1,
+			"active_time":  now.UnixMilli(),
+			"retire_after": 0,
+		}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "启用密钥失败: " + err.Error()})
+		return
+	}
+
+	if err := middleware.ReloadJWTKeys(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "重新加载密钥失败: " + err.Error()})
+		return
+	}
+
+	var updated models.JWTKey
+	db.DB.First(&updated, id)
+	recordAudit(c, "jwt_key.activate", "jwt_key", id, before, updated)
+
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "已切换签名密钥"})
+}
+
+func RetireJWTKey(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	var key models.JWTKey
+	if err := db.DB.First(&key, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "密钥不存在"})
+		return
+	}
+
+	if key.Status == 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "无法退役当前签名密钥，请先启用其他密钥"})
+		return
+	}
+	if key.Status == 0 {
+		c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "该密钥已退役"})
+		return
+	}
+	if key.RetireAfter > time.Now().UnixMilli() {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  fmt.Sprintf("仍有由该密钥签发的Token未过期，请在 %s 之后再退役", time.UnixMilli(key.RetireAfter).Format("2006-01-02 15:04:05")),
+		})
+		return
+	}
+
+	before := key
+	if err := db.DB.Model(&key).Update("status", 0).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "退役密钥失败: " + err.Error()})
+		return
+	}
+
+	if err := middleware.ReloadJWTKeys(); err != nil {
+		fmt.Printf("Warning: failed to reload jwt keys: %v\n", err)
+	}
+
+	recordAudit(c, "jwt_key.retire", "jwt_key", id, before, gin.H{"status": 0})
+
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "密钥已退役"})
+}
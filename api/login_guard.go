@@ -0,0 +1,225 @@
+package api
+
+import (
+	"fmt"
+	"market-api/db"
+	"market-api/middleware"
+	"market-api/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	loginScopeUser = "user"
+	loginScopeIP   = "ip"
+)
+
+func loginGuardInt(key string, def int) int {
+	if v := viper.GetInt("login_guard." + key); v > 0 {
+		return v
+	}
+	return def
+}
+
+func loginFailureKey(scope, key string) string {
+	if scope == loginScopeUser {
+		return strings.ToLower(strings.TrimSpace(key))
+	}
+	return key
+}
+
+func loginRetryAfter(f models.LoginFailure, now time.Time) time.Duration {
+	if f.LockedUntil > now.UnixMilli() {
+		return time.Duration(f.LockedUntil-now.UnixMilli()) * time.Millisecond
+	}
+
+	window := time.Duration(loginGuardInt("window_minutes", 30)) * time.Minute
+	if now.UnixMilli()-f.LastFailTime > window.Milliseconds() {
+		return 0
+	}
+
+	free := loginGuardInt("free_attempts", 3)
+	if f.FailCount < free {
+		return 0
+	}
+
+	delay := time.Duration(loginGuardInt("delay_base_seconds", 2)) * time.Second
+	maxDelay := time.Duration(loginGuardInt("delay_max_seconds", 60)) * time.Second
+	for i := free; i < f.FailCount && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	wait := time.UnixMilli(f.LastFailTime).Add(delay).Sub(now)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+func checkLoginAllowed(c *gin.Context, username string) bool {
+	now := time.Now()
+	var failures []models.LoginFailure
+	db.DB.Where("(scope = ? AND failure_key = ?) OR (scope = ? AND failure_key = ?)",
+		loginScopeUser, loginFailureKey(loginScopeUser, username),
+		loginScopeIP, c.ClientIP()).Find(&failures)
+
+	var wait time.Duration
+	locked := false
+	for _, f := range failures {
+		if f.LockedUntil > now.UnixMilli() {
+			locked = true
+		}
+		if w := loginRetryAfter(f, now); w > wait {
+			wait = w
+		}
+	}
+
+	if wait <= 0 {
+		return true
+	}
+
+	seconds := int(wait.Seconds()) + 1
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	msg := fmt.Sprintf("登录尝试过于频繁，请 %d 秒后再试", seconds)
+	if locked {
+		msg = fmt.Sprintf("登录失败次数过多，账号或IP已被临时锁定，请 %d 分钟后再试", (seconds+59)/60)
+	}
+	c.JSON(http.StatusTooManyRequests, gin.H{"code": 429, "msg": msg, "data": gin.H{"retry_after": seconds}})
+	return false
+}
+
+func recordLoginFailureFor(scope, key string, maxFailures int) models.LoginFailure {
+	now := time.Now()
+	window := time.Duration(loginGuardInt("window_minutes", 30)) * time.Minute
+	lockout := time.Duration(loginGuardInt("lockout_minutes", 15)) * time.Minute
+
+	var failure models.LoginFailure
+	db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where(models.LoginFailure{Scope: scope, Key: key}).
+			FirstOrCreate(&failure).Error; err != nil {
+			return err
+		}
+
+		if now.UnixMilli()-failure.LastFailTime > window.Milliseconds() && failure.LockedUntil < now.UnixMilli() {
+			failure.FailCount = 0
+		}
+		failure.FailCount++
+		failure.LastFailTime = now.UnixMilli()
+		if failure.FailCount >= maxFailures && failure.FailCount%maxFailures == 0 {
+			failure.LockedUntil = now.Add(lockout).UnixMilli()
+		}
+
+		return tx.Save(&failure).Error
+	})
+	return failure
+}
+
+func recordLoginFailure(c *gin.Context, username string) {
+	recordLoginFailureFor(loginScopeUser, loginFailureKey(loginScopeUser, username), loginGuardInt("max_user_failures", 10))
+
+	ip := c.ClientIP()
+	ipFailure := recordLoginFailureFor(loginScopeIP, ip, loginGuardInt("max_ip_failures", 30))
+	if ipFailure.FailCount < loginGuardInt("ip_ban_threshold", 100) {
+		return
+	}
+
+	banned := false
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		var failure models.LoginFailure
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where(models.LoginFailure{Scope: loginScopeIP, Key: ip}).
+			First(&failure).Error; err != nil {
+			return err
+		}
+
+		var count int64
+		if err := tx.Model(&models.BannedIP{}).
+			Where("ip = ? AND (expire_time = 0 OR expire_time > ?)", ip, time.Now().UnixMilli()).
+			Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return nil
+		}
+
+		bannedIP := models.BannedIP{
+			IP:         ip,
+			Reason:     "登录失败次数过多",
+			ExpireTime: time.Now().Add(time.Duration(loginGuardInt("ip_ban_hours", 24)) * time.Hour).UnixMilli(),
+			CreateTime: time.Now().UnixMilli(),
+		}
+		if err := tx.Create(&bannedIP).Error; err != nil {
+			return err
+		}
+		banned = true
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Warning: failed to ban ip %s after repeated login failures: %v\n", ip, err)
+		return
+	}
+	if banned {
+		if err := middleware.ReloadBannedIPs(); err != nil {
+			fmt.Printf("Warning: failed to reload banned ip list: %v\n", err)
+		}
+	}
+}
+
+func clearLoginFailures(username string) {
+	db.DB.Where("scope = ? AND failure_key = ?", loginScopeUser, loginFailureKey(loginScopeUser, username)).Delete(&models.LoginFailure{})
+}
+
+func GetUserLoginLock(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	var user models.User
+	if err := db.DB.First(&user, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "用户不存在"})
+		return
+	}
+
+	var failure models.LoginFailure
+	if err := db.DB.Where("scope = ? AND failure_key = ?", loginScopeUser, loginFailureKey(loginScopeUser, user.Username)).First(&failure).Error; err != nil {
+		c.JSON(http.StatusOK, gin.H{"code": 200, "data": gin.H{"fail_count": 0, "locked": false, "locked_until": 0, "last_fail_time": 0}})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"data": gin.H{
+			"fail_count":     failure.FailCount,
+			"locked":         failure.LockedUntil > time.Now().UnixMilli(),
+			"locked_until":   failure.LockedUntil,
+			"last_fail_time": failure.LastFailTime,
+		},
+	})
+}
+
+func ClearUserLoginLock(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	var user models.User
+	if err := db.DB.First(&user, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "用户不存在"})
+		return
+	}
+
+	clearLoginFailures(user.Username)
+
+	if ip := c.Query("ip"); ip != "" {
+		db.DB.Where("scope = ? AND failure_key = ?", loginScopeIP, ip).Delete(&models.LoginFailure{})
+	}
+
+	recordAudit(c, "user.clear_login_lock", "user", user.ID, nil, gin.H{"ip": c.Query("ip")})
+
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "登录锁定已解除"})
+}
@@ -0,0 +1,201 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"market-api/db"
+	"market-api/models"
+	"market-api/utils"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+type MediaOrphan struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Deleted bool      `json:"deleted"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+type MediaGCReport struct {
+	DryRun     bool          `json:"dry_run"`
+	Scanned    int           `json:"scanned"`
+	Referenced int           `json:"referenced"`
+	Deleted    int           `json:"deleted"`
+	Skipped    int           `json:"skipped"`
+	Failed     int           `json:"failed"`
+	Orphans    []MediaOrphan `json:"orphans"`
+}
+
+func (r MediaGCReport) Summary() string {
+	return fmt.Sprintf("scanned=%d referenced=%d orphans=%d deleted=%d in_grace=%d failed=%d dry_run=%v",
+		r.Scanned, r.Referenced, len(r.Orphans), r.Deleted, r.Skipped, r.Failed, r.DryRun)
+}
+
+func mediaGCGrace() time.Duration {
+	hours := viper.GetInt("media_gc.grace_hours")
+	if hours <= 0 {
+		hours = 72
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+func mediaGCPrefixes() []string {
+	seen := map[string]bool{}
+	var prefixes []string
+	for _, dir := range mediaDirs {
+		prefix := mediaDir(dir.key) + "/"
+		if !seen[prefix] {
+			seen[prefix] = true
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+func referencedMediaKeys() (map[string]bool, error) {
+	keys := map[string]bool{}
+	add := func(value string) {
+		if value == "" {
+			return
+		}
+		if key, ok := utils.StorageKeyFromURL(value); ok {
+			keys[key] = true
+			return
+		}
+		keys[strings.TrimPrefix(value, "/")] = true
+	}
+
+	var apps []models.App
+	err := db.DB.Select("id", "app_icon", "local_icon_path", "app_previews", "app_icon_variants", "app_preview_variants").FindInBatches(&apps, 500, func(tx *gorm.DB, batch int) error {
+		for _, app := range apps {
+			add(app.AppIcon)
+			for _, key := range liveMediaPaths(app) {
+				keys[key] = true
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions []models.AppRevision
+	if err := db.DB.Where("status = ?", revisionPending).Find(&revisions).Error; err != nil {
+		return nil, err
+	}
+	for _, revision := range revisions {
+		for _, key := range pendingMediaPaths(models.App{}, revisionData(revision)) {
+			keys[key] = true
+		}
+	}
+
+	var refs []string
+	if err := db.DB.Model(&models.MediaRef{}).Distinct("storage_key").Pluck("storage_key", &refs).Error; err != nil {
+		return nil, err
+	}
+	for _, key := range refs {
+		keys[key] = true
+	}
+
+	var banners []string
+	if err := db.DB.Model(&models.Banner{}).Pluck("banner", &banners).Error; err != nil {
+		return nil, err
+	}
+	for _, url := range banners {
+		add(url)
+	}
+
+	var popups []string
+	if err := db.DB.Model(&models.Popup{}).Distinct("img_url").Pluck("img_url", &popups).Error; err != nil {
+		return nil, err
+	}
+	for _, url := range popups {
+		add(url)
+	}
+
+	var tagIcons []string
+	if err := db.DB.Model(&models.AppTag{}).Pluck("icon", &tagIcons).Error; err != nil {
+		return nil, err
+	}
+	for _, url := range tagIcons {
+		add(url)
+	}
+
+	return keys, nil
+}
+
+func RunMediaGC(dryRun bool) (MediaGCReport, error) {
+	report := MediaGCReport{DryRun: dryRun, Orphans: []MediaOrphan{}}
+
+	walker, ok := utils.DefaultStorage.(utils.StorageWalker)
+	if !ok {
+		return report, errors.New("storage driver does not support listing objects")
+	}
+
+	referenced, err := referencedMediaKeys()
+	if err != nil {
+		return report, err
+	}
+
+	cutoff := time.Now().Add(-mediaGCGrace())
+	for _, prefix := range mediaGCPrefixes() {
+		err := walker.Walk(prefix, func(object utils.StorageObject) error {
+			report.Scanned++
+			if referenced[object.Key] {
+				report.Referenced++
+				return nil
+			}
+
+			orphan := MediaOrphan{Key: object.Key, Size: object.Size, ModTime: object.ModTime}
+			switch {
+			case object.ModTime.After(cutoff):
+				orphan.Reason = "in grace period"
+				report.Skipped++
+			case dryRun:
+			default:
+				if err := utils.DefaultStorage.Delete(object.Key); err != nil {
+					orphan.Reason = err.Error()
+					report.Failed++
+				} else {
+					orphan.Deleted = true
+					report.Deleted++
+				}
+			}
+			report.Orphans = append(report.Orphans, orphan)
+			return nil
+		})
+		if err != nil {
+			return report, fmt.Errorf("walk %s: %w", prefix, err)
+		}
+	}
+	return report, nil
+}
+
+func StartMediaGCJob() {
+	if !viper.GetBool("media_gc.enabled") {
+		return
+	}
+	hours := viper.GetInt("media_gc.interval_hours")
+	if hours <= 0 {
+		hours = 24
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(hours) * time.Hour)
+		defer ticker.Stop()
+		for {
+			report, err := RunMediaGC(viper.GetBool("media_gc.dry_run"))
+			if err != nil {
+				fmt.Printf("Warning: media gc failed: %v\n", err)
+			} else {
+				fmt.Printf("Media gc finished: %s\n", report.Summary())
+			}
+			<-ticker.C
+		}
+	}()
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"market-api/db"
+	"market-api/models"
+	"market-api/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunMediaGCReleasesPopupImageWithLastPopup(t *testing.T) {
+	setupTestDB(t, &models.App{}, &models.AppRevision{}, &models.MediaRef{}, &models.Banner{}, &models.Popup{}, &models.AppTag{})
+
+	base := t.TempDir()
+	previous := utils.DefaultStorage
+	utils.DefaultStorage = utils.NewLocalStorage(base, "http://localhost")
+	defer func() { utils.DefaultStorage = previous }()
+
+	key := mediaDir(mediaDirPopup) + "/campaign.png"
+	fullPath := filepath.Join(base, key)
+	os.MkdirAll(filepath.Dir(fullPath), 0755)
+	if err := os.WriteFile(fullPath, []byte("png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * mediaGCGrace())
+	os.Chtimes(fullPath, old, old)
+
+	db.DB.Create(&[]models.Popup{{ByUserID: 1, ImgURL: key}, {ByUserID: 2, ImgURL: key}})
+
+	db.DB.Where("by_userid = ?", 1).Delete(&models.Popup{})
+	report, err := RunMediaGC(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Referenced != 1 || report.Deleted != 0 {
+		t.Fatalf("report with a remaining popup = %s", report.Summary())
+	}
+
+	db.DB.Where("by_userid = ?", 2).Delete(&models.Popup{})
+	if report, err = RunMediaGC(false); err != nil {
+		t.Fatal(err)
+	}
+	if report.Deleted != 1 {
+		t.Fatalf("report after the last popup = %s", report.Summary())
+	}
+	if _, err := os.Stat(fullPath); !os.IsNotExist(err) {
+		t.Fatalf("popup image still on disk: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"fmt"
+	"market-api/db"
+	"market-api/models"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	mediaOwnerApp    = "app"
+	mediaOwnerBanner = "banner"
+	mediaOwnerTag    = "tag"
+)
+
+const (
+	mediaDirIcon    = "storage.icon_path"
+	mediaDirPreview = "storage.preview_path"
+	mediaDirBanner  = "storage.banner_path"
+	mediaDirPopup   = "storage.popup_path"
+	mediaDirTagIcon = "storage.tag_icon_path"
+)
+
+var mediaDirs = []struct {
+	key      string
+	fallback string
+}{
+	{mediaDirIcon, "images/app_icon"},
+	{mediaDirPreview, "images/app_previews"},
+	{mediaDirBanner, "images/banana"},
+	{mediaDirPopup, "images/popup"},
+	{mediaDirTagIcon, "images/tag_icon"},
+}
+
+func mediaDir(key string) string {
+	if dir := strings.Trim(viper.GetString(key), "/"); dir != "" {
+		return dir
+	}
+	for _, dir := range mediaDirs {
+		if dir.key == key {
+			return dir.fallback
+		}
+	}
+	return ""
+}
+
+func retainMedia(ownerType string, ownerID int, keys []string) {
+	seen := map[string]bool{}
+	var refs []models.MediaRef
+	now := time.Now().UnixMilli()
+	for _, key := range keys {
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		refs = append(refs, models.MediaRef{StorageKey: key, OwnerType: ownerType, OwnerID: ownerID, CreateTime: now})
+	}
+	if len(refs) == 0 {
+		return
+	}
+	if err := db.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&refs).Error; err != nil {
+		fmt.Printf("Warning: failed to retain media for %s %d: %v\n", ownerType, ownerID, err)
+	}
+}
+
+func releaseMedia(ownerType string, ownerID int, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	if err := db.DB.Where("owner_type = ? AND owner_id = ? AND storage_key IN ?", ownerType, ownerID, keys).Delete(&models.MediaRef{}).Error; err != nil {
+		fmt.Printf("Warning: failed to release media for %s %d: %v\n", ownerType, ownerID, err)
+	}
+}
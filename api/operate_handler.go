@@ -12,7 +12,6 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/spf13/viper"
 )
 
 type SendNoticeRequest struct {
@@ -82,6 +81,14 @@ func SendNotice(c *gin.Context) {
 		}
 	}
 
+	recordAudit(c, "operate.notice", "users", 0, nil, gin.H{
+		"user_ids":   req.UserIDs,
+		"recipients": len(targetUserIDs),
+		"title":      req.Title,
+		"content":    req.Content,
+		"actions":    actionsJSON,
+	})
+
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "通知发送成功"})
 }
 
@@ -94,16 +101,12 @@ func SendPopup(c *gin.Context) {
 		return
 	}
 
-	if !utils.ValidateFileExtension(file.Filename, allowedImageExtensions) {
-		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "不支持的图片格式，请上传 jpg, jpeg, png, webp 格式的图片"})
-		return
-	}
-
-	imagePath, err := utils.SaveUploadedFile(file, viper.GetString("storage.popup_path"))
+	image, err := utils.ProcessUploadedImage(file, mediaDir(mediaDirPopup), utils.PlainImageSpec())
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "保存图片失败: " + err.Error()})
+		respondImageError(c, "图片", err)
 		return
 	}
+	imagePath := image.Key
 
 	actions := c.PostForm("actions")
 	surplusCount, _ := strconv.Atoi(c.PostForm("surplus_count"))
@@ -162,6 +165,14 @@ func SendPopup(c *gin.Context) {
 		}
 	}
 
+	recordAudit(c, "operate.popup", "users", 0, nil, gin.H{
+		"user_ids":      userIDsStr,
+		"recipients":    len(targetUserIDs),
+		"img_url":       imagePath,
+		"actions":       actions,
+		"surplus_count": surplusCount,
+	})
+
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "弹窗发送成功"})
 }
 
@@ -217,6 +228,13 @@ func SendActions(c *gin.Context) {
 		}
 	}
 
+	recordAudit(c, "operate.actions", "users", 0, nil, gin.H{
+		"user_ids":      req.UserIDs,
+		"recipients":    len(targetUserIDs),
+		"actions":       string(req.Actions),
+		"surplus_count": req.SurplusCount,
+	})
+
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "云控发送成功"})
 }
 
@@ -261,6 +279,15 @@ func SendEmailToUsers(c *gin.Context) {
 		}
 	}
 
+	recordAudit(c, "operate.email", "users", 0, nil, gin.H{
+		"user_ids":      req.UserIDs,
+		"recipients":    len(targetUsers),
+		"subject":       req.Subject,
+		"body":          req.Body,
+		"success_count": successCount,
+		"error_count":   errorCount,
+	})
+
 	if successCount == 0 && errorCount > 0 {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "所有邮件都发送失败，请检查SMTP配置或联系管理员。"})
 		return
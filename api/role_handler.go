@@ -0,0 +1,312 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"market-api/db"
+	"market-api/middleware"
+	"market-api/models"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type RoleRequest struct {
+	Name        string   `json:"name" binding:"required"`
+	DisplayName string   `json:"display_name" binding:"required"`
+	Description string   `json:"description"`
+	Level       int      `json:"level"`
+	Permissions []string `json:"permissions"`
+}
+
+type RoleInfo struct {
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	DisplayName string   `json:"display_name"`
+	Description string   `json:"description"`
+	Level       int      `json:"level"`
+	Permissions []string `json:"permissions"`
+	BuiltIn     int      `json:"built_in"`
+}
+
+func toRoleInfo(role models.Role) RoleInfo {
+	permissions := []string{}
+	json.Unmarshal([]byte(role.Permissions), &permissions)
+	return RoleInfo{
+		ID:          role.ID,
+		Name:        role.Name,
+		DisplayName: role.DisplayName,
+		Description: role.Description,
+		Level:       role.Level,
+		Permissions: permissions,
+		BuiltIn:     role.BuiltIn,
+	}
+}
+
+func reloadRoles() {
+	if err := middleware.ReloadRoles(); err != nil {
+		fmt.Printf("Warning: failed to reload roles: %v\n", err)
+	}
+}
+
+func validateRoleGrant(c *gin.Context, level int, permissions []string) (int, string) {
+	access := middleware.CurrentAccess(c)
+	if level < 0 || level >= access.Level {
+		return http.StatusForbidden, "角色等级必须低于自身等级"
+	}
+	for _, p := range permissions {
+		if !middleware.IsKnownPermission(p) {
+			return http.StatusBadRequest, "未知的权限: " + p
+		}
+		if p == "*" || !access.Permissions[p] {
+			return http.StatusForbidden, "无权授予自身不具备的权限: " + p
+		}
+	}
+	return 0, ""
+}
+
+func ListPermissions(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"code": 200, "data": middleware.Permissions})
+}
+
+func GetMyPermissions(c *gin.Context) {
+	access := middleware.CurrentAccess(c)
+
+	roles := make([]RoleInfo, 0, len(access.Roles))
+	for _, role := range access.Roles {
+		roles = append(roles, toRoleInfo(role))
+	}
+	permissions := make([]string, 0, len(access.Permissions))
+	for _, p := range middleware.Permissions {
+		if access.Permissions[p.Key] {
+			permissions = append(permissions, p.Key)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"data": gin.H{
+			"level":       access.Level,
+			"roles":       roles,
+			"permissions": permissions,
+		},
+	})
+}
+
+func ListRoles(c *gin.Context) {
+	var roles []models.Role
+	db.DB.Order("level asc, id asc").Find(&roles)
+
+	data := make([]RoleInfo, 0, len(roles))
+	for _, role := range roles {
+		data = append(data, toRoleInfo(role))
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 200, "data": data})
+}
+
+func CreateRole(c *gin.Context) {
+	var req RoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "参数错误: " + err.Error()})
+		return
+	}
+	if status, msg := validateRoleGrant(c, req.Level, req.Permissions); status != 0 {
+		c.JSON(status, gin.H{"code": status, "msg": msg})
+		return
+	}
+
+	if req.Permissions == nil {
+		req.Permissions = []string{}
+	}
+	permissionsJSON, _ := json.Marshal(req.Permissions)
+	role := models.Role{
+		Name:        req.Name,
+		DisplayName: req.DisplayName,
+		Description: req.Description,
+		Level:       req.Level,
+		Permissions: string(permissionsJSON),
+	}
+	if err := db.DB.Create(&role).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "创建角色失败，角色标识可能已存在"})
+		return
+	}
+
+	reloadRoles()
+	recordAudit(c, "role.create", "role", role.ID, nil, toRoleInfo(role))
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "创建成功", "data": toRoleInfo(role)})
+}
+
+func UpdateRole(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	var role models.Role
+	if err := db.DB.First(&role, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "角色不存在"})
+		return
+	}
+
+	var req RoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "参数错误: " + err.Error()})
+		return
+	}
+
+	if role.Level >= middleware.CurrentAccess(c).Level {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权修改不低于自身等级的角色"})
+		return
+	}
+	if status, msg := validateRoleGrant(c, req.Level, req.Permissions); status != 0 {
+		c.JSON(status, gin.H{"code": status, "msg": msg})
+		return
+	}
+	if role.BuiltIn == 1 && (req.Name != role.Name || req.Level != role.Level) {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "内置角色不可修改标识和等级"})
+		return
+	}
+
+	if req.Permissions == nil {
+		req.Permissions = []string{}
+	}
+	permissionsJSON, _ := json.Marshal(req.Permissions)
+	updates := map[string]interface{}{
+		"name":         req.Name,
+		"display_name": req.DisplayName,
+		"description":  req.Description,
+		"level":        req.Level,
+		"permissions":  string(permissionsJSON),
+	}
+	if err := db.DB.Model(&role).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "更新角色失败，角色标识可能已存在"})
+		return
+	}
+
+	reloadRoles()
+	before := toRoleInfo(role)
+	db.DB.First(&role, id)
+	recordAudit(c, "role.update", "role", id, before, toRoleInfo(role))
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "更新成功", "data": toRoleInfo(role)})
+}
+
+func DeleteRole(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	var role models.Role
+	if err := db.DB.First(&role, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "角色不存在"})
+		return
+	}
+
+	if role.BuiltIn == 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "内置角色不可删除"})
+		return
+	}
+	if role.Level >= middleware.CurrentAccess(c).Level {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权删除不低于自身等级的角色"})
+		return
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("role_id = ?", role.ID).Delete(&models.UserRole{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&role).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "删除失败: " + err.Error()})
+		return
+	}
+
+	reloadRoles()
+	recordAudit(c, "role.delete", "role", id, toRoleInfo(role), nil)
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "删除成功"})
+}
+
+func GetUserRoles(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	var targetUser models.User
+	if err := db.DB.First(&targetUser, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "用户不存在"})
+		return
+	}
+
+	access := middleware.LoadUserAccess(targetUser)
+	roles := make([]RoleInfo, 0, len(access.Roles))
+	for _, role := range access.Roles {
+		roles = append(roles, toRoleInfo(role))
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 200, "data": gin.H{"level": access.Level, "roles": roles}})
+}
+
+func SetUserRoles(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	var req struct {
+		RoleIDs []int `json:"role_ids"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "参数错误: " + err.Error()})
+		return
+	}
+
+	var targetUser models.User
+	if err := db.DB.First(&targetUser, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "用户不存在"})
+		return
+	}
+
+	currentUser := c.MustGet("user").(models.User)
+	if currentUser.ID == targetUser.ID {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "无法修改自己的角色"})
+		return
+	}
+
+	currentLevel := middleware.CurrentAccess(c).Level
+	if currentLevel <= middleware.UserLevel(targetUser) {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权修改该用户的角色"})
+		return
+	}
+
+	var roles []models.Role
+	if len(req.RoleIDs) > 0 {
+		db.DB.Where("id IN ?", req.RoleIDs).Find(&roles)
+	}
+	if len(roles) != len(req.RoleIDs) {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "存在无效的角色"})
+		return
+	}
+
+	var previousRoleIDs []int
+	db.DB.Model(&models.UserRole{}).Where("user_id = ?", targetUser.ID).Pluck("role_id", &previousRoleIDs)
+
+	userPermission := 0
+	for _, role := range roles {
+		if role.Level >= currentLevel {
+			c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权授予角色: " + role.DisplayName})
+			return
+		}
+		if role.Level > userPermission {
+			userPermission = role.Level
+		}
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", targetUser.ID).Delete(&models.UserRole{}).Error; err != nil {
+			return err
+		}
+		for _, role := range roles {
+			if err := tx.Create(&models.UserRole{UserID: targetUser.ID, RoleID: role.ID}).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&targetUser).Update("user_permission", userPermission).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "更新失败: " + err.Error()})
+		return
+	}
+
+	recordAudit(c, "user.set_roles", "user", targetUser.ID,
+		gin.H{"role_ids": previousRoleIDs, "user_permission": targetUser.UserPermission},
+		gin.H{"role_ids": req.RoleIDs, "user_permission": userPermission})
+
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "角色已更新"})
+}
@@ -0,0 +1,258 @@
+package api
+
+import (
+	"errors"
+	"market-api/db"
+	"market-api/models"
+	"market-api/utils"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var errRefreshTokenReused = errors.New("refresh token reused")
+
+func refreshTokenLifetime() time.Duration {
+	hours := viper.GetInt("jwt.refresh_expire_hours")
+	if hours <= 0 {
+		hours = 168
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+func sessionMaxLifetime() time.Duration {
+	hours := viper.GetInt("jwt.session_max_hours")
+	if hours <= 0 {
+		hours = 720
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+func sessionExpireTime(loginToken models.UserToken, now time.Time) int64 {
+	expire := now.Add(refreshTokenLifetime()).UnixMilli()
+	if maxExpire := time.UnixMilli(loginToken.CreateTime).Add(sessionMaxLifetime()).UnixMilli(); expire > maxExpire {
+		expire = maxExpire
+	}
+	return expire
+}
+
+func issueSessionTokens(tx *gorm.DB, user *models.User, loginToken *models.UserToken) (string, string, error) {
+	now := time.Now()
+	expireTime := sessionExpireTime(*loginToken, now)
+
+	refreshToken, refreshHash, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	record := models.UserRefreshToken{
+		TokenID:    loginToken.ID,
+		TokenHash:  refreshHash,
+		Status:     1,
+		CreateTime: now.UnixMilli(),
+		ExpireTime: expireTime,
+	}
+	if err := tx.Create(&record).Error; err != nil {
+		return "", "", err
+	}
+
+	accessToken, err := utils.GenerateToken(user, loginToken.ID)
+	if err != nil {
+		return "", "", err
+	}
+
+	updates := map[string]interface{}{
+		"token":       accessToken,
+		"expire_time": expireTime,
+	}
+	if err := tx.Model(loginToken).Updates(updates).Error; err != nil {
+		return "", "", err
+	}
+	loginToken.Token = accessToken
+	loginToken.ExpireTime = expireTime
+
+	return accessToken, refreshToken, nil
+}
+
+func revokeTokenFamily(tx *gorm.DB, tokenID int) error {
+	if err := tx.Model(&models.UserToken{}).Where("id = ?", tokenID).Update("status", 0).Error; err != nil {
+		return err
+	}
+	return tx.Model(&models.UserRefreshToken{}).Where("token_id = ? AND status = ?", tokenID, 1).Update("status", 0).Error
+}
+
+func accessTokenExpiresIn() int {
+	return int(utils.AccessTokenLifetime().Seconds())
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+func RefreshToken(c *gin.Context) {
+	var req RefreshTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "参数错误"})
+		return
+	}
+
+	var accessToken, refreshToken string
+	var user models.User
+	now := time.Now()
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		var record models.UserRefreshToken
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ?", utils.HashOpaqueToken(req.RefreshToken)).
+			First(&record).Error; err != nil {
+			return err
+		}
+
+		if record.Status != 1 {
+			return errRefreshTokenReused
+		}
+		if record.ExpireTime <= now.UnixMilli() {
+			return gorm.ErrRecordNotFound
+		}
+
+		var loginToken models.UserToken
+		if err := tx.Where("id = ? AND status = ? AND expire_time > ?", record.TokenID, 1, now.UnixMilli()).
+			First(&loginToken).Error; err != nil {
+			return err
+		}
+
+		if err := tx.First(&user, loginToken.ByUserID).Error; err != nil {
+			return err
+		}
+		if user.BanTime > now.UnixMilli() {
+			return revokeTokenFamily(tx, loginToken.ID)
+		}
+
+		if err := tx.Model(&record).Update("status", 0).Error; err != nil {
+			return err
+		}
+
+		var err error
+		accessToken, refreshToken, err = issueSessionTokens(tx, &user, &loginToken)
+		return err
+	})
+
+	if errors.Is(err, errRefreshTokenReused) {
+		db.DB.Transaction(func(tx *gorm.DB) error {
+			var record models.UserRefreshToken
+			if err := tx.Where("token_hash = ?", utils.HashOpaqueToken(req.RefreshToken)).First(&record).Error; err != nil {
+				return err
+			}
+			return revokeTokenFamily(tx, record.TokenID)
+		})
+		c.JSON(http.StatusUnauthorized, gin.H{"code": 401, "msg": "检测到登录凭证被重复使用，该登录已失效，请重新登录"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"code": 401, "msg": "登录已过期，请重新登录"})
+		return
+	}
+	if accessToken == "" {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "您已被封禁，请等待解禁后再登录后台。"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "刷新成功",
+		"data": gin.H{
+			"token":         accessToken,
+			"refresh_token": refreshToken,
+			"expires_in":    accessTokenExpiresIn(),
+		},
+	})
+}
+
+type SessionInfo struct {
+	ID           int    `json:"id"`
+	LoginDevice  string `json:"login_device"`
+	UserAgent    string `json:"user_agent"`
+	LoginIP      string `json:"login_ip"`
+	LastUsedIP   string `json:"last_used_ip"`
+	CreateTime   int64  `json:"create_time"`
+	LastUsedTime int64  `json:"last_used_time"`
+	ExpireTime   int64  `json:"expire_time"`
+	Current      bool   `json:"current"`
+}
+
+func ListMySessions(c *gin.Context) {
+	currentUser := c.MustGet("user").(models.User)
+	currentTokenID := c.MustGet("token_id").(int)
+
+	var tokens []models.UserToken
+	db.DB.Where("by_userid = ? AND status = ? AND expire_time > ?", currentUser.ID, 1, time.Now().UnixMilli()).
+		Order("last_used_time desc").
+		Find(&tokens)
+
+	sessions := make([]SessionInfo, 0, len(tokens))
+	for _, t := range tokens {
+		sessions = append(sessions, SessionInfo{
+			ID:           t.ID,
+			LoginDevice:  t.LoginDevice,
+			UserAgent:    t.UserAgent,
+			LoginIP:      t.LoginIP,
+			LastUsedIP:   t.LastUsedIP,
+			CreateTime:   t.CreateTime,
+			LastUsedTime: t.LastUsedTime,
+			ExpireTime:   t.ExpireTime,
+			Current:      t.ID == currentTokenID,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"code": 200, "data": sessions})
+}
+
+func RevokeMySession(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	currentUser := c.MustGet("user").(models.User)
+
+	var token models.UserToken
+	if err := db.DB.Where("id = ? AND by_userid = ?", id, currentUser.ID).First(&token).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "登录记录不存在"})
+		return
+	}
+
+	if err := db.DB.Transaction(func(tx *gorm.DB) error {
+		return revokeTokenFamily(tx, token.ID)
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "操作失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "已退出该设备"})
+}
+
+func RevokeOtherSessions(c *gin.Context) {
+	currentUser := c.MustGet("user").(models.User)
+	currentTokenID := c.MustGet("token_id").(int)
+
+	var tokenIDs []int
+	db.DB.Model(&models.UserToken{}).
+		Where("by_userid = ? AND status = ? AND id <> ?", currentUser.ID, 1, currentTokenID).
+		Pluck("id", &tokenIDs)
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		for _, tokenID := range tokenIDs {
+			if err := revokeTokenFamily(tx, tokenID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "操作失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "已退出其他所有设备", "data": gin.H{"count": len(tokenIDs)}})
+}
@@ -0,0 +1,582 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"market-api/db"
+	"market-api/models"
+	"market-api/utils"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	taxonomyTags         = "tags"
+	taxonomyTypes        = "types"
+	taxonomyVersionTypes = "version_types"
+)
+
+var (
+	errTaxonomyInUse         = errors.New("taxonomy entry still referenced")
+	errTaxonomyTargetInvalid = errors.New("invalid reassign target")
+)
+
+type taxonomyCacheEntry struct {
+	rows     interface{}
+	loadedAt time.Time
+}
+
+var taxonomyCache = struct {
+	mu      sync.Mutex
+	entries map[string]taxonomyCacheEntry
+}{entries: map[string]taxonomyCacheEntry{}}
+
+type TaxonomyNameRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+type TaxonomyOrderRequest struct {
+	IDs []int `json:"ids" binding:"required"`
+}
+
+func taxonomyCacheTTL() time.Duration {
+	seconds := viper.GetInt("taxonomy.cache_seconds")
+	if seconds <= 0 {
+		seconds = 300
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func cachedTaxonomy[T any](kind string) ([]T, error) {
+	taxonomyCache.mu.Lock()
+	defer taxonomyCache.mu.Unlock()
+	if entry, ok := taxonomyCache.entries[kind]; ok && time.Since(entry.loadedAt) < taxonomyCacheTTL() {
+		return entry.rows.([]T), nil
+	}
+	rows := []T{}
+	if err := db.DB.Order("sort_order asc, id asc").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	taxonomyCache.entries[kind] = taxonomyCacheEntry{rows: rows, loadedAt: time.Now()}
+	return rows, nil
+}
+
+func invalidateTaxonomy(kind string) {
+	taxonomyCache.mu.Lock()
+	defer taxonomyCache.mu.Unlock()
+	delete(taxonomyCache.entries, kind)
+}
+
+func nextTaxonomySortOrder(model interface{}) int {
+	var max int
+	db.DB.Model(model).Select("COALESCE(MAX(sort_order), 0)").Scan(&max)
+	return max + 1
+}
+
+func hasTagID(tags string, id int) bool {
+	for _, tag := range strings.Split(tags, ",") {
+		if strings.TrimSpace(tag) == strconv.Itoa(id) {
+			return true
+		}
+	}
+	return false
+}
+
+func replaceTagID(tags string, from, to int) (string, bool) {
+	fromID, toID := strconv.Itoa(from), strconv.Itoa(to)
+	seen := map[string]bool{}
+	changed := false
+	var kept []string
+	for _, tag := range strings.Split(tags, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if tag == fromID {
+			tag = toID
+			changed = true
+		}
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		kept = append(kept, tag)
+	}
+	if !changed {
+		return tags, false
+	}
+	return "," + strings.Join(kept, ",") + ",", true
+}
+
+func forEachPendingRevision(tx *gorm.DB, key string, fn func(revision models.AppRevision, data map[string]interface{}, value interface{}) error) error {
+	var revisions []models.AppRevision
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("status = ?", revisionPending).Find(&revisions).Error; err != nil {
+		return err
+	}
+	for _, revision := range revisions {
+		data := revisionData(revision)
+		value, ok := data[key]
+		if !ok {
+			continue
+		}
+		if err := fn(revision, data, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func saveRevisionData(tx *gorm.DB, revision models.AppRevision, data map[string]interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return tx.Model(&models.AppRevision{}).Where("id = ?", revision.ID).Update("data", string(raw)).Error
+}
+
+func taxonomyColumnReferences(tx *gorm.DB, column string, id int) (int64, error) {
+	var count int64
+	if err := tx.Model(&models.App{}).Clauses(clause.Locking{Strength: "UPDATE"}).Where(column+" = ?", id).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	err := forEachPendingRevision(tx, column, func(_ models.AppRevision, _ map[string]interface{}, value interface{}) error {
+		if fmt.Sprint(value) == strconv.Itoa(id) {
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+func reassignTaxonomyColumn(tx *gorm.DB, column string, from, to int) error {
+	if err := tx.Model(&models.App{}).Where(column+" = ?", from).Update(column, to).Error; err != nil {
+		return err
+	}
+	return forEachPendingRevision(tx, column, func(revision models.AppRevision, data map[string]interface{}, value interface{}) error {
+		if fmt.Sprint(value) != strconv.Itoa(from) {
+			return nil
+		}
+		data[column] = to
+		return saveRevisionData(tx, revision, data)
+	})
+}
+
+func tagReferences(tx *gorm.DB, id int) (int64, error) {
+	var count int64
+	if err := tx.Model(&models.App{}).Clauses(clause.Locking{Strength: "UPDATE"}).Where("FIND_IN_SET(?, app_tags) > 0", strconv.Itoa(id)).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	err := forEachPendingRevision(tx, "app_tags", func(_ models.AppRevision, _ map[string]interface{}, value interface{}) error {
+		if hasTagID(fmt.Sprint(value), id) {
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+func reassignTag(tx *gorm.DB, from, to int) error {
+	var apps []models.App
+	if err := tx.Select("id", "app_tags").Where("FIND_IN_SET(?, app_tags) > 0", strconv.Itoa(from)).Find(&apps).Error; err != nil {
+		return err
+	}
+	for _, app := range apps {
+		tags, _ := replaceTagID(app.AppTags, from, to)
+		if err := tx.Model(&models.App{}).Where("id = ?", app.ID).Update("app_tags", tags).Error; err != nil {
+			return err
+		}
+	}
+	return forEachPendingRevision(tx, "app_tags", func(revision models.AppRevision, data map[string]interface{}, value interface{}) error {
+		tags, changed := replaceTagID(fmt.Sprint(value), from, to)
+		if !changed {
+			return nil
+		}
+		data["app_tags"] = tags
+		return saveRevisionData(tx, revision, data)
+	})
+}
+
+func deleteTaxonomyEntry(c *gin.Context, label string, model interface{}, id int, references func(*gorm.DB, int) (int64, error), reassign func(*gorm.DB, int, int) error) (int, bool) {
+	reassignTo, _ := strconv.Atoi(c.Query("reassign_to"))
+	if reassignTo == id {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "替换的" + label + "无效"})
+		return 0, false
+	}
+
+	var count int64
+	var countErr error
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if reassignTo != 0 {
+			var target int64
+			if err := tx.Model(model).Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", reassignTo).Count(&target).Error; err != nil {
+				return err
+			}
+			if target == 0 {
+				return errTaxonomyTargetInvalid
+			}
+		}
+
+		if count, countErr = references(tx, id); countErr != nil {
+			return countErr
+		}
+		if count > 0 {
+			if reassignTo == 0 {
+				return errTaxonomyInUse
+			}
+			if err := reassign(tx, id, reassignTo); err != nil {
+				return err
+			}
+		}
+		return tx.Delete(model, id).Error
+	})
+	switch {
+	case err == nil:
+		return reassignTo, true
+	case errors.Is(err, errTaxonomyTargetInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "替换的" + label + "无效"})
+	case errors.Is(err, errTaxonomyInUse):
+		c.JSON(http.StatusConflict, gin.H{"code": 409, "msg": fmt.Sprintf("仍有 %d 个应用使用该%s，请指定替换的%s后再删除", count, label, label), "data": gin.H{"references": count}})
+	case countErr != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "统计" + label + "引用失败: " + err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "删除" + label + "失败: " + err.Error()})
+	}
+	return 0, false
+}
+
+func bindTaxonomyName(c *gin.Context) (string, bool) {
+	var req TaxonomyNameRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "参数错误: " + err.Error()})
+		return "", false
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "名称不能为空"})
+		return "", false
+	}
+	return name, true
+}
+
+func reorderTaxonomy(c *gin.Context, label string, model interface{}) ([]int, []int, bool) {
+	var req TaxonomyOrderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "参数错误: " + err.Error()})
+		return nil, nil, false
+	}
+
+	var existing []int
+	db.DB.Model(model).Order("sort_order asc, id asc").Pluck("id", &existing)
+	known := map[int]bool{}
+	for _, id := range existing {
+		known[id] = true
+	}
+	seen := map[int]bool{}
+	for _, id := range req.IDs {
+		if !known[id] || seen[id] {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": label + "列表与现有数据不一致"})
+			return nil, nil, false
+		}
+		seen[id] = true
+	}
+	if len(seen) != len(known) {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": label + "列表与现有数据不一致"})
+		return nil, nil, false
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		for i, id := range req.IDs {
+			if err := tx.Model(model).Where("id = ?", id).Update("sort_order", i+1).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "调整" + label + "顺序失败: " + err.Error()})
+		return nil, nil, false
+	}
+	return existing, req.IDs, true
+}
+
+func CreateAppTag(c *gin.Context) {
+	name := strings.TrimSpace(c.PostForm("name"))
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "标签名称不能为空"})
+		return
+	}
+	uploadPermission, _ := strconv.Atoi(c.PostForm("upload_permission"))
+
+	tag := models.AppTag{
+		Name:             name,
+		UploadPermission: uploadPermission,
+		SortOrder:        nextTaxonomySortOrder(&models.AppTag{}),
+	}
+	var iconKey string
+	if file, err := c.FormFile("icon"); err == nil {
+		image, err := utils.ProcessUploadedImage(file, mediaDir(mediaDirTagIcon), utils.PlainImageSpec())
+		if err != nil {
+			respondImageError(c, "图标", err)
+			return
+		}
+		tag.Icon = image.URL
+		iconKey = image.Key
+	}
+
+	if err := db.DB.Create(&tag).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "创建标签失败: " + err.Error()})
+		return
+	}
+
+	retainMedia(mediaOwnerTag, tag.ID, []string{iconKey})
+	invalidateTaxonomy(taxonomyTags)
+	recordAudit(c, "tag.create", "tag", tag.ID, nil, tag)
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "创建成功", "data": tag})
+}
+
+func UpdateAppTag(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	var tag models.AppTag
+	if err := db.DB.First(&tag, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "标签不存在"})
+		return
+	}
+
+	updates := map[string]interface{}{}
+	if name, ok := c.GetPostForm("name"); ok {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "标签名称不能为空"})
+			return
+		}
+		updates["name"] = name
+	}
+	if value, ok := c.GetPostForm("upload_permission"); ok {
+		uploadPermission, err := strconv.Atoi(value)
+		if err != nil || uploadPermission < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "上传权限参数错误"})
+			return
+		}
+		updates["upload_permission"] = uploadPermission
+	}
+
+	var iconKey string
+	if file, err := c.FormFile("icon"); err == nil {
+		image, err := utils.ProcessUploadedImage(file, mediaDir(mediaDirTagIcon), utils.PlainImageSpec())
+		if err != nil {
+			respondImageError(c, "图标", err)
+			return
+		}
+		updates["icon"] = image.URL
+		iconKey = image.Key
+	} else if c.PostForm("remove_icon") == "1" {
+		updates["icon"] = ""
+	}
+
+	if len(updates) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "没有需要修改的内容"})
+		return
+	}
+
+	if err := db.DB.Model(&models.AppTag{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "更新标签失败: " + err.Error()})
+		return
+	}
+
+	if _, changed := updates["icon"]; changed {
+		retainMedia(mediaOwnerTag, id, []string{iconKey})
+		if oldKey, ok := utils.StorageKeyFromURL(tag.Icon); ok && oldKey != iconKey {
+			releaseMedia(mediaOwnerTag, id, []string{oldKey})
+		}
+	}
+
+	var updated models.AppTag
+	db.DB.First(&updated, id)
+	invalidateTaxonomy(taxonomyTags)
+	recordAudit(c, "tag.update", "tag", id, tag, updated)
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "更新成功", "data": updated})
+}
+
+func DeleteAppTag(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	var tag models.AppTag
+	if err := db.DB.First(&tag, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "标签不存在"})
+		return
+	}
+
+	reassignTo, ok := deleteTaxonomyEntry(c, "标签", &models.AppTag{}, id, tagReferences, reassignTag)
+	if !ok {
+		return
+	}
+
+	if key, ok := utils.StorageKeyFromURL(tag.Icon); ok {
+		releaseMedia(mediaOwnerTag, id, []string{key})
+	}
+	invalidateTaxonomy(taxonomyTags)
+	recordAudit(c, "tag.delete", "tag", id, tag, gin.H{"reassign_to": reassignTo})
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "删除成功"})
+}
+
+func ReorderAppTags(c *gin.Context) {
+	before, after, ok := reorderTaxonomy(c, "标签", &models.AppTag{})
+	if !ok {
+		return
+	}
+	invalidateTaxonomy(taxonomyTags)
+	recordAudit(c, "tag.reorder", "tag", 0, before, after)
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "调整成功"})
+}
+
+func CreateAppType(c *gin.Context) {
+	name, ok := bindTaxonomyName(c)
+	if !ok {
+		return
+	}
+	appType := models.AppType{Name: name, SortOrder: nextTaxonomySortOrder(&models.AppType{})}
+	if err := db.DB.Create(&appType).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "创建应用类型失败: " + err.Error()})
+		return
+	}
+	invalidateTaxonomy(taxonomyTypes)
+	recordAudit(c, "app_type.create", "app_type", appType.ID, nil, appType)
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "创建成功", "data": appType})
+}
+
+func UpdateAppType(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	name, ok := bindTaxonomyName(c)
+	if !ok {
+		return
+	}
+
+	var appType models.AppType
+	if err := db.DB.First(&appType, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "应用类型不存在"})
+		return
+	}
+	if err := db.DB.Model(&models.AppType{}).Where("id = ?", id).Update("name", name).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "更新应用类型失败: " + err.Error()})
+		return
+	}
+
+	var updated models.AppType
+	db.DB.First(&updated, id)
+	invalidateTaxonomy(taxonomyTypes)
+	recordAudit(c, "app_type.update", "app_type", id, appType, updated)
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "更新成功", "data": updated})
+}
+
+func DeleteAppType(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	var appType models.AppType
+	if err := db.DB.First(&appType, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "应用类型不存在"})
+		return
+	}
+
+	references := func(tx *gorm.DB, id int) (int64, error) { return taxonomyColumnReferences(tx, "app_type", id) }
+	reassign := func(tx *gorm.DB, from, to int) error { return reassignTaxonomyColumn(tx, "app_type", from, to) }
+	reassignTo, ok := deleteTaxonomyEntry(c, "应用类型", &models.AppType{}, id, references, reassign)
+	if !ok {
+		return
+	}
+
+	invalidateTaxonomy(taxonomyTypes)
+	recordAudit(c, "app_type.delete", "app_type", id, appType, gin.H{"reassign_to": reassignTo})
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "删除成功"})
+}
+
+func ReorderAppTypes(c *gin.Context) {
+	before, after, ok := reorderTaxonomy(c, "应用类型", &models.AppType{})
+	if !ok {
+		return
+	}
+	invalidateTaxonomy(taxonomyTypes)
+	recordAudit(c, "app_type.reorder", "app_type", 0, before, after)
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "调整成功"})
+}
+
+func CreateAppVersionType(c *gin.Context) {
+	name, ok := bindTaxonomyName(c)
+	if !ok {
+		return
+	}
+	versionType := models.AppVersionType{Name: name, SortOrder: nextTaxonomySortOrder(&models.AppVersionType{})}
+	if err := db.DB.Create(&versionType).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "创建版本类型失败: " + err.Error()})
+		return
+	}
+	invalidateTaxonomy(taxonomyVersionTypes)
+	recordAudit(c, "app_version_type.create", "app_version_type", versionType.ID, nil, versionType)
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "创建成功", "data": versionType})
+}
+
+func UpdateAppVersionType(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	name, ok := bindTaxonomyName(c)
+	if !ok {
+		return
+	}
+
+	var versionType models.AppVersionType
+	if err := db.DB.First(&versionType, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "版本类型不存在"})
+		return
+	}
+	if err := db.DB.Model(&models.AppVersionType{}).Where("id = ?", id).Update("name", name).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "更新版本类型失败: " + err.Error()})
+		return
+	}
+
+	var updated models.AppVersionType
+	db.DB.First(&updated, id)
+	invalidateTaxonomy(taxonomyVersionTypes)
+	recordAudit(c, "app_version_type.update", "app_version_type", id, versionType, updated)
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "更新成功", "data": updated})
+}
+
+func DeleteAppVersionType(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	var versionType models.AppVersionType
+	if err := db.DB.First(&versionType, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "版本类型不存在"})
+		return
+	}
+
+	references := func(tx *gorm.DB, id int) (int64, error) { return taxonomyColumnReferences(tx, "app_version_type", id) }
+	reassign := func(tx *gorm.DB, from, to int) error {
+		return reassignTaxonomyColumn(tx, "app_version_type", from, to)
+	}
+	reassignTo, ok := deleteTaxonomyEntry(c, "版本类型", &models.AppVersionType{}, id, references, reassign)
+	if !ok {
+		return
+	}
+
+	invalidateTaxonomy(taxonomyVersionTypes)
+	recordAudit(c, "app_version_type.delete", "app_version_type", id, versionType, gin.H{"reassign_to": reassignTo})
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "删除成功"})
+}
+
+func ReorderAppVersionTypes(c *gin.Context) {
+	before, after, ok := reorderTaxonomy(c, "版本类型", &models.AppVersionType{})
+	if !ok {
+		return
+	}
+	invalidateTaxonomy(taxonomyVersionTypes)
+	recordAudit(c, "app_version_type.reorder", "app_version_type", 0, before, after)
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "调整成功"})
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"market-api/db"
+	"market-api/models"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestDeleteAppTypeReassignsReferences(t *testing.T) {
+	setupTestDB(t, &models.App{}, &models.AppRevision{}, &models.AppType{}, &models.AuditLog{})
+
+	db.DB.Create(&[]models.AppType{{ID: 1, Name: "游戏"}, {ID: 2, Name: "工具"}})
+	db.DB.Create(&models.App{ID: 1, AppName: "应用", AppTypeID: 1})
+	db.DB.Create(&models.AppRevision{ID: 1, AppID: 1, Status: revisionPending, Data: `{"app_type":1,"app_name":"应用"}`})
+	db.DB.Create(&models.AppRevision{ID: 2, AppID: 1, Status: revisionApplied, Data: `{"app_type":1}`})
+
+	router := gin.New()
+	router.DELETE("/types/:id", DeleteAppType)
+	remove := func(path string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, path, nil))
+		var body map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body
+	}
+
+	status, body := remove("/types/1")
+	if status != http.StatusConflict {
+		t.Fatalf("delete without reassign = %d %v, want 409", status, body)
+	}
+	if refs := body["data"].(map[string]interface{})["references"]; refs != float64(2) {
+		t.Fatalf("references = %v, want 2", refs)
+	}
+	for _, target := range []string{"1", "99"} {
+		if status, body := remove("/types/1?reassign_to=" + target); status != http.StatusBadRequest {
+			t.Fatalf("reassign to %s = %d %v, want 400", target, status, body)
+		}
+	}
+
+	if status, body := remove("/types/1?reassign_to=2"); status != http.StatusOK {
+		t.Fatalf("delete with reassign = %d %v", status, body)
+	}
+	var app models.App
+	db.DB.First(&app, 1)
+	if app.AppTypeID != 2 {
+		t.Fatalf("app type = %d, want 2", app.AppTypeID)
+	}
+	var pending, applied models.AppRevision
+	db.DB.First(&pending, 1)
+	db.DB.First(&applied, 2)
+	if fmt.Sprint(revisionData(pending)["app_type"]) != "2" || revisionData(pending)["app_name"] != "应用" {
+		t.Fatalf("pending revision data = %s", pending.Data)
+	}
+	if applied.Data != `{"app_type":1}` {
+		t.Fatalf("applied revision rewritten: %s", applied.Data)
+	}
+	var remaining int64
+	db.DB.Model(&models.AppType{}).Where("id = ?", 1).Count(&remaining)
+	if remaining != 0 {
+		t.Fatal("app type 1 was not deleted")
+	}
+	var audits int64
+	db.DB.Model(&models.AuditLog{}).Where("action = ?", "app_type.delete").Count(&audits)
+	if audits != 1 {
+		t.Fatalf("audit entries = %d, want 1", audits)
+	}
+
+	if status, _ := remove("/types/2"); status != http.StatusConflict {
+		t.Fatalf("delete of reassigned target = %d, want 409", status)
+	}
+}
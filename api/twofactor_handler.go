@@ -0,0 +1,321 @@
+package api
+
+import (
+	"encoding/json"
+	"market-api/db"
+	"market-api/middleware"
+	"market-api/models"
+	"market-api/utils"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const totpIssuer = "弦-应用商店"
+
+func verifySecondFactor(tx *gorm.DB, user *models.User, code string) bool {
+	if step, ok := utils.ValidateTOTP(user.TotpSecret, code, time.Now()); ok {
+		if step <= user.TotpLastStep {
+			return false
+		}
+		result := tx.Model(&models.User{}).
+			Where("id = ? AND totp_last_step < ?", user.ID, step).
+			Update("totp_last_step", step)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return false
+		}
+		user.TotpLastStep = step
+		return true
+	}
+
+	var hashes []string
+	if user.TotpRecovery == "" || json.Unmarshal([]byte(user.TotpRecovery), &hashes) != nil {
+		return false
+	}
+
+	target := utils.HashRecoveryCode(code)
+	for i, h := range hashes {
+		if h != target {
+			continue
+		}
+		remaining := append(hashes[:i:i], hashes[i+1:]...)
+		remainingJSON, _ := json.Marshal(remaining)
+		result := tx.Model(&models.User{}).
+			Where("id = ? AND totp_recovery = ?", user.ID, user.TotpRecovery).
+			Update("totp_recovery", string(remainingJSON))
+		if result.Error != nil || result.RowsAffected == 0 {
+			return false
+		}
+		user.TotpRecovery = string(remainingJSON)
+		return true
+	}
+	return false
+}
+
+func newRecoveryCodes() ([]string, string, error) {
+	codes, err := utils.GenerateRecoveryCodes(10)
+	if err != nil {
+		return nil, "", err
+	}
+	hashes := make([]string, 0, len(codes))
+	for _, code := range codes {
+		hashes = append(hashes, utils.HashRecoveryCode(code))
+	}
+	hashesJSON, _ := json.Marshal(hashes)
+	return codes, string(hashesJSON), nil
+}
+
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code" binding:"required"`
+}
+
+func LoginTwoFactor(c *gin.Context) {
+	var req TwoFactorLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "参数错误"})
+		return
+	}
+
+	claims, err := utils.ParseToken(req.ChallengeToken)
+	if err != nil || claims.Purpose != utils.TwoFactorChallengePurpose {
+		c.JSON(http.StatusUnauthorized, gin.H{"code": 401, "msg": "验证已过期，请重新登录"})
+		return
+	}
+
+	var user models.User
+	if err := db.DB.First(&user, claims.UserID).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"code": 401, "msg": "用户不存在"})
+		return
+	}
+
+	if !checkLoginAllowed(c, user.Username) {
+		return
+	}
+
+	if user.TotpEnabled != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "该账号未开启两步验证，请重新登录"})
+		return
+	}
+
+	if user.BanTime > time.Now().UnixMilli() {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "您已被封禁，请等待解禁后再登录后台。"})
+		return
+	}
+
+	if !verifySecondFactor(db.DB, &user, req.Code) {
+		recordLoginFailure(c, user.Username)
+		c.JSON(http.StatusUnauthorized, gin.H{"code": 403, "msg": "验证码错误"})
+		return
+	}
+
+	completeLogin(c, user)
+}
+
+func GetTwoFactorStatus(c *gin.Context) {
+	currentUser := c.MustGet("user").(models.User)
+
+	var hashes []string
+	json.Unmarshal([]byte(currentUser.TotpRecovery), &hashes)
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"data": gin.H{
+			"enabled":                  currentUser.TotpEnabled == 1,
+			"required":                 middleware.TwoFactorRequired(currentUser),
+			"recovery_codes_remaining": len(hashes),
+		},
+	})
+}
+
+func SetupTwoFactor(c *gin.Context) {
+	currentUser := c.MustGet("user").(models.User)
+
+	if currentUser.TotpEnabled == 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "已开启两步验证，如需更换请先关闭"})
+		return
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "生成密钥失败"})
+		return
+	}
+
+	if err := db.DB.Model(&currentUser).Update("totp_secret", secret).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "保存密钥失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"data": gin.H{
+			"secret":      secret,
+			"otpauth_uri": utils.TOTPURI(totpIssuer, currentUser.Username, secret),
+		},
+	})
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+func EnableTwoFactor(c *gin.Context) {
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "参数错误"})
+		return
+	}
+
+	currentUser := c.MustGet("user").(models.User)
+
+	if currentUser.TotpEnabled == 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "已开启两步验证"})
+		return
+	}
+	if currentUser.TotpSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "请先生成两步验证密钥"})
+		return
+	}
+
+	step, ok := utils.ValidateTOTP(currentUser.TotpSecret, req.Code, time.Now())
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "验证码错误"})
+		return
+	}
+
+	codes, hashesJSON, err := newRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "生成恢复码失败"})
+		return
+	}
+
+	updates := map[string]interface{}{
+		"totp_enabled":   1,
+		"totp_last_step": step,
+		"totp_recovery":  hashesJSON,
+	}
+	if err := db.DB.Model(&currentUser).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "开启两步验证失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "两步验证已开启，请妥善保存恢复码",
+		"data": gin.H{"recovery_codes": codes},
+	})
+}
+
+type DisableTwoFactorRequest struct {
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+func DisableTwoFactor(c *gin.Context) {
+	var req DisableTwoFactorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "参数错误"})
+		return
+	}
+
+	currentUser := c.MustGet("user").(models.User)
+
+	if currentUser.TotpEnabled != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "未开启两步验证"})
+		return
+	}
+
+	if middleware.TwoFactorRequired(currentUser) {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "当前账号必须开启两步验证，无法关闭"})
+		return
+	}
+
+	if ok, _ := utils.VerifyPassword(req.Password, currentUser.Password); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "密码不正确"})
+		return
+	}
+
+	if !verifySecondFactor(db.DB, &currentUser, req.Code) {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "验证码错误"})
+		return
+	}
+
+	updates := map[string]interface{}{
+		"totp_enabled":   0,
+		"totp_secret":    "",
+		"totp_last_step": 0,
+		"totp_recovery":  "",
+	}
+	if err := db.DB.Model(&currentUser).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "关闭两步验证失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "两步验证已关闭"})
+}
+
+func RegenerateRecoveryCodes(c *gin.Context) {
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "参数错误"})
+		return
+	}
+
+	currentUser := c.MustGet("user").(models.User)
+
+	if currentUser.TotpEnabled != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "未开启两步验证"})
+		return
+	}
+
+	if !verifySecondFactor(db.DB, &currentUser, req.Code) {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "验证码错误"})
+		return
+	}
+
+	codes, hashesJSON, err := newRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "生成恢复码失败"})
+		return
+	}
+
+	if err := db.DB.Model(&currentUser).Update("totp_recovery", hashesJSON).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "保存恢复码失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "恢复码已重新生成", "data": gin.H{"recovery_codes": codes}})
+}
+
+func ResetUserTwoFactor(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	var targetUser models.User
+	if err := db.DB.First(&targetUser, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "用户不存在"})
+		return
+	}
+
+	if middleware.CurrentAccess(c).Level <= middleware.UserLevel(targetUser) {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权重置该用户的两步验证"})
+		return
+	}
+
+	updates := map[string]interface{}{
+		"totp_enabled":   0,
+		"totp_secret":    "",
+		"totp_last_step": 0,
+		"totp_recovery":  "",
+	}
+	if err := db.DB.Model(&targetUser).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "重置两步验证失败: " + err.Error()})
+		return
+	}
+
+	recordAudit(c, "user.reset_2fa", "user", targetUser.ID, gin.H{"totp_enabled": targetUser.TotpEnabled}, gin.H{"totp_enabled": 0})
+
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "两步验证已重置"})
+}
@@ -0,0 +1,182 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"market-api/db"
+	"market-api/models"
+	"market-api/utils"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+const (
+	uploadAwaitingBinary = "awaiting_binary"
+	uploadPendingAudit   = "pending_audit"
+	uploadExpired        = "expired"
+)
+
+type FileServerCallbackRequest struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func FileServerUploadCallback(c *gin.Context) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "读取回调内容失败"})
+		return
+	}
+	if !utils.VerifyFileServerCallback(c.GetHeader("X-Callback-Timestamp"), c.GetHeader("X-Callback-Signature"), body) {
+		c.JSON(http.StatusUnauthorized, gin.H{"code": 401, "msg": "回调签名无效"})
+		return
+	}
+
+	var req FileServerCallbackRequest
+	if err := json.Unmarshal(body, &req); err != nil || req.Path == "" || req.Size <= 0 || len(req.SHA256) != 64 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "回调参数错误"})
+		return
+	}
+
+	var version models.AppVersion
+	if err := db.DB.Where("apk_path = ?", req.Path).First(&version).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "未找到对应的上传记录"})
+		return
+	}
+	if version.UploadState == uploadExpired {
+		c.JSON(http.StatusGone, gin.H{"code": 410, "msg": "该上传已超时过期"})
+		return
+	}
+	if version.AuditStatus == 1 {
+		c.JSON(http.StatusConflict, gin.H{"code": 409, "msg": "该版本已审核通过，不能覆盖"})
+		return
+	}
+
+	if err := markAPKArrived(version, req.SHA256, req.Size); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "更新上传状态失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "ok"})
+}
+
+func markAPKArrived(version models.AppVersion, sha256 string, size int64) error {
+	inspection := map[string]interface{}{
+		"apk_inspect_time": 0,
+		"signing_cert":     "",
+		"signing_certs":    "",
+		"signing_subject":  "",
+		"signature_status": signatureUnchecked,
+		"upload_state":     uploadPendingAudit,
+		"download_size":    utils.FormatSizeUnits(size),
+	}
+	versionUpdates := map[string]interface{}{
+		"apk_sha256": strings.ToLower(sha256),
+		"apk_size":   size,
+	}
+	for key, value := range inspection {
+		versionUpdates[key] = value
+	}
+
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&version).Updates(versionUpdates).Error; err != nil {
+			return err
+		}
+		if version.IsCurrent == 1 {
+			return tx.Model(&models.App{}).Where("id = ?", version.AppID).Updates(inspection).Error
+		}
+		return nil
+	})
+}
+
+func uploadBinaryTimeout() time.Duration {
+	hours := viper.GetInt("upload.binary_timeout_hours")
+	if hours <= 0 {
+		hours = 24
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+func StartUploadExpiryJob() {
+	minutes := viper.GetInt("upload.expiry_check_minutes")
+	if minutes <= 0 {
+		minutes = 10
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(minutes) * time.Minute)
+		defer ticker.Stop()
+		for {
+			expireStaleUploads()
+			expireUploadSessions()
+			<-ticker.C
+		}
+	}()
+}
+
+func expireStaleUploads() {
+	deadline := time.Now().Add(-uploadBinaryTimeout()).UnixMilli()
+
+	var versions []models.AppVersion
+	if err := db.DB.Where("upload_state = ? AND upload_time < ?", uploadAwaitingBinary, deadline).Find(&versions).Error; err != nil {
+		fmt.Printf("Warning: failed to query stale uploads: %v\n", err)
+		return
+	}
+	for _, version := range versions {
+		expireUpload(version)
+	}
+}
+
+func expireUpload(version models.AppVersion) {
+	reason := "超时未上传APK，已自动过期"
+	result := db.DB.Model(&models.AppVersion{}).
+		Where("id = ? AND upload_state = ?", version.ID, uploadAwaitingBinary).
+		Updates(map[string]interface{}{
+			"upload_state": uploadExpired,
+			"audit_status": 2,
+			"audit_reason": reason,
+		})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return
+	}
+	if version.IsCurrent != 1 {
+		return
+	}
+
+	var app models.App
+	if err := db.DB.First(&app, version.AppID).Error; err != nil {
+		return
+	}
+	media := liveMediaPaths(app)
+	if err := db.DB.Model(&app).Updates(map[string]interface{}{
+		"upload_state":         uploadExpired,
+		"audit_status":         2,
+		"audit_reason":         reason,
+		"app_icon":             "",
+		"local_icon_path":      "",
+		"app_previews":         "[]",
+		"app_icon_variants":    nil,
+		"app_preview_variants": nil,
+	}).Error; err != nil {
+		fmt.Printf("Warning: failed to expire app %d: %v\n", app.ID, err)
+		return
+	}
+	releaseAppMedia(app.ID, media)
+
+	notice := models.Notice{
+		ByUserID:     app.ByUserID,
+		SenderUserID: -1,
+		Title:        "应用上传已过期",
+		Content:      fmt.Sprintf("您提交的「%s」在 %d 小时内未完成APK上传，已自动过期并清理图标和截图，请重新提交。", app.AppName, int(uploadBinaryTimeout().Hours())),
+		Time:         time.Now().UnixMilli(),
+		Actions:      "[]",
+	}
+	db.DB.Create(&notice)
+}
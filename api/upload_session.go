@@ -0,0 +1,484 @@
+package api
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"market-api/db"
+	"market-api/middleware"
+	"market-api/models"
+	"market-api/utils"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+)
+
+const (
+	tusVersion         = "1.0.0"
+	resumableUploadURL = "/api/v1/uploads"
+)
+
+const (
+	sessionUploading  = 0
+	sessionComplete   = 1
+	sessionExpired    = 2
+	sessionTerminated = 3
+)
+
+const statusChecksumMismatch = 460
+
+var uploadSessionLocks sync.Map
+
+func uploadSessionDir() string {
+	if dir := viper.GetString("upload.session_path"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "market-uploads")
+}
+
+func uploadSessionFile(id string) string {
+	return filepath.Join(uploadSessionDir(), id+".part")
+}
+
+func uploadSessionTTL() time.Duration {
+	hours := viper.GetInt("upload.session_expire_hours")
+	if hours <= 0 {
+		hours = 24
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+func maxAPKSize() int64 {
+	mb := viper.GetInt64("upload.max_apk_mb")
+	if mb <= 0 {
+		mb = 2048
+	}
+	return mb << 20
+}
+
+func lockUploadSession(id string) func() {
+	value, _ := uploadSessionLocks.LoadOrStore(id, &sync.Mutex{})
+	lock := value.(*sync.Mutex)
+	lock.Lock()
+	return lock.Unlock
+}
+
+func parseTusMetadata(header string) map[string]string {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 {
+			continue
+		}
+		value := ""
+		if len(fields) > 1 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				continue
+			}
+			value = string(decoded)
+		}
+		metadata[fields[0]] = value
+	}
+	return metadata
+}
+
+func parseUploadChecksum(header string) (hash.Hash, []byte, error) {
+	fields := strings.Fields(header)
+	if len(fields) != 2 {
+		return nil, nil, errors.New("invalid Upload-Checksum header")
+	}
+	expected, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, nil, errors.New("invalid Upload-Checksum value")
+	}
+	switch strings.ToLower(fields[0]) {
+	case "sha1":
+		return sha1.New(), expected, nil
+	case "md5":
+		return md5.New(), expected, nil
+	case "sha256":
+		return sha256.New(), expected, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported checksum algorithm %s", fields[0])
+}
+
+func setTusHeaders(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+}
+
+func setUploadSessionHeaders(c *gin.Context, session models.UploadSession) {
+	c.Header("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(session.Length, 10))
+	c.Header("Upload-Expires", time.UnixMilli(session.ExpireTime).UTC().Format(http.TimeFormat))
+	c.Header("Cache-Control", "no-store")
+}
+
+func checkTusVersion(c *gin.Context) bool {
+	if v := c.GetHeader("Tus-Resumable"); v != "" && v != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.JSON(http.StatusPreconditionFailed, gin.H{"code": 412, "msg": "不支持的 tus 协议版本: " + v})
+		return false
+	}
+	return true
+}
+
+func apkStoredLocally(path string) bool {
+	if !utils.FileServerConfigured() {
+		return true
+	}
+	var count int64
+	db.DB.Model(&models.UploadSession{}).Where("path = ? AND status = ?", path, sessionComplete).Count(&count)
+	return count > 0
+}
+
+func apkUploadToken(path string) (string, error) {
+	if !utils.FileServerConfigured() {
+		return "", nil
+	}
+	return utils.DefaultFileServer.UploadToken(path)
+}
+
+func UploadSessionOptions(c *gin.Context) {
+	setTusHeaders(c)
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", "creation,expiration,checksum,termination")
+	c.Header("Tus-Max-Size", strconv.FormatInt(maxAPKSize(), 10))
+	c.Header("Tus-Checksum-Algorithm", "sha1,md5,sha256")
+	c.Status(http.StatusNoContent)
+}
+
+func CreateUploadSession(c *gin.Context) {
+	setTusHeaders(c)
+	if !checkTusVersion(c) {
+		return
+	}
+
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "Upload-Length 无效"})
+		return
+	}
+	if length > maxAPKSize() {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"code": 413, "msg": fmt.Sprintf("文件大小超过上限 %d MB", maxAPKSize()>>20)})
+		return
+	}
+
+	metadata := parseTusMetadata(c.GetHeader("Upload-Metadata"))
+	versionID, _ := strconv.Atoi(metadata["version_id"])
+	checksum := strings.ToLower(metadata["sha256"])
+	if checksum != "" {
+		if _, err := hex.DecodeString(checksum); err != nil || len(checksum) != 64 {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "sha256 元数据格式错误"})
+			return
+		}
+	}
+
+	var version models.AppVersion
+	if err := db.DB.First(&version, versionID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "版本不存在，请在 Upload-Metadata 中提供 version_id"})
+		return
+	}
+	var app models.App
+	if err := db.DB.First(&app, version.AppID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "应用不存在"})
+		return
+	}
+
+	currentUser := c.MustGet("user").(models.User)
+	if app.ByUserID != currentUser.ID && !middleware.HasPermission(c, "app.edit_any") {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权操作此应用"})
+		return
+	}
+	if version.UploadState == uploadExpired {
+		c.JSON(http.StatusGone, gin.H{"code": 410, "msg": "该上传已超时过期"})
+		return
+	}
+	if version.AuditStatus == 1 {
+		c.JSON(http.StatusConflict, gin.H{"code": 409, "msg": "该版本已审核通过，不能覆盖"})
+		return
+	}
+
+	var stale []models.UploadSession
+	db.DB.Where("version_id = ? AND status = ?", version.ID, sessionUploading).Find(&stale)
+	for _, session := range stale {
+		closeUploadSession(session, sessionTerminated)
+	}
+
+	if err := os.MkdirAll(uploadSessionDir(), os.ModePerm); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "创建上传目录失败: " + err.Error()})
+		return
+	}
+
+	rawMetadata, _ := json.Marshal(metadata)
+	now := time.Now()
+	session := models.UploadSession{
+		ID:         uuid.New().String(),
+		AppID:      app.ID,
+		VersionID:  version.ID,
+		ByUserID:   currentUser.ID,
+		Path:       version.ApkPath,
+		Length:     length,
+		SHA256:     checksum,
+		Metadata:   string(rawMetadata),
+		Status:     sessionUploading,
+		CreateTime: now.UnixMilli(),
+		UpdateTime: now.UnixMilli(),
+		ExpireTime: now.Add(uploadSessionTTL()).UnixMilli(),
+	}
+
+	f, err := os.Create(uploadSessionFile(session.ID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "创建上传文件失败: " + err.Error()})
+		return
+	}
+	f.Close()
+
+	if err := db.DB.Create(&session).Error; err != nil {
+		os.Remove(uploadSessionFile(session.ID))
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "创建上传会话失败: " + err.Error()})
+		return
+	}
+
+	location := strings.TrimSuffix(c.Request.URL.Path, "/") + "/" + session.ID
+	c.Header("Location", location)
+	setUploadSessionHeaders(c, session)
+	c.JSON(http.StatusCreated, gin.H{
+		"code": 200,
+		"msg":  "上传会话已创建",
+		"data": gin.H{"id": session.ID, "location": location, "expire_time": session.ExpireTime},
+	})
+}
+
+func loadUploadSession(c *gin.Context) (models.UploadSession, bool) {
+	var session models.UploadSession
+	if err := db.DB.Where("id = ?", c.Param("id")).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "上传会话不存在"})
+		return session, false
+	}
+
+	currentUser := c.MustGet("user").(models.User)
+	if session.ByUserID != currentUser.ID && !middleware.HasPermission(c, "app.edit_any") {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权访问此上传会话"})
+		return session, false
+	}
+
+	switch session.Status {
+	case sessionExpired:
+		c.JSON(http.StatusGone, gin.H{"code": 410, "msg": "上传会话已过期"})
+		return session, false
+	case sessionTerminated:
+		c.JSON(http.StatusGone, gin.H{"code": 410, "msg": "上传会话已终止"})
+		return session, false
+	}
+	return session, true
+}
+
+func GetUploadSession(c *gin.Context) {
+	setTusHeaders(c)
+	session, ok := loadUploadSession(c)
+	if !ok {
+		return
+	}
+	setUploadSessionHeaders(c, session)
+	if c.Request.Method == http.MethodHead {
+		c.Status(http.StatusOK)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 200, "data": session})
+}
+
+func PatchUploadSession(c *gin.Context) {
+	setTusHeaders(c)
+	if !checkTusVersion(c) {
+		return
+	}
+	if c.ContentType() != "application/offset+octet-stream" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"code": 415, "msg": "Content-Type 必须为 application/offset+octet-stream"})
+		return
+	}
+
+	unlock := lockUploadSession(c.Param("id"))
+	defer unlock()
+
+	session, ok := loadUploadSession(c)
+	if !ok {
+		return
+	}
+	if session.Status == sessionComplete {
+		setUploadSessionHeaders(c, session)
+		c.JSON(http.StatusConflict, gin.H{"code": 409, "msg": "该上传已完成"})
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset != session.Offset {
+		setUploadSessionHeaders(c, session)
+		c.JSON(http.StatusConflict, gin.H{"code": 409, "msg": fmt.Sprintf("Upload-Offset 不匹配，当前偏移量为 %d", session.Offset)})
+		return
+	}
+
+	var hasher hash.Hash
+	var expected []byte
+	if header := c.GetHeader("Upload-Checksum"); header != "" {
+		if hasher, expected, err = parseUploadChecksum(header); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": err.Error()})
+			return
+		}
+	}
+
+	f, err := os.OpenFile(uploadSessionFile(session.ID), os.O_WRONLY, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "打开上传文件失败: " + err.Error()})
+		return
+	}
+	defer f.Close()
+	if err := f.Truncate(session.Offset); err == nil {
+		_, err = f.Seek(session.Offset, io.SeekStart)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "定位上传文件失败: " + err.Error()})
+		return
+	}
+
+	var dst io.Writer = f
+	if hasher != nil {
+		dst = io.MultiWriter(f, hasher)
+	}
+	written, copyErr := io.Copy(dst, io.LimitReader(c.Request.Body, session.Length-session.Offset))
+	if hasher != nil && (copyErr != nil || !bytes.Equal(hasher.Sum(nil), expected)) {
+		f.Truncate(session.Offset)
+		if copyErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "读取分片失败: " + copyErr.Error()})
+			return
+		}
+		setUploadSessionHeaders(c, session)
+		c.JSON(statusChecksumMismatch, gin.H{"code": statusChecksumMismatch, "msg": "分片校验和不匹配"})
+		return
+	}
+
+	now := time.Now()
+	session.Offset += written
+	session.UpdateTime = now.UnixMilli()
+	session.ExpireTime = now.Add(uploadSessionTTL()).UnixMilli()
+	if err := db.DB.Model(&session).Updates(map[string]interface{}{
+		"upload_offset": session.Offset,
+		"update_time":   session.UpdateTime,
+		"expire_time":   session.ExpireTime,
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "更新上传进度失败: " + err.Error()})
+		return
+	}
+
+	if session.Offset == session.Length {
+		f.Close()
+		if status, err := finishUploadSession(&session); err != nil {
+			setUploadSessionHeaders(c, session)
+			c.JSON(status, gin.H{"code": status, "msg": err.Error()})
+			return
+		}
+	}
+
+	setUploadSessionHeaders(c, session)
+	c.Status(http.StatusNoContent)
+}
+
+func finishUploadSession(session *models.UploadSession) (int, error) {
+	tmpPath := uploadSessionFile(session.ID)
+	sum, err := utils.FileSHA256(tmpPath)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("计算文件校验值失败: %v", err)
+	}
+	if session.SHA256 != "" && sum != session.SHA256 {
+		closeUploadSession(*session, sessionTerminated)
+		return statusChecksumMismatch, errors.New("文件 SHA-256 与声明不一致，请重新上传")
+	}
+
+	var version models.AppVersion
+	if err := db.DB.First(&version, session.VersionID).Error; err != nil {
+		closeUploadSession(*session, sessionTerminated)
+		return http.StatusNotFound, errors.New("版本不存在")
+	}
+	if version.UploadState == uploadExpired {
+		closeUploadSession(*session, sessionExpired)
+		return http.StatusGone, errors.New("该上传已超时过期")
+	}
+	if version.AuditStatus == 1 {
+		closeUploadSession(*session, sessionTerminated)
+		return http.StatusConflict, errors.New("该版本已审核通过，不能覆盖")
+	}
+
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("打开上传文件失败: %v", err)
+	}
+	err = utils.DefaultStorage.Put(session.Path, f, session.Length, "application/vnd.android.package-archive")
+	f.Close()
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("保存APK失败: %v", err)
+	}
+
+	if err := markAPKArrived(version, sum, session.Length); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("更新上传状态失败: %v", err)
+	}
+	session.Status = sessionComplete
+	closeUploadSession(*session, sessionComplete)
+	return http.StatusNoContent, nil
+}
+
+func closeUploadSession(session models.UploadSession, status int) {
+	db.DB.Model(&session).Updates(map[string]interface{}{"status": status, "update_time": time.Now().UnixMilli()})
+	if err := os.Remove(uploadSessionFile(session.ID)); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Warning: failed to remove upload session file %s: %v\n", session.ID, err)
+	}
+	uploadSessionLocks.Delete(session.ID)
+}
+
+func DeleteUploadSession(c *gin.Context) {
+	setTusHeaders(c)
+	unlock := lockUploadSession(c.Param("id"))
+	defer unlock()
+
+	session, ok := loadUploadSession(c)
+	if !ok {
+		return
+	}
+	if session.Status == sessionComplete {
+		c.JSON(http.StatusConflict, gin.H{"code": 409, "msg": "该上传已完成，不能终止"})
+		return
+	}
+	closeUploadSession(session, sessionTerminated)
+	c.Status(http.StatusNoContent)
+}
+
+func expireUploadSessions() {
+	var sessions []models.UploadSession
+	if err := db.DB.Where("status = ? AND expire_time < ?", sessionUploading, time.Now().UnixMilli()).Find(&sessions).Error; err != nil {
+		fmt.Printf("Warning: failed to query expired upload sessions: %v\n", err)
+		return
+	}
+	for _, session := range sessions {
+		unlock := lockUploadSession(session.ID)
+		var current models.UploadSession
+		if db.DB.Where("id = ? AND status = ? AND expire_time < ?", session.ID, sessionUploading, time.Now().UnixMilli()).First(&current).Error == nil {
+			closeUploadSession(current, sessionExpired)
+		}
+		unlock()
+	}
+}
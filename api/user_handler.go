@@ -3,14 +3,17 @@ package api
 import (
 	"fmt"
 	"market-api/db"
+	"market-api/middleware"
 	"market-api/models"
 	"market-api/utils"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/viper"
+	"gorm.io/gorm"
 )
 
 type LoginRequest struct {
@@ -25,19 +28,26 @@ func Login(c *gin.Context) {
 		return
 	}
 
+	if !checkLoginAllowed(c, req.Username) {
+		return
+	}
+
 	var user models.User
 	if err := db.DB.Where("username = ?", req.Username).First(&user).Error; err != nil {
+		recordLoginFailure(c, req.Username)
 		c.JSON(http.StatusUnauthorized, gin.H{"code": 403, "msg": "用户名或密码错误"})
 		return
 	}
 
-	if utils.MD5(req.Password) != user.Password {
+	passwordOK, needsRehash := utils.VerifyPassword(req.Password, user.Password)
+	if !passwordOK {
+		recordLoginFailure(c, req.Username)
 		c.JSON(http.StatusUnauthorized, gin.H{"code": 403, "msg": "用户名或密码错误"})
 		return
 	}
 
 	if user.VerifyEmail != 1 {
-		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "账号未验证，请先前往客户端验证账号后再试。"})
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "账号未验证，请先验证绑定的邮箱后再试。", "data": gin.H{"need_verify_email": true}})
 		return
 	}
 
@@ -46,28 +56,65 @@ func Login(c *gin.Context) {
 		return
 	}
 
+	if needsRehash {
+		if newHash, err := utils.HashPassword(req.Password); err != nil {
+			fmt.Printf("Warning: failed to rehash password for user %d: %v\n", user.ID, err)
+		} else if err := db.DB.Model(&user).Update("password", newHash).Error; err != nil {
+			fmt.Printf("Warning: failed to save rehashed password for user %d: %v\n", user.ID, err)
+		}
+	}
+
+	if user.TotpEnabled == 1 {
+		challengeToken, err := utils.GenerateChallengeToken(&user)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "生成验证凭证失败"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"code": 200,
+			"msg":  "请输入两步验证码",
+			"data": gin.H{
+				"need_2fa":        true,
+				"challenge_token": challengeToken,
+			},
+		})
+		return
+	}
+
+	completeLogin(c, user)
+}
+
+func completeLogin(c *gin.Context, user models.User) {
+	clearLoginFailures(user.Username)
+
+	now := time.Now()
 	loginToken := models.UserToken{
 		LoginDevice:  "网页端后台",
 		LoginVersion: 0,
 		LoginIP:      c.ClientIP(),
-		CreateTime:   time.Now().UnixMilli(),
-		ExpireTime:   time.Now().Add(time.Duration(viper.GetInt("jwt.expire_hours")) * time.Hour).UnixMilli(),
+		CreateTime:   now.UnixMilli(),
 		ByUserID:     user.ID,
 		Status:       1,
+		UserAgent:    c.Request.UserAgent(),
+		LastUsedTime: now.UnixMilli(),
+		LastUsedIP:   c.ClientIP(),
 	}
-	if err := db.DB.Create(&loginToken).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "创建登录记录失败"})
-		return
-	}
+	loginToken.ExpireTime = sessionExpireTime(loginToken, now)
 
-	tokenString, err := utils.GenerateToken(&user, loginToken.ID)
+	var tokenString, refreshToken string
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&loginToken).Error; err != nil {
+			return err
+		}
+		var err error
+		tokenString, refreshToken, err = issueSessionTokens(tx, &user, &loginToken)
+		return err
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "生成Token失败"})
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "创建登录记录失败"})
 		return
 	}
 
-	db.DB.Model(&loginToken).Update("token", tokenString)
-
 	db.DB.Model(&user).Updates(models.User{
 		LastLoginIP:     c.ClientIP(),
 		LastLoginDevice: "网页端后台",
@@ -101,8 +148,11 @@ func Login(c *gin.Context) {
 		"code": 200,
 		"msg":  "登录成功",
 		"data": gin.H{
-			"token": tokenString,
-			"user":  user,
+			"token":          tokenString,
+			"refresh_token":  refreshToken,
+			"expires_in":     accessTokenExpiresIn(),
+			"user":           user,
+			"need_2fa_setup": user.TotpEnabled != 1 && middleware.TwoFactorRequired(user),
 		},
 	})
 }
@@ -133,11 +183,23 @@ func UpdateUser(c *gin.Context) {
 		return
 	}
 
-	if currentUser.UserPermission <= targetUser.UserPermission {
+	currentLevel := middleware.CurrentAccess(c).Level
+	if currentLevel <= middleware.UserLevel(targetUser) {
 		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权修改该用户的信息"})
 		return
 	}
 
+	if reqUser.UserPermission >= currentLevel {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权授予不低于自身的权限等级"})
+		return
+	}
+
+	if reqUser.UserPermission != targetUser.UserPermission {
+		db.DB.Where("user_id = ?", targetUser.ID).Delete(&models.UserRole{})
+	}
+
+	before := targetUser
+
 	updates := map[string]interface{}{
 		"display_name":    reqUser.DisplayName,
 		"user_describe":   reqUser.UserDescribe,
@@ -154,6 +216,7 @@ func UpdateUser(c *gin.Context) {
 
 	var updatedUser models.User
 	db.DB.First(&updatedUser, id)
+	recordAudit(c, "user.update", "user", id, before, updatedUser)
 
 	c.JSON(http.StatusOK, gin.H{
 		"code": 200,
@@ -178,12 +241,18 @@ func ChangePassword(c *gin.Context) {
 
 	currentUser := c.MustGet("user").(models.User)
 
-	if utils.MD5(req.OldPassword) != currentUser.Password {
+	if ok, _ := utils.VerifyPassword(req.OldPassword, currentUser.Password); !ok {
 		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": "旧密码不正确"})
 		return
 	}
 
-	if err := db.DB.Model(&currentUser).Update("password", utils.MD5(req.NewPassword)).Error; err != nil {
+	newHash, err := utils.HashPassword(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "修改密码失败"})
+		return
+	}
+
+	if err := db.DB.Model(&currentUser).Update("password", newHash).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "修改密码失败"})
 		return
 	}
@@ -197,10 +266,34 @@ func GetSelfInfo(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"code": 200, "data": user})
 }
 
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
 func Logout(c *gin.Context) {
-	tokenID, exists := c.Get("token_id")
-	if exists {
-		db.DB.Model(&models.UserToken{}).Where("id = ?", tokenID).Update("status", 0)
+	var req LogoutRequest
+	c.ShouldBindJSON(&req)
+
+	tokenID := 0
+	if req.RefreshToken != "" {
+		var record models.UserRefreshToken
+		if err := db.DB.Where("token_hash = ?", utils.HashOpaqueToken(req.RefreshToken)).First(&record).Error; err == nil {
+			tokenID = record.TokenID
+		}
+	}
+	if tokenID == 0 {
+		parts := strings.SplitN(c.GetHeader("Authorization"), " ", 2)
+		if len(parts) == 2 && parts[0] == "Bearer" {
+			if claims, err := utils.ParseToken(parts[1]); err == nil && claims.Purpose == "" {
+				tokenID, _ = strconv.Atoi(claims.ID)
+			}
+		}
+	}
+
+	if tokenID != 0 {
+		db.DB.Transaction(func(tx *gorm.DB) error {
+			return revokeTokenFamily(tx, tokenID)
+		})
 	}
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "登出成功"})
 }
@@ -262,7 +355,13 @@ func CreateUser(c *gin.Context) {
 		return
 	}
 
-	newUser.Password = utils.MD5("123456")
+	defaultPassword, err := utils.HashPassword("123456")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "创建用户失败: " + err.Error()})
+		return
+	}
+
+	newUser.Password = defaultPassword
 	newUser.JoinTime = time.Now().UnixMilli()
 	newUser.UserAvatar = viper.GetString("user.default_avatar_url")
 	newUser.VerifyEmail = 1
@@ -273,6 +372,8 @@ func CreateUser(c *gin.Context) {
 		return
 	}
 
+	recordAudit(c, "user.create", "user", newUser.ID, nil, newUser)
+
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "创建成功，默认密码为 123456", "data": newUser})
 }
 
@@ -291,7 +392,7 @@ func DeleteUser(c *gin.Context) {
 		return
 	}
 
-	if currentUser.UserPermission <= targetUser.UserPermission {
+	if middleware.CurrentAccess(c).Level <= middleware.UserLevel(targetUser) {
 		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权删除该用户"})
 		return
 	}
@@ -301,6 +402,8 @@ func DeleteUser(c *gin.Context) {
 		return
 	}
 
+	recordAudit(c, "user.delete", "user", id, targetUser, nil)
+
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "删除成功"})
 }
 
@@ -324,11 +427,12 @@ func BanUser(c *gin.Context) {
 	}
 
 	currentUser := c.MustGet("user").(models.User)
-	if currentUser.UserPermission <= targetUser.UserPermission {
+	if middleware.CurrentAccess(c).Level <= middleware.UserLevel(targetUser) {
 		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权封禁该用户"})
 		return
 	}
 
+	before := targetUser
 	banTime := time.Now().Add(time.Duration(req.Hours) * time.Hour).UnixMilli()
 	updates := map[string]interface{}{
 		"ban_time":           banTime,
@@ -352,6 +456,9 @@ func BanUser(c *gin.Context) {
 	}
 	db.DB.Create(&notice)
 
+	recordAudit(c, "user.ban", "user", targetUser.ID,
+		gin.H{"ban_time": before.BanTime, "user_status_reason": before.UserStatusReason}, updates)
+
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "封禁成功"})
 }
 
@@ -364,12 +471,14 @@ func UnbanUser(c *gin.Context) {
 	}
 
 	currentUser := c.MustGet("user").(models.User)
-	if currentUser.UserPermission <= targetUser.UserPermission {
+	if middleware.CurrentAccess(c).Level <= middleware.UserLevel(targetUser) {
 		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权解封该用户"})
 		return
 	}
 
-	if err := db.DB.Model(&targetUser).Update("ban_time", time.Now().UnixMilli()).Error; err != nil {
+	previousBanTime := targetUser.BanTime
+	unbanTime := time.Now().UnixMilli()
+	if err := db.DB.Model(&targetUser).Update("ban_time", unbanTime).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "解封失败: " + err.Error()})
 		return
 	}
@@ -386,6 +495,8 @@ func UnbanUser(c *gin.Context) {
 	}
 	db.DB.Create(&notice)
 
+	recordAudit(c, "user.unban", "user", targetUser.ID, gin.H{"ban_time": previousBanTime}, gin.H{"ban_time": unbanTime})
+
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "解封成功"})
 }
 
@@ -397,18 +508,23 @@ func ResetPassword(c *gin.Context) {
 		return
 	}
 
-	currentUser := c.MustGet("user").(models.User)
-	if currentUser.UserPermission <= targetUser.UserPermission {
+	if middleware.CurrentAccess(c).Level <= middleware.UserLevel(targetUser) {
 		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权重置该用户密码"})
 		return
 	}
 
-	newPassword := "123456"
-	if err := db.DB.Model(&targetUser).Update("password", utils.MD5(newPassword)).Error; err != nil {
+	newPassword, err := utils.HashPassword("123456")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "重置密码失败: " + err.Error()})
+		return
+	}
+	if err := db.DB.Model(&targetUser).Update("password", newPassword).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "重置密码失败: " + err.Error()})
 		return
 	}
 
+	recordAudit(c, "user.reset_password", "user", targetUser.ID, nil, nil)
+
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "密码已重置为 123456"})
 }
 
@@ -428,16 +544,22 @@ func KickUserToken(c *gin.Context) {
 	}
 
 	currentUser := c.MustGet("user").(models.User)
-	if currentUser.UserPermission < 2 && currentUser.ID != token.ByUserID {
+	if currentUser.ID != token.ByUserID && !middleware.HasPermission(c, "user.sessions") {
 		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权操作"})
 		return
 	}
 
-	if err := db.DB.Model(&token).Update("status", 0).Error; err != nil {
+	if err := db.DB.Transaction(func(tx *gorm.DB) error {
+		return revokeTokenFamily(tx, token.ID)
+	}); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "操作失败: " + err.Error()})
 		return
 	}
 
+	if currentUser.ID != token.ByUserID {
+		recordAudit(c, "user.kick_session", "user", token.ByUserID, gin.H{"token_id": token.ID, "status": token.Status}, gin.H{"token_id": token.ID, "status": 0})
+	}
+
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "操作成功"})
 }
 
@@ -504,18 +626,20 @@ func ResetAvatar(c *gin.Context) {
 		return
 	}
 
-	currentUser := c.MustGet("user").(models.User)
-	if currentUser.UserPermission < 3 {
+	if !middleware.HasPermission(c, "user.reset_avatar") {
 		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "无权操作"})
 		return
 	}
 
+	previousAvatar := targetUser.UserAvatar
 	defaultAvatar := viper.GetString("user.default_avatar_url")
 	if err := db.DB.Model(&targetUser).Update("user_avatar", defaultAvatar).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "重置头像失败: " + err.Error()})
 		return
 	}
 
+	recordAudit(c, "user.reset_avatar", "user", targetUser.ID, gin.H{"user_avatar": previousAvatar}, gin.H{"user_avatar": defaultAvatar})
+
 	c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "头像已重置为默认"})
 }
 
@@ -44,9 +44,17 @@ func Init() {
 	sqlDB.SetMaxOpenConns(100)
 	sqlDB.SetConnMaxLifetime(time.Hour)
 
+	if DB.Migrator().HasTable(&models.AppDownloadEvent{}) && !DB.Migrator().HasColumn(&models.AppDownloadEvent{}, "bucket") {
+		if err := DB.Migrator().DropTable(&models.AppDownloadEvent{}); err != nil {
+			log.Fatalf("Failed to reset download events: %v", err)
+		}
+	}
+
 	err = DB.AutoMigrate(
 		&models.User{},
 		&models.UserToken{},
+		&models.UserRefreshToken{},
+		&models.UserEmailToken{},
 		&models.Notice{},
 		&models.App{},
 		&models.AppReply{},
@@ -65,6 +73,19 @@ func Init() {
 		&models.Report{},
 		&models.Setting{},
 		&models.AppPage{},
+		&models.LoginFailure{},
+		&models.JWTKey{},
+		&models.Role{},
+		&models.UserRole{},
+		&models.AuditLog{},
+		&models.AppSigningKey{},
+		&models.AppVersion{},
+		&models.AppRevision{},
+		&models.MediaRef{},
+		&models.UploadSession{},
+		&models.AppDownloadStat{},
+		&models.AppDownloadEvent{},
+		&models.AppDownloadCheck{},
 	)
 	if err != nil {
 		log.Fatalf("Failed to auto migrate database: %v", err)
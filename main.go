@@ -1,11 +1,14 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"market-api/api"
 	"market-api/db"
 	"market-api/middleware"
+	"market-api/utils"
+	"os"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -14,6 +17,10 @@ import (
 )
 
 func main() {
+	gcMedia := flag.Bool("gc-media", false, "scan storage for orphaned media, then exit")
+	dryRun := flag.Bool("dry-run", false, "with -gc-media, only report orphans without deleting them")
+	flag.Parse()
+
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
 	viper.AddConfigPath("./config")
@@ -24,20 +31,65 @@ func main() {
 
 	db.Init()
 
+	if err := utils.InitStorage(); err != nil {
+		log.Fatalf("Failed to init storage: %v", err)
+	}
+	utils.InitFileServer()
+
+	if *gcMedia {
+		report, err := api.RunMediaGC(*dryRun)
+		if err != nil {
+			log.Fatalf("Media gc failed: %v", err)
+		}
+		for _, orphan := range report.Orphans {
+			status := "kept"
+			if orphan.Deleted {
+				status = "deleted"
+			}
+			fmt.Printf("%s\t%d\t%s\t%s\t%s\n", status, orphan.Size, orphan.ModTime.Format(time.RFC3339), orphan.Key, orphan.Reason)
+		}
+		fmt.Println(report.Summary())
+		os.Exit(0)
+	}
+
+	if err := middleware.InitJWTKeys(); err != nil {
+		log.Fatalf("Failed to load jwt signing keys: %v", err)
+	}
+
+	if err := middleware.InitRoles(); err != nil {
+		log.Fatalf("Failed to load roles: %v", err)
+	}
+
+	if err := api.InitAppVersions(); err != nil {
+		log.Fatalf("Failed to migrate app versions: %v", err)
+	}
+
+	api.StartUploadExpiryJob()
+	api.StartMediaGCJob()
+	api.StartDownloadEventCleanupJob()
+	api.StartDownloadCheckJob()
+
+	if err := middleware.ReloadBannedIPs(); err != nil {
+		log.Printf("Failed to load banned ip list: %v", err)
+	}
+
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.Default()
 	r.SetTrustedProxies([]string{"127.0.0.1"})
 
 	config := cors.DefaultConfig()
 	config.AllowOrigins = []string{"http://localhost:5173", "http://127.0.0.1:5173"}
-	config.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
-	config.AllowHeaders = []string{"Origin", "Content-Type", "Authorization", "Accept"}
+	config.AllowMethods = []string{"GET", "POST", "PUT", "PATCH", "HEAD", "DELETE", "OPTIONS"}
+	config.AllowHeaders = []string{"Origin", "Content-Type", "Authorization", "Accept",
+		"Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata", "Upload-Checksum"}
+	config.ExposeHeaders = []string{"Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size",
+		"Tus-Checksum-Algorithm", "Upload-Offset", "Upload-Length", "Upload-Expires"}
 	config.AllowCredentials = true
 	config.MaxAge = 12 * time.Hour
 	r.Use(cors.New(config))
 
 	staticPath := viper.GetString("storage.base_path")
-	if staticPath != "" {
+	if staticPath != "" && (viper.GetString("storage.driver") == "" || viper.GetString("storage.driver") == "local") {
 		r.Static("/"+staticPath, "./"+staticPath)
 	}
 
@@ -51,15 +103,27 @@ func main() {
 
 func setupRoutes(r *gin.Engine) {
 	v1 := r.Group("/api/v1")
+	v1.Use(middleware.IPBanMiddleware())
 	{
 		auth := v1.Group("/auth")
 		{
 			auth.POST("/login", api.Login)
+			auth.POST("/2fa", api.LoginTwoFactor)
+			auth.POST("/refresh", api.RefreshToken)
 			auth.POST("/logout", api.Logout)
+			auth.POST("/password/forgot", api.ForgotPassword)
+			auth.POST("/password/reset", api.ResetPasswordByEmail)
+			auth.POST("/verify-email/request", api.RequestEmailVerification)
+			auth.POST("/verify-email/confirm", api.ConfirmEmailVerification)
 		}
 
+		v1.POST("/file-server/callback", api.FileServerUploadCallback)
+		v1.OPTIONS("/uploads", api.UploadSessionOptions)
+		v1.GET("/download/:id", api.RedirectPrimaryAppDownload)
+		v1.GET("/download/:id/:download_id", api.RedirectAppDownload)
+
 		authed := v1.Group("/")
-		authed.Use(middleware.AuthMiddleware())
+		authed.Use(middleware.AuthMiddleware(), middleware.TwoFactorSetupMiddleware())
 		{
 			dashboardGroup := authed.Group("/dashboard")
 			{
@@ -76,31 +140,64 @@ func setupRoutes(r *gin.Engine) {
 				meGroup.PUT("/password", api.ChangePassword)
 				meGroup.GET("/reports", api.ListMyReports)
 				meGroup.GET("/comments", api.ListMyComments)
+				meGroup.GET("/download-stats", api.GetMyDownloadStats)
+				meGroup.GET("/permissions", api.GetMyPermissions)
+				meGroup.GET("/sessions", api.ListMySessions)
+				meGroup.DELETE("/sessions/:id", api.RevokeMySession)
+				meGroup.POST("/sessions/revoke-others", api.RevokeOtherSessions)
+				meGroup.GET("/2fa", api.GetTwoFactorStatus)
+				meGroup.POST("/2fa/setup", api.SetupTwoFactor)
+				meGroup.POST("/2fa/enable", api.EnableTwoFactor)
+				meGroup.POST("/2fa/disable", api.DisableTwoFactor)
+				meGroup.POST("/2fa/recovery-codes", api.RegenerateRecoveryCodes)
 			}
 
 			userGroup := authed.Group("/users")
 			{
-				userGroup.GET("", middleware.PermissionMiddleware(2), api.ListUsers)
-				userGroup.POST("", middleware.PermissionMiddleware(3), api.CreateUser)
-				userGroup.GET("/:id", middleware.PermissionMiddleware(2), api.GetUserByID)
-				userGroup.PUT("/:id", middleware.PermissionMiddleware(3), api.UpdateUser)
-				userGroup.DELETE("/:id", middleware.PermissionMiddleware(3), api.DeleteUser)
-				userGroup.GET("/:id/tokens", middleware.PermissionMiddleware(2), api.ListUserTokens)
-				userGroup.POST("/:id/ban", middleware.PermissionMiddleware(1), api.BanUser)
-				userGroup.POST("/:id/unban", middleware.PermissionMiddleware(1), api.UnbanUser)
-				userGroup.POST("/:id/reset-password", middleware.PermissionMiddleware(3), api.ResetPassword)
-				userGroup.POST("/:id/reset-avatar", middleware.PermissionMiddleware(3), api.ResetAvatar)
+				userGroup.GET("", middleware.RequirePermission("user.view"), api.ListUsers)
+				userGroup.POST("", middleware.RequirePermission("user.create"), api.CreateUser)
+				userGroup.GET("/:id", middleware.RequirePermission("user.view"), api.GetUserByID)
+				userGroup.PUT("/:id", middleware.RequirePermission("user.edit"), api.UpdateUser)
+				userGroup.DELETE("/:id", middleware.RequirePermission("user.delete"), api.DeleteUser)
+				userGroup.GET("/:id/tokens", middleware.RequirePermission("user.sessions"), api.ListUserTokens)
+				userGroup.GET("/:id/download-stats", middleware.RequirePermission("app.view_all"), api.GetUserDownloadStats)
+				userGroup.GET("/:id/login-lock", middleware.RequirePermission("user.login_lock"), api.GetUserLoginLock)
+				userGroup.DELETE("/:id/login-lock", middleware.RequirePermission("user.login_lock"), api.ClearUserLoginLock)
+				userGroup.POST("/:id/ban", middleware.RequirePermission("user.ban"), api.BanUser)
+				userGroup.POST("/:id/unban", middleware.RequirePermission("user.ban"), api.UnbanUser)
+				userGroup.POST("/:id/reset-password", middleware.RequirePermission("user.reset_password"), api.ResetPassword)
+				userGroup.POST("/:id/reset-avatar", middleware.RequirePermission("user.reset_avatar"), api.ResetAvatar)
+				userGroup.POST("/:id/reset-2fa", middleware.RequirePermission("user.reset_2fa"), api.ResetUserTwoFactor)
+				userGroup.GET("/:id/roles", middleware.RequirePermission("role.manage"), api.GetUserRoles)
+				userGroup.PUT("/:id/roles", middleware.RequirePermission("role.manage"), api.SetUserRoles)
 			}
 
 			authed.DELETE("/tokens/:id", api.KickUserToken)
 
+			uploadGroup := authed.Group("/uploads")
+			{
+				uploadGroup.POST("", api.CreateUploadSession)
+				uploadGroup.HEAD("/:id", api.GetUploadSession)
+				uploadGroup.GET("/:id", api.GetUploadSession)
+				uploadGroup.PATCH("/:id", api.PatchUploadSession)
+				uploadGroup.DELETE("/:id", api.DeleteUploadSession)
+			}
+
 			appGroup := authed.Group("/apps")
 			{
 				appGroup.GET("", api.ListApps)
 				appGroup.GET("/simple-list", api.ListAllSimpleApps)
 				appGroup.GET("/:id", api.GetApp)
 				appGroup.POST("/pre-upload", api.PreUploadApp)
+				appGroup.POST("/:id/upload-complete", api.CompleteAppUpload)
+				appGroup.GET("/:id/download-stats", api.GetAppDownloadStats)
+				appGroup.GET("/:id/versions", api.ListAppVersions)
+				appGroup.POST("/:id/versions", api.CreateAppVersion)
+				appGroup.POST("/:id/versions/:version_id/upload-complete", api.CompleteAppVersionUpload)
+				appGroup.POST("/:id/versions/:version_id/audit", middleware.RequirePermission("app.audit"), api.AuditAppVersion)
+				appGroup.POST("/:id/versions/:version_id/rollback", middleware.RequirePermission("app.rollback"), api.RollbackAppVersion)
 				appGroup.PUT("/:id", api.UpdateApp)
+				appGroup.GET("/:id/revision", api.GetAppRevision)
 				appGroup.DELETE("/:id", api.DeleteApp)
 
 				appGroup.GET("/tags", api.GetAppTags)
@@ -109,16 +206,18 @@ func setupRoutes(r *gin.Engine) {
 
 				appGroup.GET("/:id/downloads", api.ListAppDownloads)
 				appGroup.POST("/:id/downloads", api.AddAppDownload)
+				appGroup.PUT("/:id/downloads/order", api.ReorderAppDownloads)
+				appGroup.PUT("/downloads/:download_id", api.UpdateAppDownload)
 				appGroup.DELETE("/downloads/:download_id", api.DeleteAppDownload)
+				appGroup.POST("/downloads/:download_id/check", api.CheckAppDownloadNow)
+				appGroup.GET("/downloads/:download_id/checks", api.ListAppDownloadChecks)
 
-				adminAppGroup := appGroup.Group("/")
-				adminAppGroup.Use(middleware.PermissionMiddleware(1))
-				{
-					adminAppGroup.POST("/:id/audit", api.AuditApp)
-					adminAppGroup.GET("/:id/download-test-url", api.GetAppDownloadTestURL)
-					adminAppGroup.POST("/downloads/:download_id/audit", api.AuditAppDownload)
-					adminAppGroup.GET("/downloads-to-audit", api.ListDownloadsToAudit)
-				}
+				appGroup.POST("/:id/audit", middleware.RequirePermission("app.audit"), api.AuditApp)
+				appGroup.GET("/signing-keys", middleware.RequirePermission("app.audit"), api.ListAppSigningKeys)
+				appGroup.POST("/:id/signing-rotation", middleware.RequirePermission("app.signing_override"), api.ConfirmAppSigningRotation)
+				appGroup.GET("/:id/download-test-url", middleware.RequirePermission("app.download.audit"), api.GetAppDownloadTestURL)
+				appGroup.POST("/downloads/:download_id/audit", middleware.RequirePermission("app.download.audit"), api.AuditAppDownload)
+				appGroup.GET("/downloads-to-audit", middleware.RequirePermission("app.download.audit"), api.ListDownloadsToAudit)
 			}
 
 			noticeGroup := authed.Group("/notices")
@@ -128,46 +227,78 @@ func setupRoutes(r *gin.Engine) {
 			}
 
 			operateGroup := authed.Group("/operate")
-			operateGroup.Use(middleware.PermissionMiddleware(2))
 			{
-				operateGroup.POST("/notice", api.SendNotice)
-				operateGroup.POST("/popup", api.SendPopup)
-				operateGroup.POST("/actions", api.SendActions)
-				operateGroup.POST("/email", api.SendEmailToUsers)
+				operateGroup.POST("/notice", middleware.RequirePermission("operate.notice"), api.SendNotice)
+				operateGroup.POST("/popup", middleware.RequirePermission("operate.popup"), api.SendPopup)
+				operateGroup.POST("/actions", middleware.RequirePermission("operate.actions"), api.SendActions)
+				operateGroup.POST("/email", middleware.RequirePermission("operate.email"), api.SendEmailToUsers)
 			}
 
 			adminGroup := authed.Group("/admin")
-			adminGroup.Use(middleware.PermissionMiddleware(2))
 			{
-				adminGroup.GET("/banners", api.ListBanners)
-				adminGroup.POST("/banners", api.CreateBanner)
-				adminGroup.PUT("/banners/:id", api.UpdateBanner)
-				adminGroup.DELETE("/banners/:id", api.DeleteBanner)
+				adminGroup.GET("/banners", middleware.RequirePermission("banner.manage"), api.ListBanners)
+				adminGroup.POST("/banners", middleware.RequirePermission("banner.manage"), api.CreateBanner)
+				adminGroup.PUT("/banners/:id", middleware.RequirePermission("banner.manage"), api.UpdateBanner)
+				adminGroup.DELETE("/banners/:id", middleware.RequirePermission("banner.manage"), api.DeleteBanner)
+
+				adminGroup.GET("/banned-ips", middleware.RequirePermission("ip_ban.manage"), api.ListBannedIPs)
+				adminGroup.POST("/banned-ips", middleware.RequirePermission("ip_ban.manage"), api.CreateBannedIP)
+				adminGroup.DELETE("/banned-ips/:id", middleware.RequirePermission("ip_ban.manage"), api.DeleteBannedIP)
 
-				adminGroup.GET("/banned-ips", api.ListBannedIPs)
-				adminGroup.POST("/banned-ips", api.CreateBannedIP)
-				adminGroup.DELETE("/banned-ips/:id", api.DeleteBannedIP)
+				adminGroup.GET("/prohibited-words", middleware.RequirePermission("prohibited_word.manage"), api.ListProhibitedWords)
+				adminGroup.POST("/prohibited-words", middleware.RequirePermission("prohibited_word.manage"), api.CreateProhibitedWord)
+				adminGroup.DELETE("/prohibited-words/:id", middleware.RequirePermission("prohibited_word.manage"), api.DeleteProhibitedWord)
 
-				adminGroup.GET("/prohibited-words", api.ListProhibitedWords)
-				adminGroup.POST("/prohibited-words", api.CreateProhibitedWord)
-				adminGroup.DELETE("/prohibited-words/:id", api.DeleteProhibitedWord)
+				adminGroup.GET("/username-blacklists", middleware.RequirePermission("username_blacklist.manage"), api.ListUsernameBlacklists)
+				adminGroup.POST("/username-blacklists", middleware.RequirePermission("username_blacklist.manage"), api.CreateUsernameBlacklist)
+				adminGroup.DELETE("/username-blacklists/:id", middleware.RequirePermission("username_blacklist.manage"), api.DeleteUsernameBlacklist)
 
-				adminGroup.GET("/username-blacklists", api.ListUsernameBlacklists)
-				adminGroup.POST("/username-blacklists", api.CreateUsernameBlacklist)
-				adminGroup.DELETE("/username-blacklists/:id", api.DeleteUsernameBlacklist)
+				adminGroup.GET("/comments", middleware.RequirePermission("comment.manage"), api.ListComments)
+				adminGroup.PUT("/comments/:id", middleware.RequirePermission("comment.manage"), api.UpdateComment)
+				adminGroup.DELETE("/comments/:id", middleware.RequirePermission("comment.manage"), api.DeleteComment)
 
-				adminGroup.GET("/comments", api.ListComments)
-				adminGroup.PUT("/comments/:id", api.UpdateComment)
-				adminGroup.DELETE("/comments/:id", api.DeleteComment)
+				adminGroup.GET("/reports", middleware.RequirePermission("report.manage"), api.ListReports)
+				adminGroup.GET("/reports/:id", middleware.RequirePermission("report.manage"), api.GetReportDetails)
+				adminGroup.POST("/reports/:id/audit", middleware.RequirePermission("report.manage"), api.AuditReport)
 
-				adminGroup.GET("/reports", api.ListReports)
-				adminGroup.GET("/reports/:id", api.GetReportDetails)
-				adminGroup.POST("/reports/:id/audit", api.AuditReport)
+				adminGroup.GET("/jwt-keys", middleware.RequirePermission("security.keys"), api.ListJWTKeys)
+				adminGroup.POST("/jwt-keys", middleware.RequirePermission("security.keys"), api.CreateJWTKey)
+				adminGroup.POST("/jwt-keys/:id/activate", middleware.RequirePermission("security.keys"), api.ActivateJWTKey)
+				adminGroup.POST("/jwt-keys/:id/retire", middleware.RequirePermission("security.keys"), api.RetireJWTKey)
 
-				adminGroup.GET("/settings/:key", api.GetSetting)
-				adminGroup.PUT("/settings/:key", api.UpdateSetting)
+				adminGroup.GET("/permissions", middleware.RequirePermission("role.manage"), api.ListPermissions)
+				adminGroup.GET("/roles", middleware.RequirePermission("role.manage"), api.ListRoles)
+				adminGroup.POST("/roles", middleware.RequirePermission("role.manage"), api.CreateRole)
+				adminGroup.PUT("/roles/:id", middleware.RequirePermission("role.manage"), api.UpdateRole)
+				adminGroup.DELETE("/roles/:id", middleware.RequirePermission("role.manage"), api.DeleteRole)
+
+				adminGroup.GET("/audit-log", middleware.RequirePermission("audit_log.view"), api.ListAuditLogs)
+				adminGroup.GET("/audit-log/export", middleware.RequirePermission("audit_log.view"), api.ExportAuditLogs)
+
+				adminGroup.GET("/settings/:key", middleware.RequirePermission("settings.read"), api.GetSetting)
+				adminGroup.PUT("/settings/:key", middleware.RequirePermission("settings.write"), api.UpdateSetting)
+
+				taxonomyGroup := adminGroup.Group("")
+				taxonomyGroup.Use(middleware.RequirePermission("taxonomy.manage"))
+				{
+					taxonomyGroup.POST("/tags", api.CreateAppTag)
+					taxonomyGroup.PUT("/tags/order", api.ReorderAppTags)
+					taxonomyGroup.PUT("/tags/:id", api.UpdateAppTag)
+					taxonomyGroup.DELETE("/tags/:id", api.DeleteAppTag)
+
+					taxonomyGroup.POST("/app-types", api.CreateAppType)
+					taxonomyGroup.PUT("/app-types/order", api.ReorderAppTypes)
+					taxonomyGroup.PUT("/app-types/:id", api.UpdateAppType)
+					taxonomyGroup.DELETE("/app-types/:id", api.DeleteAppType)
+
+					taxonomyGroup.POST("/version-types", api.CreateAppVersionType)
+					taxonomyGroup.PUT("/version-types/order", api.ReorderAppVersionTypes)
+					taxonomyGroup.PUT("/version-types/:id", api.UpdateAppVersionType)
+					taxonomyGroup.DELETE("/version-types/:id", api.DeleteAppVersionType)
+				}
 
 				pageGroup := adminGroup.Group("/pages")
+				pageGroup.Use(middleware.RequirePermission("page.manage"))
 				{
 					pageGroup.GET("", api.ListAppPages)
 					pageGroup.POST("", api.CreateAppPage)
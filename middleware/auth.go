@@ -5,14 +5,20 @@ import (
 	"market-api/models"
 	"market-api/utils"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+const tokenLastUsedInterval = time.Minute
+
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		refreshJWTKeysIfStale()
+		refreshRolesIfStale()
+
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"code": 401, "msg": "请求未携带token，无权限访问"})
@@ -29,6 +35,13 @@ func AuthMiddleware() gin.HandlerFunc {
 
 		tokenString := parts[1]
 		claims, err := utils.ParseToken(tokenString)
+		if err != nil || claims.Purpose != "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"code": 401, "msg": "无效的Token"})
+			c.Abort()
+			return
+		}
+
+		tokenID, err := strconv.Atoi(claims.ID)
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"code": 401, "msg": "无效的Token"})
 			c.Abort()
@@ -36,7 +49,7 @@ func AuthMiddleware() gin.HandlerFunc {
 		}
 
 		var dbToken models.UserToken
-		if err := db.DB.Where("token = ? AND status = ? AND expire_time > ?", tokenString, 1, time.Now().UnixMilli()).First(&dbToken).Error; err != nil {
+		if err := db.DB.Where("id = ? AND status = ? AND expire_time > ?", tokenID, 1, time.Now().UnixMilli()).First(&dbToken).Error; err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"code": 401, "msg": "Token已失效或已在别处登录"})
 			c.Abort()
 			return
@@ -61,28 +74,47 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		now := time.Now().UnixMilli()
+		if now-dbToken.LastUsedTime > tokenLastUsedInterval.Milliseconds() || dbToken.LastUsedIP != c.ClientIP() {
+			db.DB.Model(&models.UserToken{}).Where("id = ?", dbToken.ID).Updates(map[string]interface{}{
+				"last_used_time": now,
+				"last_used_ip":   c.ClientIP(),
+			})
+		}
+
 		c.Set("user", user)
 		c.Set("token_id", dbToken.ID)
 		c.Next()
 	}
 }
 
-func PermissionMiddleware(requiredPermission int) gin.HandlerFunc {
+func TwoFactorRequired(user models.User) bool {
+	var setting models.Setting
+	if err := db.DB.Where("setting_key = ?", "2fa_required_permission").First(&setting).Error; err != nil {
+		return false
+	}
+	level, err := strconv.Atoi(strings.TrimSpace(setting.Value))
+	if err != nil || level < 0 {
+		return false
+	}
+	return UserLevel(user) >= level
+}
+
+func TwoFactorSetupMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		_user, exists := c.Get("user")
-		if !exists {
-			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "无法获取用户信息"})
-			c.Abort()
+		user := c.MustGet("user").(models.User)
+		if user.TotpEnabled == 1 || !TwoFactorRequired(user) {
+			c.Next()
 			return
 		}
 
-		user := _user.(models.User)
-		if user.UserPermission < requiredPermission {
-			c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "权限不足"})
-			c.Abort()
+		path := c.FullPath()
+		if path == "/api/v1/me" || strings.HasPrefix(path, "/api/v1/me/2fa") {
+			c.Next()
 			return
 		}
 
-		c.Next()
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "当前账号必须先绑定两步验证后才能继续操作", "data": gin.H{"need_2fa_setup": true}})
+		c.Abort()
 	}
 }
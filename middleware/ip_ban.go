@@ -0,0 +1,135 @@
+package middleware
+
+import (
+	"fmt"
+	"market-api/db"
+	"market-api/models"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const bannedIPRefreshInterval = time.Minute
+
+type bannedRange struct {
+	prefix     netip.Prefix
+	reason     string
+	expireTime int64
+}
+
+type bannedIPMatcher struct {
+	mu         sync.RWMutex
+	ranges     []bannedRange
+	loadedAt   time.Time
+	refreshing atomic.Bool
+}
+
+var bannedIPs = &bannedIPMatcher{}
+
+func ParseIPOrCIDR(value string) (netip.Prefix, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if prefix.Addr().Is4In6() {
+			bits := prefix.Bits() - 96
+			if bits < 0 {
+				return netip.Prefix{}, fmt.Errorf("invalid prefix length: %s", value)
+			}
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), bits)
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func ReloadBannedIPs() error {
+	var rows []models.BannedIP
+	if err := db.DB.Where("expire_time = 0 OR expire_time > ?", time.Now().UnixMilli()).Find(&rows).Error; err != nil {
+		return err
+	}
+
+	ranges := make([]bannedRange, 0, len(rows))
+	for _, row := range rows {
+		prefix, err := ParseIPOrCIDR(row.IP)
+		if err != nil {
+			fmt.Printf("Warning: skipping invalid banned ip entry %d (%s): %v\n", row.ID, row.IP, err)
+			continue
+		}
+		ranges = append(ranges, bannedRange{prefix: prefix, reason: row.Reason, expireTime: row.ExpireTime})
+	}
+
+	bannedIPs.mu.Lock()
+	bannedIPs.ranges = ranges
+	bannedIPs.loadedAt = time.Now()
+	bannedIPs.mu.Unlock()
+	return nil
+}
+
+func (m *bannedIPMatcher) refreshIfStale() {
+	m.mu.RLock()
+	stale := time.Since(m.loadedAt) > bannedIPRefreshInterval
+	m.mu.RUnlock()
+
+	if !stale || !m.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer m.refreshing.Store(false)
+		if err := ReloadBannedIPs(); err != nil {
+			fmt.Printf("Warning: failed to refresh banned ip list: %v\n", err)
+		}
+	}()
+}
+
+func (m *bannedIPMatcher) match(ip string) (bannedRange, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return bannedRange{}, false
+	}
+	addr = addr.Unmap()
+	now := time.Now().UnixMilli()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, r := range m.ranges {
+		if r.expireTime != 0 && r.expireTime <= now {
+			continue
+		}
+		if r.prefix.Contains(addr) {
+			return r, true
+		}
+	}
+	return bannedRange{}, false
+}
+
+func IPBanMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bannedIPs.refreshIfStale()
+
+		if r, banned := bannedIPs.match(c.ClientIP()); banned {
+			msg := "您的IP已被封禁"
+			if r.reason != "" {
+				msg = fmt.Sprintf("您的IP已被封禁，原因：%s", r.reason)
+			}
+			c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": msg, "data": gin.H{"expire_time": r.expireTime}})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"encoding/base64"
+	"fmt"
+	"market-api/db"
+	"market-api/models"
+	"market-api/utils"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const jwtKeyRefreshInterval = time.Minute
+
+var jwtKeys = struct {
+	mu         sync.RWMutex
+	loadedAt   time.Time
+	refreshing atomic.Bool
+}{}
+
+func InitJWTKeys() error {
+	var count int64
+	if err := db.DB.Model(&models.JWTKey{}).Count(&count).Error; err != nil {
+		return err
+	}
+
+	if count == 0 {
+		var secret string
+		if configSecret := viper.GetString("jwt.secret"); configSecret != "" {
+			secret = base64.StdEncoding.EncodeToString([]byte(configSecret))
+		} else {
+			generated, _, err := utils.GenerateJWTKeyMaterial("HS256")
+			if err != nil {
+				return err
+			}
+			secret = generated
+		}
+
+		legacy := models.JWTKey{
+			Kid:        utils.LegacyJWTKeyID,
+			Algorithm:  "HS256",
+			PrivateKey: secret,
+			Status:     1,
+			CreateTime: time.Now().UnixMilli(),
+			ActiveTime: time.Now().UnixMilli(),
+		}
+		if err := db.DB.Create(&legacy).Error; err != nil {
+			return err
+		}
+	}
+
+	return ReloadJWTKeys()
+}
+
+func ReloadJWTKeys() error {
+	var rows []models.JWTKey
+	if err := db.DB.Where("status <> ?", 0).Find(&rows).Error; err != nil {
+		return err
+	}
+	if err := utils.SetJWTKeys(rows); err != nil {
+		return err
+	}
+
+	jwtKeys.mu.Lock()
+	jwtKeys.loadedAt = time.Now()
+	jwtKeys.mu.Unlock()
+	return nil
+}
+
+func refreshJWTKeysIfStale() {
+	jwtKeys.mu.RLock()
+	stale := time.Since(jwtKeys.loadedAt) > jwtKeyRefreshInterval
+	jwtKeys.mu.RUnlock()
+
+	if !stale || !jwtKeys.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer jwtKeys.refreshing.Store(false)
+		if err := ReloadJWTKeys(); err != nil {
+			fmt.Printf("Warning: failed to refresh jwt keys: %v\n", err)
+		}
+	}()
+}
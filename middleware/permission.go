@@ -0,0 +1,349 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"market-api/db"
+	"market-api/models"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const roleRefreshInterval = time.Minute
+
+const seededPermissionsKey = "role_seeded_permissions"
+
+type PermissionInfo struct {
+	Key  string `json:"key"`
+	Name string `json:"name"`
+}
+
+var Permissions = []PermissionInfo{
+	{"user.view", "查看用户"},
+	{"user.create", "创建用户"},
+	{"user.edit", "编辑用户资料"},
+	{"user.delete", "删除用户"},
+	{"user.ban", "封禁/解封用户"},
+	{"user.sessions", "查看/踢出用户登录"},
+	{"user.reset_password", "重置用户密码"},
+	{"user.reset_avatar", "重置用户头像"},
+	{"user.reset_2fa", "重置用户两步验证"},
+	{"user.login_lock", "查看/解除登录锁定"},
+	{"role.manage", "管理角色与权限"},
+	{"app.view_all", "查看全部应用"},
+	{"app.audit", "审核应用"},
+	{"app.edit_any", "编辑任意应用"},
+	{"app.delete_any", "删除任意应用"},
+	{"app.download.audit", "审核/测试下载路线"},
+	{"app.signing_override", "确认应用签名轮换"},
+	{"app.rollback", "回滚应用版本"},
+	{"operate.notice", "发送通知"},
+	{"operate.popup", "发送弹窗"},
+	{"operate.actions", "发送云控"},
+	{"operate.email", "群发邮件"},
+	{"banner.manage", "管理头图"},
+	{"ip_ban.manage", "管理IP封禁"},
+	{"prohibited_word.manage", "管理违禁词"},
+	{"username_blacklist.manage", "管理用户名黑名单"},
+	{"comment.manage", "管理评论"},
+	{"report.manage", "处理举报"},
+	{"page.manage", "管理专题"},
+	{"taxonomy.manage", "管理应用标签与分类"},
+	{"settings.read", "读取系统设置"},
+	{"settings.write", "修改系统设置"},
+	{"security.keys", "管理签名密钥"},
+	{"audit_log.view", "查看操作审计日志"},
+}
+
+var auditorPermissions = []string{
+	"app.view_all", "app.audit", "app.download.audit", "user.ban",
+}
+
+var operatorPermissions = append(append([]string{}, auditorPermissions...),
+	"user.view", "user.sessions", "user.login_lock",
+	"operate.notice", "operate.popup", "operate.actions", "operate.email",
+	"banner.manage", "ip_ban.manage", "prohibited_word.manage", "username_blacklist.manage",
+	"comment.manage", "report.manage", "page.manage", "taxonomy.manage", "settings.read", "settings.write",
+)
+
+var defaultRoles = []struct {
+	Name        string
+	DisplayName string
+	Level       int
+	Permissions []string
+}{
+	{"user", "普通用户", 0, []string{}},
+	{"auditor", "审核员", 1, auditorPermissions},
+	{"operator", "运营", 2, operatorPermissions},
+	{"admin", "管理员", 3, []string{"*"}},
+}
+
+type cachedRole struct {
+	role        models.Role
+	permissions map[string]bool
+}
+
+var roles = struct {
+	mu         sync.RWMutex
+	byID       map[int]cachedRole
+	byLevel    map[int]int
+	loadedAt   time.Time
+	refreshing atomic.Bool
+}{byID: map[int]cachedRole{}, byLevel: map[int]int{}}
+
+type UserAccess struct {
+	Level       int             `json:"level"`
+	Roles       []models.Role   `json:"roles"`
+	Permissions map[string]bool `json:"permissions"`
+}
+
+func IsKnownPermission(key string) bool {
+	if key == "*" {
+		return true
+	}
+	for _, p := range Permissions {
+		if p.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func InitRoles() error {
+	var count int64
+	if err := db.DB.Model(&models.Role{}).Count(&count).Error; err != nil {
+		return err
+	}
+
+	if count == 0 {
+		err := db.DB.Transaction(func(tx *gorm.DB) error {
+			for _, def := range defaultRoles {
+				permissionsJSON, _ := json.Marshal(def.Permissions)
+				role := models.Role{
+					Name:        def.Name,
+					DisplayName: def.DisplayName,
+					Level:       def.Level,
+					Permissions: string(permissionsJSON),
+					BuiltIn:     1,
+				}
+				if err := tx.Create(&role).Error; err != nil {
+					return err
+				}
+				if def.Level == 0 {
+					continue
+				}
+
+				condition := "user_permission = ?"
+				if def.Level == 3 {
+					condition = "user_permission >= ?"
+				}
+				if err := tx.Exec(
+					"INSERT INTO market_user_role_list (user_id, role_id) SELECT id, ? FROM market_user_list WHERE "+condition,
+					role.ID, def.Level,
+				).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := grantNewDefaultPermissions(); err != nil {
+		return err
+	}
+	return ReloadRoles()
+}
+
+func grantNewDefaultPermissions() error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		seeded := map[string][]string{}
+		var setting models.Setting
+		if err := tx.Where("setting_key = ?", seededPermissionsKey).First(&setting).Error; err == nil {
+			if err := json.Unmarshal([]byte(setting.Value), &seeded); err != nil {
+				fmt.Printf("Warning: invalid %s setting: %v\n", seededPermissionsKey, err)
+			}
+		}
+
+		for _, def := range defaultRoles {
+			var role models.Role
+			if err := tx.Where("name = ? AND built_in = ?", def.Name, 1).First(&role).Error; err != nil {
+				continue
+			}
+			var current []string
+			json.Unmarshal([]byte(role.Permissions), &current)
+			granted := map[string]bool{}
+			for _, key := range current {
+				granted[key] = true
+			}
+			previous := map[string]bool{}
+			for _, key := range seeded[def.Name] {
+				previous[key] = true
+			}
+
+			var added []string
+			for _, key := range def.Permissions {
+				if previous[key] || granted[key] || granted["*"] {
+					continue
+				}
+				current = append(current, key)
+				granted[key] = true
+				added = append(added, key)
+			}
+			seeded[def.Name] = def.Permissions
+			if len(added) == 0 {
+				continue
+			}
+
+			permissionsJSON, _ := json.Marshal(current)
+			if err := tx.Model(&role).Update("permissions", string(permissionsJSON)).Error; err != nil {
+				return err
+			}
+			fmt.Printf("Granted new default permissions %v to role %s\n", added, role.Name)
+		}
+
+		value, _ := json.Marshal(seeded)
+		return tx.Save(&models.Setting{Key: seededPermissionsKey, Value: string(value)}).Error
+	})
+}
+
+func ReloadRoles() error {
+	var rows []models.Role
+	if err := db.DB.Find(&rows).Error; err != nil {
+		return err
+	}
+
+	byID := make(map[int]cachedRole, len(rows))
+	byLevel := map[int]int{}
+	for _, row := range rows {
+		var keys []string
+		if err := json.Unmarshal([]byte(row.Permissions), &keys); err != nil {
+			fmt.Printf("Warning: invalid permissions on role %s: %v\n", row.Name, err)
+		}
+		set := make(map[string]bool, len(keys))
+		for _, key := range keys {
+			set[key] = true
+		}
+		byID[row.ID] = cachedRole{role: row, permissions: set}
+
+		if row.BuiltIn == 1 {
+			if existing, ok := byLevel[row.Level]; !ok || row.ID < existing {
+				byLevel[row.Level] = row.ID
+			}
+		}
+	}
+
+	roles.mu.Lock()
+	roles.byID = byID
+	roles.byLevel = byLevel
+	roles.loadedAt = time.Now()
+	roles.mu.Unlock()
+	return nil
+}
+
+func refreshRolesIfStale() {
+	roles.mu.RLock()
+	stale := time.Since(roles.loadedAt) > roleRefreshInterval
+	roles.mu.RUnlock()
+
+	if !stale || !roles.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer roles.refreshing.Store(false)
+		if err := ReloadRoles(); err != nil {
+			fmt.Printf("Warning: failed to refresh roles: %v\n", err)
+		}
+	}()
+}
+
+func defaultRoleIDForPermission(userPermission int) (int, bool) {
+	level := userPermission
+	if level < 0 {
+		level = 0
+	}
+	if level > 3 {
+		level = 3
+	}
+	roleID, ok := roles.byLevel[level]
+	return roleID, ok
+}
+
+func LoadUserAccess(user models.User) UserAccess {
+	var roleIDs []int
+	db.DB.Model(&models.UserRole{}).Where("user_id = ?", user.ID).Pluck("role_id", &roleIDs)
+
+	roles.mu.RLock()
+	defer roles.mu.RUnlock()
+
+	if len(roleIDs) == 0 {
+		if roleID, ok := defaultRoleIDForPermission(user.UserPermission); ok {
+			roleIDs = []int{roleID}
+		}
+	}
+
+	access := UserAccess{Roles: []models.Role{}, Permissions: map[string]bool{}}
+	for _, roleID := range roleIDs {
+		cached, ok := roles.byID[roleID]
+		if !ok {
+			continue
+		}
+		access.Roles = append(access.Roles, cached.role)
+		if cached.role.Level > access.Level {
+			access.Level = cached.role.Level
+		}
+		for key := range cached.permissions {
+			if key == "*" {
+				for _, p := range Permissions {
+					access.Permissions[p.Key] = true
+				}
+				continue
+			}
+			access.Permissions[key] = true
+		}
+	}
+	return access
+}
+
+func UserLevel(user models.User) int {
+	return LoadUserAccess(user).Level
+}
+
+func CurrentAccess(c *gin.Context) UserAccess {
+	if access, ok := c.Get("access"); ok {
+		return access.(UserAccess)
+	}
+	user := c.MustGet("user").(models.User)
+	access := LoadUserAccess(user)
+	c.Set("access", access)
+	return access
+}
+
+func HasPermission(c *gin.Context, permission string) bool {
+	return CurrentAccess(c).Permissions[permission]
+}
+
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, exists := c.Get("user"); !exists {
+			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": "无法获取用户信息"})
+			c.Abort()
+			return
+		}
+
+		if !HasPermission(c, permission) {
+			c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": "权限不足"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -12,8 +12,11 @@ func (Banner) TableName() string {
 }
 
 type BannedIP struct {
-	ID int    `gorm:"primaryKey;column:id" json:"id"`
-	IP string `gorm:"type:text;column:ip" json:"ip"`
+	ID         int    `gorm:"primaryKey;column:id" json:"id"`
+	IP         string `gorm:"type:text;column:ip" json:"ip"`
+	Reason     string `gorm:"type:text;column:reason" json:"reason"`
+	ExpireTime int64  `gorm:"column:expire_time;default:0" json:"expire_time"`
+	CreateTime int64  `gorm:"column:create_time;default:0" json:"create_time"`
 }
 
 func (BannedIP) TableName() string {
@@ -67,3 +70,51 @@ type Setting struct {
 func (Setting) TableName() string {
 	return "market_settings"
 }
+
+type LoginFailure struct {
+	ID           int    `gorm:"primaryKey;column:id" json:"id"`
+	Scope        string `gorm:"type:varchar(16);column:scope;uniqueIndex:idx_login_failure_scope_key" json:"scope"`
+	Key          string `gorm:"type:varchar(191);column:failure_key;uniqueIndex:idx_login_failure_scope_key" json:"key"`
+	FailCount    int    `gorm:"column:fail_count" json:"fail_count"`
+	LastFailTime int64  `gorm:"column:last_fail_time" json:"last_fail_time"`
+	LockedUntil  int64  `gorm:"column:locked_until" json:"locked_until"`
+}
+
+func (LoginFailure) TableName() string {
+	return "market_login_failure_list"
+}
+
+type JWTKey struct {
+	ID          int    `gorm:"primaryKey;column:id" json:"id"`
+	Kid         string `gorm:"type:varchar(64);column:kid;uniqueIndex" json:"kid"`
+	Algorithm   string `gorm:"type:varchar(16);column:algorithm" json:"algorithm"`
+	PrivateKey  string `gorm:"type:text;column:private_key" json:"-"`
+	PublicKey   string `gorm:"type:text;column:public_key" json:"public_key"`
+	Status      int    `gorm:"column:status" json:"status"`
+	CreateTime  int64  `gorm:"column:create_time" json:"create_time"`
+	ActiveTime  int64  `gorm:"column:active_time" json:"active_time"`
+	RetireAfter int64  `gorm:"column:retire_after" json:"retire_after"`
+}
+
+func (JWTKey) TableName() string {
+	return "market_jwt_key_list"
+}
+
+type AuditLog struct {
+	ID         int    `gorm:"primaryKey;column:id" json:"id"`
+	ActorID    int    `gorm:"column:actor_id;index" json:"actor_id"`
+	ActorName  string `gorm:"type:text;column:actor_name" json:"actor_name"`
+	Action     string `gorm:"type:varchar(64);column:action;index" json:"action"`
+	TargetType string `gorm:"type:varchar(32);column:target_type;index:idx_audit_log_target" json:"target_type"`
+	TargetID   int    `gorm:"column:target_id;index:idx_audit_log_target" json:"target_id"`
+	Before     string `gorm:"type:text;column:before_data" json:"before"`
+	After      string `gorm:"type:text;column:after_data" json:"after"`
+	Changes    string `gorm:"type:text;column:changes" json:"changes"`
+	IP         string `gorm:"type:varchar(64);column:ip" json:"ip"`
+	UserAgent  string `gorm:"type:text;column:user_agent" json:"user_agent"`
+	CreateTime int64  `gorm:"column:create_time;index" json:"create_time"`
+}
+
+func (AuditLog) TableName() string {
+	return "market_admin_audit_log"
+}
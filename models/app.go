@@ -1,50 +1,111 @@
 package models
 
+import "encoding/json"
+
 type App struct {
-	ID                 int    `gorm:"primaryKey;column:id" json:"id"`
-	PackageName        string `gorm:"type:text;column:package_name" json:"package_name"`
-	AppName            string `gorm:"type:text;column:app_name" json:"app_name"`
-	Keyword            string `gorm:"type:text;column:keyword" json:"keyword"`
-	VersionCode        int    `gorm:"column:version_code" json:"version_code"`
-	VersionName        string `gorm:"type:text;column:version_name" json:"version_name"`
-	AppIcon            string `gorm:"type:text;column:app_icon" json:"app_icon"`
-	ByUserID           int    `gorm:"column:by_userid" json:"by_userid"`
-	AppTypeID          int    `gorm:"column:app_type" json:"app_type_id"`
-	AppVersionTypeID   int    `gorm:"column:app_version_type" json:"app_version_type_id"`
-	AppABI             int    `gorm:"column:app_abi" json:"app_abi"`
-	AppTags            string `gorm:"type:text;column:app_tags" json:"app_tags"`
-	AppPages           string `gorm:"type:text;column:app_pages" json:"app_pages"`
-	AppPreviews        string `gorm:"type:text;column:app_previews" json:"app_previews"`
-	AppDescribe        string `gorm:"type:text;column:app_describe" json:"app_describe"`
-	AppUpdateLog       string `gorm:"type:text;column:app_update_log" json:"app_update_log"`
-	AppDeveloper       string `gorm:"type:text;column:app_developer" json:"app_developer"`
-	AppSource          string `gorm:"type:text;column:app_source" json:"app_source"`
-	UploadMessage      string `gorm:"type:text;column:upload_message" json:"upload_message"`
-	AuditStatus        int    `gorm:"column:audit_status" json:"audit_status"`
-	AuditReason        string `gorm:"type:text;column:audit_reason" json:"audit_reason"`
-	AuditUser          int    `gorm:"column:audit_user" json:"audit_user"`
-	AppSdkMin          int    `gorm:"column:app_sdk_min" json:"app_sdk_min"`
-	AppSdkTarget       int    `gorm:"column:app_sdk_target" json:"app_sdk_target"`
-	AppIsWearOS        int    `gorm:"column:app_is_wearos" json:"app_is_wearos"`
-	DownloadSize       string `gorm:"type:text;column:download_size" json:"download_size"`
-	UploadTime         int64  `gorm:"column:upload_time" json:"upload_time"`
-	UpdateTime         int64  `gorm:"column:update_time" json:"update_time"`
-	LocalApkPath       string `gorm:"type:text;column:local_apk_path" json:"local_apk_path"`
-	LocalIconPath      string `gorm:"type:text;column:local_icon_path" json:"local_icon_path"`
-	AppWeight          int    `gorm:"column:app_weight" json:"app_weight"`
-	HasAppUpdateNotice int    `gorm:"column:has_app_update_notice" json:"has_app_update_notice"`
-	Uploader           User   `gorm:"foreignKey:ByUserID" json:"uploader"`
+	ID                 int             `gorm:"primaryKey;column:id" json:"id"`
+	PackageName        string          `gorm:"type:text;column:package_name" json:"package_name"`
+	AppName            string          `gorm:"type:text;column:app_name" json:"app_name"`
+	Keyword            string          `gorm:"type:text;column:keyword" json:"keyword"`
+	VersionCode        int             `gorm:"column:version_code" json:"version_code"`
+	VersionName        string          `gorm:"type:text;column:version_name" json:"version_name"`
+	AppIcon            string          `gorm:"type:text;column:app_icon" json:"app_icon"`
+	AppIconVariants    json.RawMessage `gorm:"type:text;column:app_icon_variants" json:"app_icon_variants"`
+	ByUserID           int             `gorm:"column:by_userid" json:"by_userid"`
+	AppTypeID          int             `gorm:"column:app_type" json:"app_type_id"`
+	AppVersionTypeID   int             `gorm:"column:app_version_type" json:"app_version_type_id"`
+	AppABI             int             `gorm:"column:app_abi" json:"app_abi"`
+	AppTags            string          `gorm:"type:text;column:app_tags" json:"app_tags"`
+	AppPages           string          `gorm:"type:text;column:app_pages" json:"app_pages"`
+	AppPreviews        string          `gorm:"type:text;column:app_previews" json:"app_previews"`
+	AppPreviewVariants json.RawMessage `gorm:"type:text;column:app_preview_variants" json:"app_preview_variants"`
+	AppDescribe        string          `gorm:"type:text;column:app_describe" json:"app_describe"`
+	AppUpdateLog       string          `gorm:"type:text;column:app_update_log" json:"app_update_log"`
+	AppDeveloper       string          `gorm:"type:text;column:app_developer" json:"app_developer"`
+	AppSource          string          `gorm:"type:text;column:app_source" json:"app_source"`
+	UploadMessage      string          `gorm:"type:text;column:upload_message" json:"upload_message"`
+	AuditStatus        int             `gorm:"column:audit_status" json:"audit_status"`
+	AuditReason        string          `gorm:"type:text;column:audit_reason" json:"audit_reason"`
+	AuditUser          int             `gorm:"column:audit_user" json:"audit_user"`
+	AppSdkMin          int             `gorm:"column:app_sdk_min" json:"app_sdk_min"`
+	AppSdkTarget       int             `gorm:"column:app_sdk_target" json:"app_sdk_target"`
+	AppIsWearOS        int             `gorm:"column:app_is_wearos" json:"app_is_wearos"`
+	DownloadSize       string          `gorm:"type:text;column:download_size" json:"download_size"`
+	UploadTime         int64           `gorm:"column:upload_time" json:"upload_time"`
+	UpdateTime         int64           `gorm:"column:update_time" json:"update_time"`
+	LocalApkPath       string          `gorm:"type:text;column:local_apk_path" json:"local_apk_path"`
+	LocalIconPath      string          `gorm:"type:text;column:local_icon_path" json:"local_icon_path"`
+	AppWeight          int             `gorm:"column:app_weight" json:"app_weight"`
+	HasAppUpdateNotice int             `gorm:"column:has_app_update_notice" json:"has_app_update_notice"`
+	ApkInspectTime     int64           `gorm:"column:apk_inspect_time;default:0" json:"apk_inspect_time"`
+	SigningCert        string          `gorm:"type:varchar(64);column:signing_cert" json:"signing_cert"`
+	SigningCerts       string          `gorm:"type:text;column:signing_certs" json:"signing_certs"`
+	SigningSubject     string          `gorm:"type:text;column:signing_subject" json:"signing_subject"`
+	SignatureStatus    int             `gorm:"column:signature_status;default:0" json:"signature_status"`
+	UploadState        string          `gorm:"type:varchar(32);column:upload_state;default:''" json:"upload_state"`
+	Uploader           User            `gorm:"foreignKey:ByUserID" json:"uploader"`
 }
 
 func (App) TableName() string {
 	return "market_app_list"
 }
 
+type AppVersion struct {
+	ID              int    `gorm:"primaryKey;column:id" json:"id"`
+	AppID           int    `gorm:"column:app_id;index" json:"app_id"`
+	VersionCode     int    `gorm:"column:version_code" json:"version_code"`
+	VersionName     string `gorm:"type:text;column:version_name" json:"version_name"`
+	UpdateLog       string `gorm:"type:text;column:update_log" json:"update_log"`
+	ApkPath         string `gorm:"type:text;column:apk_path" json:"apk_path"`
+	DownloadSize    string `gorm:"type:text;column:download_size" json:"download_size"`
+	AppSdkMin       int    `gorm:"column:app_sdk_min" json:"app_sdk_min"`
+	AppSdkTarget    int    `gorm:"column:app_sdk_target" json:"app_sdk_target"`
+	AppABI          int    `gorm:"column:app_abi" json:"app_abi"`
+	AppIsWearOS     int    `gorm:"column:app_is_wearos" json:"app_is_wearos"`
+	ApkInspectTime  int64  `gorm:"column:apk_inspect_time;default:0" json:"apk_inspect_time"`
+	SigningCert     string `gorm:"type:varchar(64);column:signing_cert" json:"signing_cert"`
+	SigningCerts    string `gorm:"type:text;column:signing_certs" json:"signing_certs"`
+	SigningSubject  string `gorm:"type:text;column:signing_subject" json:"signing_subject"`
+	SignatureStatus int    `gorm:"column:signature_status;default:0" json:"signature_status"`
+	UploadState     string `gorm:"type:varchar(32);column:upload_state;default:''" json:"upload_state"`
+	ApkSha256       string `gorm:"type:varchar(64);column:apk_sha256" json:"apk_sha256"`
+	ApkSize         int64  `gorm:"column:apk_size" json:"apk_size"`
+	AuditStatus     int    `gorm:"column:audit_status" json:"audit_status"`
+	AuditReason     string `gorm:"type:text;column:audit_reason" json:"audit_reason"`
+	AuditUser       int    `gorm:"column:audit_user" json:"audit_user"`
+	AuditTime       int64  `gorm:"column:audit_time" json:"audit_time"`
+	IsCurrent       int    `gorm:"column:is_current;default:0" json:"is_current"`
+	ByUserID        int    `gorm:"column:by_userid" json:"by_userid"`
+	UploadTime      int64  `gorm:"column:upload_time" json:"upload_time"`
+}
+
+func (AppVersion) TableName() string {
+	return "market_app_version_list"
+}
+
+type AppRevision struct {
+	ID          int    `gorm:"primaryKey;column:id" json:"id"`
+	AppID       int    `gorm:"column:app_id;index" json:"app_id"`
+	ByUserID    int    `gorm:"column:by_userid" json:"by_userid"`
+	Data        string `gorm:"type:longtext;column:data" json:"data"`
+	Status      int    `gorm:"column:status;default:0" json:"status"`
+	AuditUser   int    `gorm:"column:audit_user" json:"audit_user"`
+	AuditReason string `gorm:"type:text;column:audit_reason" json:"audit_reason"`
+	CreateTime  int64  `gorm:"column:create_time" json:"create_time"`
+	UpdateTime  int64  `gorm:"column:update_time" json:"update_time"`
+	AuditTime   int64  `gorm:"column:audit_time" json:"audit_time"`
+}
+
+func (AppRevision) TableName() string {
+	return "market_app_revision_list"
+}
+
 type AppTag struct {
 	ID               int    `gorm:"primaryKey;column:id" json:"id"`
 	Name             string `gorm:"type:text;column:name" json:"name"`
 	Icon             string `gorm:"type:text;column:icon" json:"icon"`
 	UploadPermission int    `gorm:"column:upload_permission" json:"upload_permission"`
+	SortOrder        int    `gorm:"column:sort_order;default:0" json:"sort_order"`
 }
 
 func (AppTag) TableName() string {
@@ -52,8 +113,9 @@ func (AppTag) TableName() string {
 }
 
 type AppType struct {
-	ID   int    `gorm:"primaryKey;column:id" json:"id"`
-	Name string `gorm:"type:text;column:name" json:"name"`
+	ID        int    `gorm:"primaryKey;column:id" json:"id"`
+	Name      string `gorm:"type:text;column:name" json:"name"`
+	SortOrder int    `gorm:"column:sort_order;default:0" json:"sort_order"`
 }
 
 func (AppType) TableName() string {
@@ -61,8 +123,9 @@ func (AppType) TableName() string {
 }
 
 type AppVersionType struct {
-	ID   int    `gorm:"primaryKey;column:id" json:"id"`
-	Name string `gorm:"type:text;column:name" json:"name"`
+	ID        int    `gorm:"primaryKey;column:id" json:"id"`
+	Name      string `gorm:"type:text;column:name" json:"name"`
+	SortOrder int    `gorm:"column:sort_order;default:0" json:"sort_order"`
 }
 
 func (AppVersionType) TableName() string {
@@ -76,6 +139,15 @@ type AppDownload struct {
 	URL         string `gorm:"type:text;column:url" json:"url"`
 	IsExtra     int    `gorm:"column:is_extra" json:"is_extra"`
 	AuditStatus int    `gorm:"column:audit_status" json:"audit_status"`
+	Health      int    `gorm:"column:health;default:0" json:"health"`
+	HealthMsg   string `gorm:"type:text;column:health_msg" json:"health_msg"`
+	FailCount   int    `gorm:"column:fail_count;default:0" json:"fail_count"`
+	CheckTime   int64  `gorm:"column:check_time" json:"check_time"`
+	SortOrder   int    `gorm:"column:sort_order;default:0" json:"sort_order"`
+	Weight      int    `gorm:"column:weight;default:1" json:"weight"`
+	Enabled     int    `gorm:"column:enabled;default:1" json:"enabled"`
+	Regions     string `gorm:"type:text;column:regions" json:"regions"`
+	ABIMask     int    `gorm:"column:abi_mask;default:0" json:"abi_mask"`
 	App         App    `gorm:"foreignKey:AppID" json:"app"`
 }
 
@@ -83,6 +155,23 @@ func (AppDownload) TableName() string {
 	return "market_app_download_list"
 }
 
+type AppDownloadCheck struct {
+	ID            int    `gorm:"primaryKey;column:id" json:"id"`
+	DownloadID    int    `gorm:"column:download_id;index" json:"download_id"`
+	AppID         int    `gorm:"column:app_id" json:"app_id"`
+	StatusCode    int    `gorm:"column:status_code" json:"status_code"`
+	ContentLength int64  `gorm:"column:content_length" json:"content_length"`
+	ContentType   string `gorm:"type:varchar(255);column:content_type" json:"content_type"`
+	LatencyMs     int64  `gorm:"column:latency_ms" json:"latency_ms"`
+	Health        int    `gorm:"column:health" json:"health"`
+	Message       string `gorm:"type:text;column:message" json:"message"`
+	Time          int64  `gorm:"column:time;index" json:"time"`
+}
+
+func (AppDownloadCheck) TableName() string {
+	return "market_app_download_check_list"
+}
+
 type Splash struct {
 	ID   int   `gorm:"primaryKey;column:id"`
 	Time int64 `gorm:"column:time"`
@@ -102,6 +191,32 @@ func (UserDownloadCount) TableName() string {
 	return "market_user_download_count_list"
 }
 
+type AppDownloadStat struct {
+	ID          int   `gorm:"primaryKey;column:id" json:"id"`
+	AppID       int   `gorm:"column:app_id;uniqueIndex:idx_app_download_stat_day" json:"app_id"`
+	DownloadID  int   `gorm:"column:download_id;uniqueIndex:idx_app_download_stat_day" json:"download_id"`
+	Day         int64 `gorm:"column:day;uniqueIndex:idx_app_download_stat_day;index" json:"day"`
+	DeveloperID int   `gorm:"column:developer_id;index" json:"developer_id"`
+	Count       int64 `gorm:"column:count" json:"count"`
+}
+
+func (AppDownloadStat) TableName() string {
+	return "market_app_download_stat_list"
+}
+
+type AppDownloadEvent struct {
+	ID         int    `gorm:"primaryKey;column:id" json:"id"`
+	AppID      int    `gorm:"column:app_id;uniqueIndex:idx_app_download_event_dedupe,priority:2" json:"app_id"`
+	DownloadID int    `gorm:"column:download_id;uniqueIndex:idx_app_download_event_dedupe,priority:3" json:"download_id"`
+	ClientHash string `gorm:"type:varchar(64);column:client_hash;uniqueIndex:idx_app_download_event_dedupe,priority:1" json:"client_hash"`
+	Bucket     int64  `gorm:"column:bucket;uniqueIndex:idx_app_download_event_dedupe,priority:4" json:"bucket"`
+	Time       int64  `gorm:"column:time;index" json:"time"`
+}
+
+func (AppDownloadEvent) TableName() string {
+	return "market_app_download_event_list"
+}
+
 type AppReply struct {
 	ID            int    `gorm:"primaryKey;column:id" json:"id"`
 	AppID         int    `gorm:"column:app_id" json:"app_id"`
@@ -135,4 +250,22 @@ type AppPage struct {
 
 func (AppPage) TableName() string {
 	return "market_app_page_list"
-}
\ No newline at end of file
+}
+
+type AppSigningKey struct {
+	ID          int    `gorm:"primaryKey;column:id" json:"id"`
+	PackageName string `gorm:"type:varchar(255);column:package_name;index" json:"package_name"`
+	Fingerprint string `gorm:"type:varchar(64);column:fingerprint" json:"fingerprint"`
+	Subject     string `gorm:"type:text;column:subject" json:"subject"`
+	Status      int    `gorm:"column:status" json:"status"`
+	Source      string `gorm:"type:varchar(32);column:source" json:"source"`
+	AppID       int    `gorm:"column:app_id" json:"app_id"`
+	ByUserID    int    `gorm:"column:by_userid" json:"by_userid"`
+	Reason      string `gorm:"type:text;column:reason" json:"reason"`
+	CreateTime  int64  `gorm:"column:create_time" json:"create_time"`
+	RevokeTime  int64  `gorm:"column:revoke_time" json:"revoke_time"`
+}
+
+func (AppSigningKey) TableName() string {
+	return "market_app_signing_key_list"
+}
@@ -0,0 +1,13 @@
+package models
+
+type MediaRef struct {
+	ID         int    `gorm:"primaryKey;column:id" json:"id"`
+	StorageKey string `gorm:"type:varchar(255);column:storage_key;uniqueIndex:idx_media_ref_owner" json:"storage_key"`
+	OwnerType  string `gorm:"type:varchar(32);column:owner_type;uniqueIndex:idx_media_ref_owner" json:"owner_type"`
+	OwnerID    int    `gorm:"column:owner_id;uniqueIndex:idx_media_ref_owner" json:"owner_id"`
+	CreateTime int64  `gorm:"column:create_time" json:"create_time"`
+}
+
+func (MediaRef) TableName() string {
+	return "market_media_ref_list"
+}
@@ -0,0 +1,25 @@
+package models
+
+type Role struct {
+	ID          int    `gorm:"primaryKey;column:id" json:"id"`
+	Name        string `gorm:"type:varchar(64);column:name;uniqueIndex" json:"name"`
+	DisplayName string `gorm:"type:text;column:display_name" json:"display_name"`
+	Description string `gorm:"type:text;column:description" json:"description"`
+	Level       int    `gorm:"column:level" json:"level"`
+	Permissions string `gorm:"type:text;column:permissions" json:"permissions"`
+	BuiltIn     int    `gorm:"column:built_in;default:0" json:"built_in"`
+}
+
+func (Role) TableName() string {
+	return "market_role_list"
+}
+
+type UserRole struct {
+	ID     int `gorm:"primaryKey;column:id" json:"id"`
+	UserID int `gorm:"column:user_id;index" json:"user_id"`
+	RoleID int `gorm:"column:role_id;index" json:"role_id"`
+}
+
+func (UserRole) TableName() string {
+	return "market_user_role_list"
+}
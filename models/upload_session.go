@@ -0,0 +1,21 @@
+package models
+
+type UploadSession struct {
+	ID         string `gorm:"primaryKey;type:varchar(36);column:id" json:"id"`
+	AppID      int    `gorm:"column:app_id;index" json:"app_id"`
+	VersionID  int    `gorm:"column:version_id;index" json:"version_id"`
+	ByUserID   int    `gorm:"column:by_userid" json:"by_userid"`
+	Path       string `gorm:"type:varchar(255);column:path;index" json:"path"`
+	Length     int64  `gorm:"column:length" json:"length"`
+	Offset     int64  `gorm:"column:upload_offset" json:"offset"`
+	SHA256     string `gorm:"type:varchar(64);column:sha256" json:"sha256"`
+	Metadata   string `gorm:"type:text;column:metadata" json:"metadata"`
+	Status     int    `gorm:"column:status;default:0" json:"status"`
+	CreateTime int64  `gorm:"column:create_time" json:"create_time"`
+	UpdateTime int64  `gorm:"column:update_time" json:"update_time"`
+	ExpireTime int64  `gorm:"column:expire_time;index" json:"expire_time"`
+}
+
+func (UploadSession) TableName() string {
+	return "market_upload_session_list"
+}
@@ -24,6 +24,10 @@ type User struct {
 	LastLoginVersion int    `gorm:"column:last_login_version" json:"last_login_version"`
 	LastOnlineTime   int64  `gorm:"column:last_online_time" json:"last_online_time"`
 	PubFavourite     int    `gorm:"column:pub_favourite" json:"pub_favourite"`
+	TotpEnabled      int    `gorm:"column:totp_enabled;default:0" json:"totp_enabled"`
+	TotpSecret       string `gorm:"type:text;column:totp_secret" json:"-"`
+	TotpLastStep     int64  `gorm:"column:totp_last_step;default:0" json:"-"`
+	TotpRecovery     string `gorm:"type:text;column:totp_recovery" json:"-"`
 }
 
 func (User) TableName() string {
@@ -41,12 +45,28 @@ type UserToken struct {
 	ExpireTime   int64  `gorm:"column:expire_time" json:"expire_time"`
 	ByUserID     int    `gorm:"column:by_userid" json:"by_userid"`
 	Status       int    `gorm:"column:status" json:"status"`
+	UserAgent    string `gorm:"type:text;column:user_agent" json:"user_agent"`
+	LastUsedTime int64  `gorm:"column:last_used_time;default:0" json:"last_used_time"`
+	LastUsedIP   string `gorm:"type:text;column:last_used_ip" json:"last_used_ip"`
 }
 
 func (UserToken) TableName() string {
 	return "market_user_token_list"
 }
 
+type UserRefreshToken struct {
+	ID         int    `gorm:"primaryKey;column:id" json:"id"`
+	TokenID    int    `gorm:"column:token_id;index" json:"token_id"`
+	TokenHash  string `gorm:"type:varchar(64);column:token_hash;uniqueIndex" json:"-"`
+	Status     int    `gorm:"column:status" json:"status"`
+	CreateTime int64  `gorm:"column:create_time" json:"create_time"`
+	ExpireTime int64  `gorm:"column:expire_time" json:"expire_time"`
+}
+
+func (UserRefreshToken) TableName() string {
+	return "market_user_refresh_token_list"
+}
+
 type Notice struct {
 	ID           int    `gorm:"primaryKey;column:id" json:"id"`
 	ByUserID     int    `gorm:"column:by_userid" json:"by_userid"`
@@ -62,3 +82,19 @@ type Notice struct {
 func (Notice) TableName() string {
 	return "market_notice_list"
 }
+
+type UserEmailToken struct {
+	ID         int    `gorm:"primaryKey;column:id" json:"id"`
+	ByUserID   int    `gorm:"column:by_userid;index" json:"by_userid"`
+	Purpose    string `gorm:"type:varchar(32);column:purpose" json:"purpose"`
+	Email      string `gorm:"type:text;column:email" json:"email"`
+	TokenHash  string `gorm:"type:varchar(64);column:token_hash;uniqueIndex" json:"-"`
+	CreateTime int64  `gorm:"column:create_time" json:"create_time"`
+	ExpireTime int64  `gorm:"column:expire_time" json:"expire_time"`
+	UsedTime   int64  `gorm:"column:used_time;default:0" json:"used_time"`
+	RequestIP  string `gorm:"type:text;column:request_ip" json:"request_ip"`
+}
+
+func (UserEmailToken) TableName() string {
+	return "market_user_email_token_list"
+}
@@ -0,0 +1,621 @@
+package utils
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	ABIArmeabi = 1 << iota
+	ABIArmeabiV7a
+	ABIArm64V8a
+	ABIX86
+	ABIX8664
+)
+
+var apkABIBits = map[string]int{
+	"armeabi":     ABIArmeabi,
+	"armeabi-v7a": ABIArmeabiV7a,
+	"arm64-v8a":   ABIArm64V8a,
+	"x86":         ABIX86,
+	"x86_64":      ABIX8664,
+}
+
+const (
+	axmlChunkStringPool   = 0x0001
+	axmlChunkTable        = 0x0002
+	axmlChunkXML          = 0x0003
+	axmlChunkStartElement = 0x0102
+	axmlChunkResourceMap  = 0x0180
+	arscChunkPackage      = 0x0200
+	arscChunkType         = 0x0201
+
+	resTypeReference = 0x01
+	resTypeString    = 0x03
+	resTypeIntDec    = 0x10
+	resTypeIntHex    = 0x11
+	resTypeIntBool   = 0x12
+
+	attrLabel         = 0x01010001
+	attrIcon          = 0x01010002
+	attrName          = 0x01010003
+	attrMinSdkVersion = 0x0101020c
+	attrVersionCode   = 0x0101021b
+	attrVersionName   = 0x0101021c
+	attrTargetSdk     = 0x01010270
+)
+
+const (
+	maxAPKManifestSize = 16 << 20
+	maxResolvedEntries = 256
+)
+
+var ErrInvalidAPK = errors.New("invalid apk")
+
+type APKInfo struct {
+	PackageName string   `json:"package_name"`
+	VersionCode int      `json:"version_code"`
+	VersionName string   `json:"version_name"`
+	MinSDK      int      `json:"min_sdk"`
+	TargetSDK   int      `json:"target_sdk"`
+	Label       string   `json:"label"`
+	IconPath    string   `json:"icon_path"`
+	ABIs        []string `json:"abis"`
+	ABIMask     int      `json:"abi_mask"`
+	IsWearOS    bool     `json:"is_wear_os"`
+	Size        int64    `json:"size"`
+}
+
+type resValue struct {
+	dataType uint8
+	data     uint32
+}
+
+type axmlAttr struct {
+	name  string
+	resID uint32
+	raw   string
+	value resValue
+}
+
+func ParseABIMask(list string) int {
+	mask := 0
+	for _, abi := range strings.Split(list, ",") {
+		mask |= apkABIBits[strings.TrimSpace(abi)]
+	}
+	return mask
+}
+
+func InspectAPK(path string) (*APKInfo, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAPK, err)
+	}
+	defer zr.Close()
+
+	info := &APKInfo{Size: stat.Size(), ABIs: []string{}}
+
+	var manifest, table []byte
+	abis := map[string]bool{}
+	for _, f := range zr.File {
+		switch {
+		case f.Name == "AndroidManifest.xml":
+			if manifest, err = readZipEntry(f); err != nil {
+				return nil, err
+			}
+		case f.Name == "resources.arsc":
+			if table, err = readZipEntry(f); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(f.Name, "lib/") && strings.HasSuffix(f.Name, ".so"):
+			parts := strings.Split(f.Name, "/")
+			if len(parts) == 3 && parts[1] != "" {
+				abis[parts[1]] = true
+			}
+		}
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("%w: AndroidManifest.xml not found", ErrInvalidAPK)
+	}
+
+	for abi := range abis {
+		info.ABIs = append(info.ABIs, abi)
+		info.ABIMask |= apkABIBits[abi]
+	}
+	sort.Strings(info.ABIs)
+
+	var labelRef, iconRef resValue
+	err = walkAXML(manifest, func(tag string, attrs []axmlAttr) {
+		switch tag {
+		case "manifest":
+			for _, a := range attrs {
+				switch {
+				case a.name == "package":
+					info.PackageName = a.raw
+				case a.resID == attrVersionCode || a.name == "versionCode":
+					info.VersionCode = int(a.value.data)
+				case a.resID == attrVersionName || a.name == "versionName":
+					info.VersionName = a.raw
+				}
+			}
+		case "uses-sdk":
+			for _, a := range attrs {
+				switch {
+				case a.resID == attrMinSdkVersion || a.name == "minSdkVersion":
+					info.MinSDK = sdkVersion(a)
+				case a.resID == attrTargetSdk || a.name == "targetSdkVersion":
+					info.TargetSDK = sdkVersion(a)
+				}
+			}
+		case "uses-feature":
+			for _, a := range attrs {
+				if (a.resID == attrName || a.name == "name") && a.raw == "android.hardware.type.watch" {
+					info.IsWearOS = true
+				}
+			}
+		case "application":
+			for _, a := range attrs {
+				switch {
+				case a.resID == attrLabel || a.name == "label":
+					if a.value.dataType == resTypeReference {
+						labelRef = a.value
+					} else {
+						info.Label = a.raw
+					}
+				case a.resID == attrIcon || a.name == "icon":
+					if a.value.dataType == resTypeReference {
+						iconRef = a.value
+					}
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if info.PackageName == "" {
+		return nil, fmt.Errorf("%w: manifest has no package name", ErrInvalidAPK)
+	}
+	if info.MinSDK == 0 {
+		info.MinSDK = 1
+	}
+	if info.TargetSDK == 0 {
+		info.TargetSDK = info.MinSDK
+	}
+
+	if table != nil {
+		res, err := parseResourceTable(table)
+		if err == nil {
+			if labelRef.dataType == resTypeReference {
+				info.Label = res.resolveString(labelRef.data)
+			}
+			if iconRef.dataType == resTypeReference {
+				info.IconPath = res.resolveIcon(iconRef.data)
+			}
+		}
+	}
+
+	return info, nil
+}
+
+func ReadAPKEntry(path, name string) ([]byte, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAPK, err)
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		if f.Name == name {
+			return readZipEntry(f)
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+func readZipEntry(f *zip.File) ([]byte, error) {
+	if f.UncompressedSize64 > maxAPKManifestSize {
+		return nil, fmt.Errorf("%w: %s too large", ErrInvalidAPK, f.Name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAPK, err)
+	}
+	defer rc.Close()
+	return io.ReadAll(io.LimitReader(rc, maxAPKManifestSize))
+}
+
+func sdkVersion(a axmlAttr) int {
+	switch a.value.dataType {
+	case resTypeIntDec, resTypeIntHex:
+		return int(a.value.data)
+	}
+	var v int
+	fmt.Sscanf(a.raw, "%d", &v)
+	return v
+}
+
+func readChunkHeader(b []byte, off int) (chunkType uint16, headerSize, size int, err error) {
+	if off < 0 || off+8 > len(b) {
+		return 0, 0, 0, fmt.Errorf("%w: truncated chunk", ErrInvalidAPK)
+	}
+	chunkType = binary.LittleEndian.Uint16(b[off:])
+	headerSize = int(binary.LittleEndian.Uint16(b[off+2:]))
+	size = int(binary.LittleEndian.Uint32(b[off+4:]))
+	if headerSize < 8 || headerSize > size || size > len(b)-off {
+		return 0, 0, 0, fmt.Errorf("%w: corrupt chunk header", ErrInvalidAPK)
+	}
+	return chunkType, headerSize, size, nil
+}
+
+func parseStringPool(b []byte) ([]string, error) {
+	if len(b) < 28 {
+		return nil, ErrInvalidAPK
+	}
+	headerSize := int(binary.LittleEndian.Uint16(b[2:]))
+	count := int(binary.LittleEndian.Uint32(b[8:]))
+	flags := binary.LittleEndian.Uint32(b[16:])
+	stringsStart := int(binary.LittleEndian.Uint32(b[20:]))
+	utf8 := flags&(1<<8) != 0
+
+	if headerSize < 28 || headerSize+count*4 > len(b) || stringsStart > len(b) {
+		return nil, ErrInvalidAPK
+	}
+
+	strs := make([]string, count)
+	for i := 0; i < count; i++ {
+		off := stringsStart + int(binary.LittleEndian.Uint32(b[headerSize+i*4:]))
+		if off >= len(b) {
+			return nil, ErrInvalidAPK
+		}
+		if utf8 {
+			_, n := decodeLength8(b[off:])
+			off += n
+			length, n := decodeLength8(b[off:])
+			off += n
+			if off+length > len(b) {
+				return nil, ErrInvalidAPK
+			}
+			strs[i] = string(b[off : off+length])
+		} else {
+			length, n := decodeLength16(b[off:])
+			off += n
+			if off+length*2 > len(b) {
+				return nil, ErrInvalidAPK
+			}
+			units := make([]uint16, length)
+			for j := range units {
+				units[j] = binary.LittleEndian.Uint16(b[off+j*2:])
+			}
+			strs[i] = string(utf16.Decode(units))
+		}
+	}
+	return strs, nil
+}
+
+func decodeLength8(b []byte) (int, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	if b[0]&0x80 != 0 && len(b) > 1 {
+		return int(b[0]&0x7f)<<8 | int(b[1]), 2
+	}
+	return int(b[0]), 1
+}
+
+func decodeLength16(b []byte) (int, int) {
+	if len(b) < 2 {
+		return 0, 0
+	}
+	v := int(binary.LittleEndian.Uint16(b))
+	if v&0x8000 != 0 && len(b) >= 4 {
+		return (v&0x7fff)<<16 | int(binary.LittleEndian.Uint16(b[2:])), 4
+	}
+	return v, 2
+}
+
+func poolString(pool []string, idx uint32) string {
+	if int(idx) < len(pool) && idx != 0xffffffff {
+		return pool[idx]
+	}
+	return ""
+}
+
+func walkAXML(b []byte, fn func(tag string, attrs []axmlAttr)) error {
+	if len(b) < 8 || binary.LittleEndian.Uint16(b) != axmlChunkXML {
+		return fmt.Errorf("%w: not a binary xml document", ErrInvalidAPK)
+	}
+
+	var pool []string
+	var resMap []uint32
+	_, off, _, err := readChunkHeader(b, 0)
+	if err != nil {
+		return err
+	}
+	for off+8 <= len(b) {
+		chunkType, headerSize, size, err := readChunkHeader(b, off)
+		if err != nil {
+			return err
+		}
+		chunk := b[off : off+size]
+
+		switch chunkType {
+		case axmlChunkStringPool:
+			if pool, err = parseStringPool(chunk); err != nil {
+				return err
+			}
+		case axmlChunkResourceMap:
+			resMap = make([]uint32, (size-headerSize)/4)
+			for i := range resMap {
+				resMap[i] = binary.LittleEndian.Uint32(chunk[headerSize+i*4:])
+			}
+		case axmlChunkStartElement:
+			if headerSize+20 > size {
+				return fmt.Errorf("%w: corrupt element", ErrInvalidAPK)
+			}
+			ext := chunk[headerSize:]
+			tag := poolString(pool, binary.LittleEndian.Uint32(ext[4:]))
+			attrStart := int(binary.LittleEndian.Uint16(ext[8:]))
+			attrSize := int(binary.LittleEndian.Uint16(ext[10:]))
+			attrCount := int(binary.LittleEndian.Uint16(ext[12:]))
+			if attrSize < 20 || attrStart+attrCount*attrSize > len(ext) {
+				return fmt.Errorf("%w: corrupt attributes", ErrInvalidAPK)
+			}
+
+			attrs := make([]axmlAttr, 0, attrCount)
+			for i := 0; i < attrCount; i++ {
+				a := ext[attrStart+i*attrSize:]
+				nameIdx := binary.LittleEndian.Uint32(a[4:])
+				attr := axmlAttr{
+					name: poolString(pool, nameIdx),
+					raw:  poolString(pool, binary.LittleEndian.Uint32(a[8:])),
+					value: resValue{
+						dataType: a[15],
+						data:     binary.LittleEndian.Uint32(a[16:]),
+					},
+				}
+				if int(nameIdx) < len(resMap) {
+					attr.resID = resMap[nameIdx]
+				}
+				if attr.raw == "" && attr.value.dataType == resTypeString {
+					attr.raw = poolString(pool, attr.value.data)
+				}
+				attrs = append(attrs, attr)
+			}
+			fn(tag, attrs)
+		}
+		off += size
+	}
+	return nil
+}
+
+type resEntry struct {
+	language string
+	density  uint16
+	value    resValue
+}
+
+type resourceTable struct {
+	strings []string
+	entries map[uint32][]resEntry
+}
+
+func parseResourceTable(b []byte) (*resourceTable, error) {
+	if len(b) < 12 || binary.LittleEndian.Uint16(b) != axmlChunkTable {
+		return nil, ErrInvalidAPK
+	}
+
+	t := &resourceTable{entries: map[uint32][]resEntry{}}
+	_, off, _, err := readChunkHeader(b, 0)
+	if err != nil {
+		return nil, err
+	}
+	for off+8 <= len(b) {
+		chunkType, _, size, err := readChunkHeader(b, off)
+		if err != nil {
+			return nil, err
+		}
+		chunk := b[off : off+size]
+
+		switch chunkType {
+		case axmlChunkStringPool:
+			if t.strings, err = parseStringPool(chunk); err != nil {
+				return nil, err
+			}
+		case arscChunkPackage:
+			if err := t.parsePackage(chunk); err != nil {
+				return nil, err
+			}
+		}
+		off += size
+	}
+	return t, nil
+}
+
+func (t *resourceTable) parsePackage(b []byte) error {
+	if len(b) < 12 {
+		return ErrInvalidAPK
+	}
+	_, headerSize, _, err := readChunkHeader(b, 0)
+	if err != nil {
+		return err
+	}
+	if headerSize < 12 {
+		return fmt.Errorf("%w: corrupt package header", ErrInvalidAPK)
+	}
+	pkgID := binary.LittleEndian.Uint32(b[8:])
+
+	off := headerSize
+	for off+8 <= len(b) {
+		chunkType, _, size, err := readChunkHeader(b, off)
+		if err != nil {
+			return err
+		}
+		if chunkType == arscChunkType {
+			if err := t.parseType(pkgID, b[off:off+size]); err != nil {
+				return err
+			}
+		}
+		off += size
+	}
+	return nil
+}
+
+func (t *resourceTable) parseType(pkgID uint32, b []byte) error {
+	if len(b) < 20 {
+		return fmt.Errorf("%w: truncated type chunk", ErrInvalidAPK)
+	}
+	headerSize := int(binary.LittleEndian.Uint16(b[2:]))
+	typeID := uint32(b[8])
+	flags := b[9]
+	entryCount := int(binary.LittleEndian.Uint32(b[12:]))
+	entriesStart := int(binary.LittleEndian.Uint32(b[16:]))
+	if headerSize < 20 || headerSize > len(b) || entriesStart > len(b) {
+		return fmt.Errorf("%w: corrupt type chunk", ErrInvalidAPK)
+	}
+
+	var language string
+	var density uint16
+	if config := b[20:headerSize]; len(config) >= 16 {
+		if config[8] != 0 {
+			language = string(config[8:10])
+		}
+		density = binary.LittleEndian.Uint16(config[14:])
+	}
+
+	const flagSparse, flagOffset16 = 0x01, 0x02
+	type indexed struct {
+		idx    int
+		offset int
+	}
+	var offsets []indexed
+	switch {
+	case flags&flagSparse != 0:
+		for i := 0; i < entryCount && headerSize+i*4+4 <= len(b); i++ {
+			p := b[headerSize+i*4:]
+			offsets = append(offsets, indexed{int(binary.LittleEndian.Uint16(p)), int(binary.LittleEndian.Uint16(p[2:])) * 4})
+		}
+	case flags&flagOffset16 != 0:
+		for i := 0; i < entryCount && headerSize+i*2+2 <= len(b); i++ {
+			if v := binary.LittleEndian.Uint16(b[headerSize+i*2:]); v != 0xffff {
+				offsets = append(offsets, indexed{i, int(v) * 4})
+			}
+		}
+	default:
+		for i := 0; i < entryCount && headerSize+i*4+4 <= len(b); i++ {
+			if v := binary.LittleEndian.Uint32(b[headerSize+i*4:]); v != 0xffffffff {
+				offsets = append(offsets, indexed{i, int(v)})
+			}
+		}
+	}
+
+	const flagComplex, flagCompact = 0x0001, 0x0008
+	for _, o := range offsets {
+		p := entriesStart + o.offset
+		if p+8 > len(b) {
+			continue
+		}
+		entryFlags := binary.LittleEndian.Uint16(b[p+2:])
+
+		var value resValue
+		switch {
+		case entryFlags&flagCompact != 0:
+			value = resValue{dataType: uint8(entryFlags >> 8), data: binary.LittleEndian.Uint32(b[p+4:])}
+		case entryFlags&flagComplex != 0:
+			continue
+		default:
+			entrySize := int(binary.LittleEndian.Uint16(b[p:]))
+			v := p + entrySize
+			if v+8 > len(b) {
+				continue
+			}
+			value = resValue{dataType: b[v+3], data: binary.LittleEndian.Uint32(b[v+4:])}
+		}
+
+		id := pkgID<<24 | typeID<<16 | uint32(o.idx)
+		t.entries[id] = append(t.entries[id], resEntry{language: language, density: density, value: value})
+	}
+	return nil
+}
+
+func (t *resourceTable) resolve(id uint32) []resEntry {
+	var out []resEntry
+	visited := map[uint32]bool{}
+	budget := maxResolvedEntries
+	var walk func(id uint32, language string, density uint16)
+	walk = func(id uint32, language string, density uint16) {
+		if visited[id] {
+			return
+		}
+		visited[id] = true
+		for _, e := range t.entries[id] {
+			if budget <= 0 {
+				return
+			}
+			budget--
+			if e.language == "" {
+				e.language = language
+			}
+			if e.density == 0 {
+				e.density = density
+			}
+			if e.value.dataType == resTypeReference {
+				walk(e.value.data, e.language, e.density)
+				continue
+			}
+			out = append(out, e)
+		}
+	}
+	walk(id, "", 0)
+	return out
+}
+
+func (t *resourceTable) resolveString(id uint32) string {
+	var fallback string
+	for _, e := range t.resolve(id) {
+		if e.value.dataType != resTypeString {
+			continue
+		}
+		s := poolString(t.strings, e.value.data)
+		if e.language == "" {
+			return s
+		}
+		if fallback == "" {
+			fallback = s
+		}
+	}
+	return fallback
+}
+
+func (t *resourceTable) resolveIcon(id uint32) string {
+	var best string
+	var bestDensity uint16
+	bestIsXML := true
+	for _, e := range t.resolve(id) {
+		if e.value.dataType != resTypeString {
+			continue
+		}
+		path := poolString(t.strings, e.value.data)
+		isXML := strings.HasSuffix(path, ".xml")
+		density := e.density
+		if density == 0xffff || density == 0xfffe {
+			density = 0
+		}
+		if best == "" || (bestIsXML && !isXML) || (bestIsXML == isXML && density > bestDensity) {
+			best, bestDensity, bestIsXML = path, density, isXML
+		}
+	}
+	return best
+}
@@ -0,0 +1,502 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+)
+
+const (
+	apkSigBlockMagic    = "APK Sig Block 42"
+	apkSigV2BlockID     = 0x7109871a
+	apkSigV3BlockID     = 0xf05368c0
+	apkSigV31BlockID    = 0x1b93ad61
+	apkSigMaxBlockSize  = 64 << 20
+	apkDigestChunkSize  = 1 << 20
+	zipEOCDMinSize      = 22
+	zipEOCDSignature    = 0x06054b50
+	zipEOCDCDOffsetSlot = 16
+)
+
+var ErrAPKSignature = errors.New("apk signature verification failed")
+
+var errNoSigningBlock = errors.New("no apk signing block")
+
+type APKSigner struct {
+	Scheme      string `json:"scheme"`
+	Fingerprint string `json:"fingerprint"`
+	Subject     string `json:"subject"`
+}
+
+type apkSigAlgorithm struct {
+	hash   crypto.Hash
+	pss    bool
+	verity bool
+}
+
+var apkSigAlgorithms = map[uint32]apkSigAlgorithm{
+	0x0101: {hash: crypto.SHA256, pss: true},
+	0x0102: {hash: crypto.SHA512, pss: true},
+	0x0103: {hash: crypto.SHA256},
+	0x0104: {hash: crypto.SHA512},
+	0x0201: {hash: crypto.SHA256},
+	0x0202: {hash: crypto.SHA512},
+	0x0301: {hash: crypto.SHA256},
+	0x0421: {hash: crypto.SHA256, verity: true},
+	0x0423: {hash: crypto.SHA256, verity: true},
+	0x0425: {hash: crypto.SHA256, verity: true},
+}
+
+type apkLayout struct {
+	sigBlockStart int64
+	cdOffset      int64
+	eocdOffset    int64
+	eocd          []byte
+}
+
+func CertificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+func newAPKSigner(scheme string, der []byte) APKSigner {
+	signer := APKSigner{Scheme: scheme, Fingerprint: CertificateFingerprint(der)}
+	if cert, err := x509.ParseCertificate(der); err == nil {
+		signer.Subject = cert.Subject.String()
+	}
+	return signer
+}
+
+func APKSigners(apkPath string) ([]APKSigner, error) {
+	f, err := os.Open(apkPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(f, stat.Size())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAPK, err)
+	}
+
+	var signers []APKSigner
+	verifiedSchemes := map[int]bool{}
+	var v2Certs [][]byte
+
+	layout, block, err := readAPKSigningBlock(f, stat.Size())
+	if err != nil && !errors.Is(err, errNoSigningBlock) {
+		return nil, err
+	}
+	if err == nil {
+		digests := newContentDigester(f, layout)
+		for _, scheme := range []struct {
+			id      uint32
+			name    string
+			version int
+		}{{apkSigV31BlockID, "v3.1", 3}, {apkSigV3BlockID, "v3", 3}, {apkSigV2BlockID, "v2", 2}} {
+			value, ok := block[scheme.id]
+			if !ok {
+				continue
+			}
+			certs, err := verifySchemeBlock(value, scheme.version == 3, digests)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s: %v", ErrAPKSignature, scheme.name, err)
+			}
+			verifiedSchemes[scheme.version] = true
+			if scheme.id == apkSigV2BlockID {
+				v2Certs = certs
+			}
+			for _, der := range certs {
+				signers = append(signers, newAPKSigner(scheme.name, der))
+			}
+		}
+	}
+
+	v1, strippedSchemes, err := verifyV1Signature(zr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: v1: %v", ErrAPKSignature, err)
+	}
+	for _, version := range strippedSchemes {
+		if !verifiedSchemes[version] {
+			return nil, fmt.Errorf("%w: v1 signature declares a v%d signature that is missing", ErrAPKSignature, version)
+		}
+	}
+	if len(v1) > 0 && v2Certs != nil && !sameCertificates(v1, v2Certs) {
+		return nil, fmt.Errorf("%w: v1 and v2 signers do not match", ErrAPKSignature)
+	}
+	for _, der := range v1 {
+		signers = append(signers, newAPKSigner("v1", der))
+	}
+
+	return signers, nil
+}
+
+func sameCertificates(a, b [][]byte) bool {
+	fingerprints := func(certs [][]byte) []string {
+		set := map[string]bool{}
+		for _, der := range certs {
+			set[CertificateFingerprint(der)] = true
+		}
+		var list []string
+		for fp := range set {
+			list = append(list, fp)
+		}
+		sort.Strings(list)
+		return list
+	}
+	x, y := fingerprints(a), fingerprints(b)
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func readAPKSigningBlock(r io.ReaderAt, size int64) (apkLayout, map[uint32][]byte, error) {
+	var layout apkLayout
+	tailSize := int64(zipEOCDMinSize + 0xffff)
+	if tailSize > size {
+		tailSize = size
+	}
+	tail := make([]byte, tailSize)
+	if _, err := r.ReadAt(tail, size-tailSize); err != nil {
+		return layout, nil, err
+	}
+
+	eocd := -1
+	for i := len(tail) - zipEOCDMinSize; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(tail[i:]) != zipEOCDSignature {
+			continue
+		}
+		if i+zipEOCDMinSize+int(binary.LittleEndian.Uint16(tail[i+20:])) == len(tail) {
+			eocd = i
+			break
+		}
+	}
+	if eocd < 0 {
+		return layout, nil, fmt.Errorf("%w: end of central directory not found", ErrInvalidAPK)
+	}
+	layout.eocdOffset = size - tailSize + int64(eocd)
+	layout.eocd = tail[eocd:]
+	layout.cdOffset = int64(binary.LittleEndian.Uint32(tail[eocd+zipEOCDCDOffsetSlot:]))
+	cdSize := int64(binary.LittleEndian.Uint32(tail[eocd+12:]))
+	if layout.cdOffset > layout.eocdOffset || layout.cdOffset+cdSize != layout.eocdOffset {
+		return layout, nil, fmt.Errorf("%w: invalid central directory offset", ErrInvalidAPK)
+	}
+	if layout.cdOffset < 32 {
+		return layout, nil, errNoSigningBlock
+	}
+
+	footer := make([]byte, 24)
+	if _, err := r.ReadAt(footer, layout.cdOffset-24); err != nil {
+		return layout, nil, err
+	}
+	if string(footer[8:]) != apkSigBlockMagic {
+		return layout, nil, errNoSigningBlock
+	}
+	blockSize := binary.LittleEndian.Uint64(footer)
+	if blockSize < 24 || blockSize > apkSigMaxBlockSize || int64(blockSize)+8 > layout.cdOffset {
+		return layout, nil, fmt.Errorf("%w: invalid apk signing block size", ErrInvalidAPK)
+	}
+	layout.sigBlockStart = layout.cdOffset - int64(blockSize) - 8
+
+	block := make([]byte, blockSize+8)
+	if _, err := r.ReadAt(block, layout.sigBlockStart); err != nil {
+		return layout, nil, err
+	}
+	if binary.LittleEndian.Uint64(block) != blockSize {
+		return layout, nil, fmt.Errorf("%w: apk signing block size mismatch", ErrInvalidAPK)
+	}
+
+	pairs := map[uint32][]byte{}
+	b := block[8 : len(block)-24]
+	for len(b) > 0 {
+		if len(b) < 12 {
+			return layout, nil, fmt.Errorf("%w: corrupt apk signing block", ErrInvalidAPK)
+		}
+		pairLen := binary.LittleEndian.Uint64(b)
+		if pairLen < 4 || pairLen > uint64(len(b)-8) {
+			return layout, nil, fmt.Errorf("%w: corrupt apk signing block", ErrInvalidAPK)
+		}
+		id := binary.LittleEndian.Uint32(b[8:])
+		pairs[id] = b[12 : 8+pairLen]
+		b = b[8+pairLen:]
+	}
+	return layout, pairs, nil
+}
+
+func lengthPrefixed(b []byte) ([]byte, []byte, bool) {
+	if len(b) < 4 {
+		return nil, nil, false
+	}
+	n := binary.LittleEndian.Uint32(b)
+	if uint64(n) > uint64(len(b)-4) {
+		return nil, nil, false
+	}
+	return b[4 : 4+n], b[4+n:], true
+}
+
+func lengthPrefixedList(b []byte) ([][]byte, bool) {
+	var items [][]byte
+	for len(b) > 0 {
+		item, rest, ok := lengthPrefixed(b)
+		if !ok {
+			return nil, false
+		}
+		items = append(items, item)
+		b = rest
+	}
+	return items, true
+}
+
+type contentDigester struct {
+	sections []*io.SectionReader
+	cache    map[crypto.Hash][]byte
+}
+
+func newContentDigester(r io.ReaderAt, layout apkLayout) *contentDigester {
+	eocd := append([]byte(nil), layout.eocd...)
+	binary.LittleEndian.PutUint32(eocd[zipEOCDCDOffsetSlot:], uint32(layout.sigBlockStart))
+	return &contentDigester{
+		sections: []*io.SectionReader{
+			io.NewSectionReader(r, 0, layout.sigBlockStart),
+			io.NewSectionReader(r, layout.cdOffset, layout.eocdOffset-layout.cdOffset),
+			io.NewSectionReader(bytes.NewReader(eocd), 0, int64(len(eocd))),
+		},
+		cache: map[crypto.Hash][]byte{},
+	}
+}
+
+func (d *contentDigester) digest(hash crypto.Hash) ([]byte, error) {
+	if sum, ok := d.cache[hash]; ok {
+		return sum, nil
+	}
+	if !hash.Available() {
+		return nil, fmt.Errorf("hash %v unavailable", hash)
+	}
+
+	var chunkDigests []byte
+	var count uint32
+	buf := make([]byte, apkDigestChunkSize)
+	prefix := make([]byte, 5)
+	for _, section := range d.sections {
+		for off := int64(0); off < section.Size(); off += apkDigestChunkSize {
+			n := min(int64(apkDigestChunkSize), section.Size()-off)
+			if _, err := section.ReadAt(buf[:n], off); err != nil {
+				return nil, err
+			}
+			h := hash.New()
+			prefix[0] = 0xa5
+			binary.LittleEndian.PutUint32(prefix[1:], uint32(n))
+			h.Write(prefix)
+			h.Write(buf[:n])
+			chunkDigests = h.Sum(chunkDigests)
+			count++
+		}
+	}
+
+	h := hash.New()
+	prefix[0] = 0x5a
+	binary.LittleEndian.PutUint32(prefix[1:], count)
+	h.Write(prefix)
+	h.Write(chunkDigests)
+	sum := h.Sum(nil)
+	d.cache[hash] = sum
+	return sum, nil
+}
+
+func verifySchemeBlock(value []byte, v3 bool, digests *contentDigester) ([][]byte, error) {
+	signerList, _, ok := lengthPrefixed(value)
+	if !ok {
+		return nil, errors.New("malformed signer list")
+	}
+	signers, ok := lengthPrefixedList(signerList)
+	if !ok || len(signers) == 0 {
+		return nil, errors.New("no signers")
+	}
+
+	var certs [][]byte
+	for i, signer := range signers {
+		der, err := verifySchemeSigner(signer, v3, digests)
+		if err != nil {
+			return nil, fmt.Errorf("signer #%d: %v", i+1, err)
+		}
+		certs = append(certs, der)
+	}
+	return certs, nil
+}
+
+func verifySchemeSigner(signer []byte, v3 bool, digests *contentDigester) ([]byte, error) {
+	signedData, rest, ok := lengthPrefixed(signer)
+	if !ok {
+		return nil, errors.New("malformed signed data")
+	}
+	var sdkRange []byte
+	if v3 {
+		if len(rest) < 8 {
+			return nil, errors.New("malformed sdk range")
+		}
+		sdkRange, rest = rest[:8], rest[8:]
+	}
+	signatureList, rest, ok := lengthPrefixed(rest)
+	if !ok {
+		return nil, errors.New("malformed signatures")
+	}
+	publicKeyDER, _, ok := lengthPrefixed(rest)
+	if !ok {
+		return nil, errors.New("malformed public key")
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(publicKeyDER)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+
+	signatures, ok := lengthPrefixedList(signatureList)
+	if !ok {
+		return nil, errors.New("malformed signatures")
+	}
+	signed := map[uint32]apkSigAlgorithm{}
+	for _, record := range signatures {
+		if len(record) < 8 {
+			return nil, errors.New("malformed signature record")
+		}
+		id := binary.LittleEndian.Uint32(record)
+		algorithm, known := apkSigAlgorithms[id]
+		if !known {
+			continue
+		}
+		signature, _, ok := lengthPrefixed(record[4:])
+		if !ok {
+			return nil, errors.New("malformed signature record")
+		}
+		if err := verifyWithPublicKey(publicKey, algorithm.hash, algorithm.pss, signedData, signature); err != nil {
+			return nil, fmt.Errorf("signature 0x%04x: %v", id, err)
+		}
+		signed[id] = algorithm
+	}
+	if len(signed) == 0 {
+		return nil, errors.New("no supported signatures")
+	}
+
+	digestList, rest, ok := lengthPrefixed(signedData)
+	if !ok {
+		return nil, errors.New("malformed digests")
+	}
+	certList, rest, ok := lengthPrefixed(rest)
+	if !ok {
+		return nil, errors.New("malformed certificates")
+	}
+	if v3 && (len(rest) < 8 || !bytes.Equal(rest[:8], sdkRange)) {
+		return nil, errors.New("sdk range does not match signed data")
+	}
+
+	records, ok := lengthPrefixedList(digestList)
+	if !ok {
+		return nil, errors.New("malformed digests")
+	}
+	expected := map[uint32][]byte{}
+	for _, record := range records {
+		if len(record) < 8 {
+			return nil, errors.New("malformed digest record")
+		}
+		digest, _, ok := lengthPrefixed(record[4:])
+		if !ok {
+			return nil, errors.New("malformed digest record")
+		}
+		expected[binary.LittleEndian.Uint32(record)] = digest
+	}
+
+	contentChecked := false
+	for id, algorithm := range signed {
+		digest, ok := expected[id]
+		if !ok {
+			return nil, fmt.Errorf("no digest for signature algorithm 0x%04x", id)
+		}
+		if algorithm.verity {
+			continue
+		}
+		actual, err := digests.digest(algorithm.hash)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(actual, digest) {
+			return nil, errors.New("apk content digest mismatch")
+		}
+		contentChecked = true
+	}
+	if !contentChecked {
+		return nil, errors.New("no supported content digest")
+	}
+
+	certs, ok := lengthPrefixedList(certList)
+	if !ok || len(certs) == 0 {
+		return nil, errors.New("no certificates")
+	}
+	cert, err := x509.ParseCertificate(certs[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate: %v", err)
+	}
+	if !bytes.Equal(cert.RawSubjectPublicKeyInfo, publicKeyDER) {
+		return nil, errors.New("certificate does not match signing public key")
+	}
+	return certs[0], nil
+}
+
+type dsaSignature struct {
+	R, S *big.Int
+}
+
+func verifyWithPublicKey(publicKey interface{}, hash crypto.Hash, pss bool, data, signature []byte) error {
+	if !hash.Available() {
+		return fmt.Errorf("hash %v unavailable", hash)
+	}
+	h := hash.New()
+	h.Write(data)
+	digest := h.Sum(nil)
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		if pss {
+			return rsa.VerifyPSS(key, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		if !pss && ecdsa.VerifyASN1(key, digest, signature) {
+			return nil
+		}
+	case *dsa.PublicKey:
+		if size := (key.Q.BitLen() + 7) / 8; len(digest) > size {
+			digest = digest[:size]
+		}
+		var sig dsaSignature
+		if rest, err := asn1.Unmarshal(signature, &sig); err == nil && len(rest) == 0 && !pss &&
+			sig.R != nil && sig.S != nil && dsa.Verify(key, digest, sig.R, sig.S) {
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+	return errors.New("invalid signature")
+}
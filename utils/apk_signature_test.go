@@ -0,0 +1,308 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testSigner struct {
+	key  *rsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func newTestSigner(t *testing.T, name string) testSigner {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testSigner{key: key, cert: cert}
+}
+
+func (s testSigner) sign(t *testing.T, data []byte) []byte {
+	t.Helper()
+	sum := sha256.Sum256(data)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+type testEntry struct {
+	name string
+	data []byte
+}
+
+func testZip(t *testing.T, entries []testEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: entry.name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(entry.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func sha256Base64(data []byte) string {
+	sum := sha256.Sum256(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func testPKCS7(t *testing.T, s testSigner, content []byte) []byte {
+	t.Helper()
+	sha256ID := pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}, Parameters: asn1.NullRawValue}
+	rsaID := pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}, Parameters: asn1.NullRawValue}
+	signedData := struct {
+		Version          int
+		DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+		ContentInfo      struct{ ContentType asn1.ObjectIdentifier }
+		Certificates     asn1.RawValue
+		SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+	}{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256ID},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: s.cert.Raw},
+		SignerInfos: []pkcs7SignerInfo{{
+			Version:                   1,
+			IssuerAndSerial:           pkcs7IssuerAndSerial{Issuer: asn1.RawValue{FullBytes: s.cert.RawIssuer}, Serial: s.cert.SerialNumber},
+			DigestAlgorithm:           sha256ID,
+			DigestEncryptionAlgorithm: rsaID,
+			EncryptedDigest:           s.sign(t, content),
+		}},
+	}
+	signedData.ContentInfo.ContentType = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	inner, err := asn1.Marshal(signedData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}{oidPKCS7SignedData, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: inner}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func signV1(t *testing.T, s testSigner, entries []testEntry, apkSigned string) []testEntry {
+	t.Helper()
+	manifest := "Manifest-Version: 1.0\r\nCreated-By: test\r\n\r\n"
+	sf := "Signature-Version: 1.0\r\n"
+	if apkSigned != "" {
+		sf += "X-Android-APK-Signed: " + apkSigned + "\r\n"
+	}
+	var sections string
+	for _, entry := range entries {
+		section := fmt.Sprintf("Name: %s\r\nSHA-256-Digest: %s\r\n\r\n", entry.name, sha256Base64(entry.data))
+		manifest += section
+		sections += fmt.Sprintf("Name: %s\r\nSHA-256-Digest: %s\r\n\r\n", entry.name, sha256Base64([]byte(section)))
+	}
+	sf += "SHA-256-Digest-Manifest: " + sha256Base64([]byte(manifest)) + "\r\n\r\n" + sections
+
+	signed := append([]testEntry{{"META-INF/MANIFEST.MF", []byte(manifest)}, {"META-INF/CERT.SF", []byte(sf)}}, entries...)
+	return append(signed, testEntry{"META-INF/CERT.RSA", testPKCS7(t, s, []byte(sf))})
+}
+
+func lp32(parts ...[]byte) []byte {
+	var b []byte
+	for _, part := range parts {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(part)))
+		b = append(b, part...)
+	}
+	return b
+}
+
+func testContentDigest(sections ...[]byte) []byte {
+	var chunks []byte
+	count := 0
+	for _, section := range sections {
+		for off := 0; off < len(section); off += apkDigestChunkSize {
+			chunk := section[off:min(off+apkDigestChunkSize, len(section))]
+			h := sha256.New()
+			h.Write([]byte{0xa5})
+			h.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(chunk))))
+			h.Write(chunk)
+			chunks = h.Sum(chunks)
+			count++
+		}
+	}
+	h := sha256.New()
+	h.Write([]byte{0x5a})
+	h.Write(binary.LittleEndian.AppendUint32(nil, uint32(count)))
+	h.Write(chunks)
+	return h.Sum(nil)
+}
+
+func signV2(t *testing.T, s testSigner, apk []byte) []byte {
+	t.Helper()
+	eocdOffset := bytes.LastIndex(apk, []byte{0x50, 0x4b, 0x05, 0x06})
+	cdOffset := int(binary.LittleEndian.Uint32(apk[eocdOffset+zipEOCDCDOffsetSlot:]))
+	contents, cd, eocd := apk[:cdOffset], apk[cdOffset:eocdOffset], apk[eocdOffset:]
+
+	const rsaPKCS1SHA256 = 0x0103
+	digest := testContentDigest(contents, cd, eocd)
+	signedData := lp32(
+		lp32(append(binary.LittleEndian.AppendUint32(nil, rsaPKCS1SHA256), lp32(digest)...)),
+		lp32(s.cert.Raw),
+		nil,
+	)
+	signature := append(binary.LittleEndian.AppendUint32(nil, rsaPKCS1SHA256), lp32(s.sign(t, signedData))...)
+	signer := lp32(signedData, lp32(signature), s.cert.RawSubjectPublicKeyInfo)
+	value := lp32(lp32(signer))
+
+	var pairs []byte
+	pairs = binary.LittleEndian.AppendUint64(pairs, uint64(4+len(value)))
+	pairs = binary.LittleEndian.AppendUint32(pairs, apkSigV2BlockID)
+	pairs = append(pairs, value...)
+	size := uint64(len(pairs) + 8 + len(apkSigBlockMagic))
+	var block []byte
+	block = binary.LittleEndian.AppendUint64(block, size)
+	block = append(block, pairs...)
+	block = binary.LittleEndian.AppendUint64(block, size)
+	block = append(block, apkSigBlockMagic...)
+
+	out := append(append(append([]byte(nil), contents...), block...), cd...)
+	eocd = append([]byte(nil), eocd...)
+	binary.LittleEndian.PutUint32(eocd[zipEOCDCDOffsetSlot:], uint32(cdOffset+len(block)))
+	return append(out, eocd...)
+}
+
+func writeTestAPK(t *testing.T, data []byte) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "test.apk")
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func testAPKEntries() []testEntry {
+	return []testEntry{
+		{"AndroidManifest.xml", []byte("manifest")},
+		{"classes.dex", bytes.Repeat([]byte("dex"), 500000)},
+		{"res/raw/data.bin", []byte("data")},
+	}
+}
+
+func TestAPKSignersValid(t *testing.T) {
+	signer := newTestSigner(t, "release")
+	fingerprint := CertificateFingerprint(signer.cert.Raw)
+
+	cases := []struct {
+		name    string
+		apk     []byte
+		schemes []string
+	}{
+		{"v1", testZip(t, signV1(t, signer, testAPKEntries(), "")), []string{"v1"}},
+		{"v2", signV2(t, signer, testZip(t, testAPKEntries())), []string{"v2"}},
+		{"v1 and v2", signV2(t, signer, testZip(t, signV1(t, signer, testAPKEntries(), "2"))), []string{"v2", "v1"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			signers, err := APKSigners(writeTestAPK(t, tc.apk))
+			if err != nil {
+				t.Fatalf("APKSigners() error = %v", err)
+			}
+			var schemes []string
+			for _, s := range signers {
+				if s.Fingerprint != fingerprint {
+					t.Fatalf("fingerprint = %s, want %s", s.Fingerprint, fingerprint)
+				}
+				schemes = append(schemes, s.Scheme)
+			}
+			if strings.Join(schemes, ",") != strings.Join(tc.schemes, ",") {
+				t.Fatalf("schemes = %v, want %v", schemes, tc.schemes)
+			}
+		})
+	}
+}
+
+func TestAPKSignersUnsigned(t *testing.T) {
+	signers, err := APKSigners(writeTestAPK(t, testZip(t, testAPKEntries())))
+	if err != nil || len(signers) != 0 {
+		t.Fatalf("APKSigners() = %v, %v; want no signers", signers, err)
+	}
+}
+
+func TestAPKSignersRejectsTampering(t *testing.T) {
+	signer := newTestSigner(t, "release")
+	other := newTestSigner(t, "attacker")
+
+	tamperedEntries := func(entries []testEntry) []testEntry {
+		for i := range entries {
+			if entries[i].name == "classes.dex" {
+				entries[i].data = []byte("patched")
+			}
+		}
+		return entries
+	}
+
+	v2Signed := signV2(t, signer, testZip(t, testAPKEntries()))
+	flipped := append([]byte(nil), v2Signed...)
+	flipped[bytes.Index(flipped, []byte("dexdex"))] ^= 0xff
+
+	forged := signV1(t, signer, testAPKEntries(), "")
+	forged[len(forged)-1].data = testPKCS7(t, signer, []byte("Signature-Version: 1.0\r\n\r\n"))
+
+	cases := []struct {
+		name string
+		apk  []byte
+	}{
+		{"v1 entry modified", testZip(t, tamperedEntries(signV1(t, signer, testAPKEntries(), "")))},
+		{"v1 entry added", testZip(t, append(signV1(t, signer, testAPKEntries(), ""), testEntry{"lib/extra.so", []byte("x")}))},
+		{"v1 signature file replaced", testZip(t, append(signV1(t, signer, testAPKEntries(), "")[:1],
+			append([]testEntry{{"META-INF/CERT.SF", []byte("Signature-Version: 1.0\r\n\r\n")}}, signV1(t, signer, testAPKEntries(), "")[2:]...)...))},
+		{"v2 stripped", testZip(t, signV1(t, signer, testAPKEntries(), "2"))},
+		{"v2 content modified", flipped},
+		{"v1 and v2 signers differ", signV2(t, other, testZip(t, signV1(t, signer, testAPKEntries(), "2")))},
+		{"v1 block over another signature file", testZip(t, forged)},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := APKSigners(writeTestAPK(t, tc.apk))
+			if !errors.Is(err, ErrAPKSignature) {
+				t.Fatalf("APKSigners() error = %v, want ErrAPKSignature", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,420 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	_ "crypto/sha1"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var (
+	oidPKCS7SignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+)
+
+var pkcs7DigestAlgorithms = map[string]crypto.Hash{
+	"1.3.14.3.2.26":          crypto.SHA1,
+	"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+	"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+	"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+}
+
+var jarDigestAlgorithms = map[string]crypto.Hash{
+	"SHA1":   crypto.SHA1,
+	"SHA256": crypto.SHA256,
+	"SHA384": crypto.SHA384,
+	"SHA512": crypto.SHA512,
+}
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue     `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue     `asn1:"optional,tag:1"`
+	SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+}
+
+type pkcs7IssuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type pkcs7SignerInfo struct {
+	Version                   int
+	IssuerAndSerial           pkcs7IssuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type pkcs7Attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+type manifestSection struct {
+	raw   []byte
+	attrs map[string]string
+}
+
+func (s manifestSection) name() string {
+	return s.attrs["name"]
+}
+
+func parseManifest(data []byte) ([]manifestSection, error) {
+	var sections []manifestSection
+	current := manifestSection{attrs: map[string]string{}}
+	start, lastKey := 0, ""
+	for pos := 0; pos < len(data); {
+		end := bytes.IndexAny(data[pos:], "\r\n")
+		next := len(data)
+		line := data[pos:]
+		if end >= 0 {
+			line = data[pos : pos+end]
+			next = pos + end + 1
+			if data[pos+end] == '\r' && next < len(data) && data[next] == '\n' {
+				next++
+			}
+		}
+
+		switch {
+		case len(line) == 0:
+			if len(current.attrs) > 0 {
+				current.raw = data[start:next]
+				sections = append(sections, current)
+			}
+			current = manifestSection{attrs: map[string]string{}}
+			start, lastKey = next, ""
+		case line[0] == ' ':
+			if lastKey == "" {
+				return nil, errors.New("manifest continuation line without attribute")
+			}
+			current.attrs[lastKey] += string(line[1:])
+		default:
+			colon := bytes.Index(line, []byte(": "))
+			if colon <= 0 {
+				return nil, fmt.Errorf("malformed manifest line %q", line)
+			}
+			lastKey = strings.ToLower(string(line[:colon]))
+			current.attrs[lastKey] = string(line[colon+2:])
+		}
+		pos = next
+	}
+	if len(current.attrs) > 0 {
+		current.raw = data[start:]
+		sections = append(sections, current)
+	}
+	if len(sections) == 0 {
+		return nil, errors.New("empty manifest")
+	}
+	return sections, nil
+}
+
+func manifestDigests(attrs map[string]string, suffix string) (map[crypto.Hash][]byte, error) {
+	digests := map[crypto.Hash][]byte{}
+	for key, value := range attrs {
+		if !strings.HasSuffix(key, suffix) {
+			continue
+		}
+		name := strings.ToUpper(strings.ReplaceAll(strings.TrimSuffix(key, suffix), "-", ""))
+		algorithm, ok := jarDigestAlgorithms[name]
+		if !ok {
+			continue
+		}
+		digest, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("malformed %s attribute", key)
+		}
+		digests[algorithm] = digest
+	}
+	return digests, nil
+}
+
+func digestsMatch(expected map[crypto.Hash][]byte, data []byte) bool {
+	if len(expected) == 0 {
+		return false
+	}
+	for algorithm, digest := range expected {
+		h := algorithm.New()
+		h.Write(data)
+		if !bytes.Equal(h.Sum(nil), digest) {
+			return false
+		}
+	}
+	return true
+}
+
+func entryDigestsMatch(f *zip.File, expected map[crypto.Hash][]byte) (bool, error) {
+	if len(expected) == 0 {
+		return false, nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+
+	hashes := map[crypto.Hash]hash.Hash{}
+	writers := make([]io.Writer, 0, len(expected))
+	for algorithm := range expected {
+		h := algorithm.New()
+		hashes[algorithm] = h
+		writers = append(writers, h)
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), rc); err != nil {
+		return false, err
+	}
+	for algorithm, digest := range expected {
+		if !bytes.Equal(hashes[algorithm].Sum(nil), digest) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func isJarSignatureFile(name string) bool {
+	dir, base := path.Split(name)
+	if dir != "META-INF/" {
+		return false
+	}
+	if base == "MANIFEST.MF" {
+		return true
+	}
+	switch strings.ToUpper(path.Ext(base)) {
+	case ".SF", ".RSA", ".DSA", ".EC":
+		return true
+	}
+	return false
+}
+
+func verifyV1Signature(zr *zip.Reader) ([][]byte, []int, error) {
+	entries := map[string]*zip.File{}
+	var blocks []*zip.File
+	for _, f := range zr.File {
+		if _, exists := entries[f.Name]; exists {
+			return nil, nil, fmt.Errorf("duplicate zip entry %s", f.Name)
+		}
+		entries[f.Name] = f
+		dir, base := path.Split(f.Name)
+		switch strings.ToUpper(path.Ext(base)) {
+		case ".RSA", ".DSA", ".EC":
+			if dir == "META-INF/" {
+				blocks = append(blocks, f)
+			}
+		}
+	}
+	if len(blocks) == 0 {
+		return nil, nil, nil
+	}
+
+	manifestFile, ok := entries["META-INF/MANIFEST.MF"]
+	if !ok {
+		return nil, nil, errors.New("META-INF/MANIFEST.MF not found")
+	}
+	manifestData, err := readZipEntry(manifestFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest, err := parseManifest(manifestData)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifestEntries := map[string]manifestSection{}
+	for _, section := range manifest[1:] {
+		name := section.name()
+		if name == "" {
+			return nil, nil, errors.New("manifest section without name")
+		}
+		if _, exists := manifestEntries[name]; exists {
+			return nil, nil, fmt.Errorf("duplicate manifest section %s", name)
+		}
+		manifestEntries[name] = section
+	}
+
+	var certs [][]byte
+	var declared []int
+	signedBy := map[string]int{}
+	for _, block := range blocks {
+		sfName := strings.TrimSuffix(block.Name, path.Ext(block.Name)) + ".SF"
+		sfFile, ok := entries[sfName]
+		if !ok {
+			return nil, nil, fmt.Errorf("%s not found", sfName)
+		}
+		sfData, err := readZipEntry(sfFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		blockData, err := readZipEntry(block)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		der, err := verifyPKCS7Signature(blockData, sfData)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", block.Name, err)
+		}
+		certs = append(certs, der)
+
+		sf, err := parseManifest(sfData)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", sfName, err)
+		}
+		for _, value := range strings.Split(sf[0].attrs["x-android-apk-signed"], ",") {
+			if version, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && version >= 2 {
+				declared = append(declared, version)
+			}
+		}
+
+		whole, err := manifestDigests(sf[0].attrs, "-digest-manifest")
+		if err != nil {
+			return nil, nil, err
+		}
+		if digestsMatch(whole, manifestData) {
+			for name := range manifestEntries {
+				signedBy[name]++
+			}
+			continue
+		}
+
+		covered := map[string]bool{}
+		for _, section := range sf[1:] {
+			name := section.name()
+			entry, ok := manifestEntries[name]
+			if !ok {
+				return nil, nil, fmt.Errorf("%s: entry %s not in manifest", sfName, name)
+			}
+			expected, err := manifestDigests(section.attrs, "-digest")
+			if err != nil {
+				return nil, nil, err
+			}
+			if !digestsMatch(expected, entry.raw) {
+				return nil, nil, fmt.Errorf("%s: manifest section digest mismatch for %s", sfName, name)
+			}
+			if !covered[name] {
+				covered[name] = true
+				signedBy[name]++
+			}
+		}
+	}
+
+	for name, section := range manifestEntries {
+		f, ok := entries[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("manifest entry %s not in apk", name)
+		}
+		expected, err := manifestDigests(section.attrs, "-digest")
+		if err != nil {
+			return nil, nil, err
+		}
+		match, err := entryDigestsMatch(f, expected)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if !match {
+			return nil, nil, fmt.Errorf("digest mismatch for %s", name)
+		}
+	}
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "/") || isJarSignatureFile(f.Name) {
+			continue
+		}
+		if signedBy[f.Name] != len(blocks) {
+			return nil, nil, fmt.Errorf("entry %s is not signed", f.Name)
+		}
+	}
+
+	return certs, declared, nil
+}
+
+func verifyPKCS7Signature(data, content []byte) ([]byte, error) {
+	var info pkcs7ContentInfo
+	if rest, err := asn1.Unmarshal(data, &info); err != nil || len(rest) > 0 {
+		return nil, errors.New("malformed signature block")
+	}
+	if !info.ContentType.Equal(oidPKCS7SignedData) {
+		return nil, errors.New("signature block is not pkcs7 signed data")
+	}
+	var signed pkcs7SignedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &signed); err != nil {
+		return nil, fmt.Errorf("malformed signed data: %v", err)
+	}
+	if len(signed.SignerInfos) != 1 {
+		return nil, fmt.Errorf("expected one signer, found %d", len(signed.SignerInfos))
+	}
+	signer := signed.SignerInfos[0]
+
+	var cert *x509.Certificate
+	for rest := signed.Certificates.Bytes; len(rest) > 0; {
+		var raw asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &raw); err != nil {
+			return nil, errors.New("malformed certificate list")
+		}
+		candidate, err := x509.ParseCertificate(raw.FullBytes)
+		if err != nil {
+			continue
+		}
+		if bytes.Equal(candidate.RawIssuer, signer.IssuerAndSerial.Issuer.FullBytes) &&
+			signer.IssuerAndSerial.Serial != nil && candidate.SerialNumber.Cmp(signer.IssuerAndSerial.Serial) == 0 {
+			cert = candidate
+			break
+		}
+	}
+	if cert == nil {
+		return nil, errors.New("signer certificate not found")
+	}
+
+	algorithm, ok := pkcs7DigestAlgorithms[signer.DigestAlgorithm.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported digest algorithm %s", signer.DigestAlgorithm.Algorithm)
+	}
+
+	signedBytes := content
+	if len(signer.AuthenticatedAttributes.FullBytes) > 0 {
+		var messageDigest []byte
+		for rest := signer.AuthenticatedAttributes.Bytes; len(rest) > 0; {
+			var attr pkcs7Attribute
+			var err error
+			if rest, err = asn1.Unmarshal(rest, &attr); err != nil {
+				return nil, errors.New("malformed authenticated attributes")
+			}
+			if attr.Type.Equal(oidMessageDigest) {
+				if _, err := asn1.Unmarshal(attr.Values.Bytes, &messageDigest); err != nil {
+					return nil, errors.New("malformed message digest attribute")
+				}
+			}
+		}
+		h := algorithm.New()
+		h.Write(content)
+		if messageDigest == nil || !bytes.Equal(h.Sum(nil), messageDigest) {
+			return nil, errors.New("signature file digest mismatch")
+		}
+		signedBytes = append([]byte{0x31}, signer.AuthenticatedAttributes.FullBytes[1:]...)
+	}
+
+	if err := verifyWithPublicKey(cert.PublicKey, algorithm, false, signedBytes, signer.EncryptedDigest); err != nil {
+		return nil, err
+	}
+	return cert.Raw, nil
+}
@@ -0,0 +1,317 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func testChunk(chunkType uint16, header, body []byte) []byte {
+	b := make([]byte, 8, 8+len(header)+len(body))
+	binary.LittleEndian.PutUint16(b, chunkType)
+	binary.LittleEndian.PutUint16(b[2:], uint16(8+len(header)))
+	b = append(b, header...)
+	b = append(b, body...)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)))
+	return b
+}
+
+func testChunkHeader(chunkType uint16, headerSize uint16, size uint32, rest ...byte) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint16(b, chunkType)
+	binary.LittleEndian.PutUint16(b[2:], headerSize)
+	binary.LittleEndian.PutUint32(b[4:], size)
+	return append(b, rest...)
+}
+
+func testDocument(chunkType uint16, chunks ...[]byte) []byte {
+	var body []byte
+	for _, chunk := range chunks {
+		body = append(body, chunk...)
+	}
+	return testChunk(chunkType, nil, body)
+}
+
+func testUint16(v ...uint16) []byte {
+	b := make([]byte, 2*len(v))
+	for i, x := range v {
+		binary.LittleEndian.PutUint16(b[2*i:], x)
+	}
+	return b
+}
+
+func testUint32(v ...uint32) []byte {
+	b := make([]byte, 4*len(v))
+	for i, x := range v {
+		binary.LittleEndian.PutUint32(b[4*i:], x)
+	}
+	return b
+}
+
+func testStringPool(strs ...string) []byte {
+	var offsets, data []byte
+	for _, s := range strs {
+		offsets = append(offsets, testUint32(uint32(len(data)))...)
+		data = append(data, byte(len(s)), byte(len(s)))
+		data = append(data, s...)
+		data = append(data, 0)
+	}
+	for len(data)%4 != 0 {
+		data = append(data, 0)
+	}
+	header := testUint32(uint32(len(strs)), 0, 1<<8, uint32(28+len(offsets)), 0)
+	return testChunk(axmlChunkStringPool, header, append(offsets, data...))
+}
+
+type testAttr struct {
+	name     uint32
+	raw      uint32
+	dataType uint8
+	data     uint32
+}
+
+func testElement(tag uint32, attrs ...testAttr) []byte {
+	body := testUint32(0xffffffff, tag)
+	body = append(body, testUint16(20, 20, uint16(len(attrs)), 0, 0, 0)...)
+	for _, a := range attrs {
+		body = append(body, testUint32(0xffffffff, a.name, a.raw)...)
+		body = append(body, 8, 0, 0, a.dataType)
+		body = append(body, testUint32(a.data)...)
+	}
+	return testChunk(axmlChunkStartElement, testUint32(1, 0xffffffff), body)
+}
+
+type testConfig struct {
+	language string
+	density  uint16
+}
+
+func testResType(typeID uint8, config testConfig, values ...resValue) []byte {
+	cfg := make([]byte, 16)
+	binary.LittleEndian.PutUint32(cfg, 16)
+	copy(cfg[8:10], config.language)
+	binary.LittleEndian.PutUint16(cfg[14:], config.density)
+
+	header := []byte{typeID, 0, 0, 0}
+	header = append(header, testUint32(uint32(len(values)), uint32(36+4*len(values)))...)
+	header = append(header, cfg...)
+
+	var offsets, entries []byte
+	for _, v := range values {
+		offsets = append(offsets, testUint32(uint32(len(entries)))...)
+		entries = append(entries, testUint16(8, 0)...)
+		entries = append(entries, testUint32(0)...)
+		entries = append(entries, 8, 0, 0, v.dataType)
+		entries = append(entries, testUint32(v.data)...)
+	}
+	return testChunk(arscChunkType, header, append(offsets, entries...))
+}
+
+func testResTable(strs []string, types ...[]byte) []byte {
+	var body []byte
+	for _, chunk := range types {
+		body = append(body, chunk...)
+	}
+	pkg := testChunk(arscChunkPackage, testUint32(0x7f), body)
+	return testChunk(axmlChunkTable, testUint32(1), append(testStringPool(strs...), pkg...))
+}
+
+func TestWalkAXMLMalformed(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short", []byte{0x03, 0x00, 0x08}},
+		{"wrong type", testDocument(axmlChunkTable)},
+		{"document header larger than size", testChunkHeader(axmlChunkXML, 64, 16, make([]byte, 8)...)},
+		{"document size beyond input", testChunkHeader(axmlChunkXML, 8, 1024)},
+		{"document header smaller than chunk header", testChunkHeader(axmlChunkXML, 2, 8)},
+		{"resource map header larger than size", testDocument(axmlChunkXML, testChunkHeader(axmlChunkResourceMap, 64, 16, make([]byte, 8)...))},
+		{"child chunk size beyond input", testDocument(axmlChunkXML, testChunkHeader(axmlChunkResourceMap, 8, 4096))},
+		{"child chunk size below header", testDocument(axmlChunkXML, testChunkHeader(axmlChunkStartElement, 8, 4))},
+		{"string pool header too small", testDocument(axmlChunkXML, testChunk(axmlChunkStringPool, make([]byte, 4), make([]byte, 16)))},
+		{"element without attributes block", testDocument(axmlChunkXML, testChunk(axmlChunkStartElement, make([]byte, 8), make([]byte, 4)))},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := walkAXML(tc.data, func(string, []axmlAttr) {})
+			if !errors.Is(err, ErrInvalidAPK) {
+				t.Fatalf("walkAXML() error = %v, want ErrInvalidAPK", err)
+			}
+		})
+	}
+}
+
+func TestParseResourceTableMalformed(t *testing.T) {
+	typeChunk := func(headerSize uint16) []byte {
+		return testChunkHeader(arscChunkType, headerSize, 28, make([]byte, 20)...)
+	}
+	pkg := func(chunks ...[]byte) []byte {
+		header := make([]byte, 4)
+		binary.LittleEndian.PutUint32(header, 0x7f)
+		var body []byte
+		for _, chunk := range chunks {
+			body = append(body, chunk...)
+		}
+		return testChunk(arscChunkPackage, header, body)
+	}
+
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"wrong type", testDocument(axmlChunkXML)},
+		{"table header larger than size", testChunkHeader(axmlChunkTable, 64, 16, make([]byte, 8)...)},
+		{"package header below minimum", testDocument(axmlChunkTable, testChunkHeader(arscChunkPackage, 8, 16, make([]byte, 8)...))},
+		{"type header below config offset", testDocument(axmlChunkTable, pkg(typeChunk(8)))},
+		{"type header larger than size", testDocument(axmlChunkTable, pkg(typeChunk(200)))},
+		{"type chunk truncated", testDocument(axmlChunkTable, pkg(testChunkHeader(arscChunkType, 8, 12, make([]byte, 4)...)))},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseResourceTable(tc.data)
+			if !errors.Is(err, ErrInvalidAPK) {
+				t.Fatalf("parseResourceTable() error = %v, want ErrInvalidAPK", err)
+			}
+		})
+	}
+}
+
+func TestWalkAXMLEmptyDocument(t *testing.T) {
+	if err := walkAXML(testDocument(axmlChunkXML), func(string, []axmlAttr) {}); err != nil {
+		t.Fatalf("walkAXML() error = %v", err)
+	}
+}
+
+func FuzzWalkAXML(f *testing.F) {
+	f.Add(testDocument(axmlChunkXML))
+	f.Add(testDocument(axmlChunkXML, testChunkHeader(axmlChunkResourceMap, 64, 16, make([]byte, 8)...)))
+	f.Add(testDocument(axmlChunkXML, testChunk(axmlChunkStartElement, make([]byte, 8), make([]byte, 40))))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		walkAXML(data, func(string, []axmlAttr) {})
+	})
+}
+
+func FuzzParseResourceTable(f *testing.F) {
+	f.Add(testDocument(axmlChunkTable))
+	f.Add(testDocument(axmlChunkTable, testChunkHeader(arscChunkPackage, 12, 40, make([]byte, 32)...)))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if table, err := parseResourceTable(data); err == nil {
+			table.resolveString(0x7f010000)
+			table.resolveIcon(0x7f020000)
+		}
+	})
+}
+
+func TestInspectAPK(t *testing.T) {
+	const (
+		sVersionCode = iota
+		sVersionName
+		sMinSdk
+		sTargetSdk
+		sLabel
+		sIcon
+		sManifest
+		sPackage
+		sPackageName
+		sVersion
+		sUsesSdk
+		sApplication
+	)
+	manifest := testDocument(axmlChunkXML,
+		testStringPool("versionCode", "versionName", "minSdkVersion", "targetSdkVersion", "label", "icon",
+			"manifest", "package", "com.example.app", "1.2.3", "uses-sdk", "application"),
+		testChunk(axmlChunkResourceMap, nil, testUint32(attrVersionCode, attrVersionName, attrMinSdkVersion, attrTargetSdk, attrLabel, attrIcon)),
+		testElement(sManifest,
+			testAttr{sPackage, sPackageName, resTypeString, sPackageName},
+			testAttr{sVersionCode, 0xffffffff, resTypeIntDec, 42},
+			testAttr{sVersionName, sVersion, resTypeString, sVersion},
+		),
+		testElement(sUsesSdk,
+			testAttr{sMinSdk, 0xffffffff, resTypeIntDec, 21},
+			testAttr{sTargetSdk, 0xffffffff, resTypeIntDec, 34},
+		),
+		testElement(sApplication,
+			testAttr{sLabel, 0xffffffff, resTypeReference, 0x7f010000},
+			testAttr{sIcon, 0xffffffff, resTypeReference, 0x7f020000},
+		),
+	)
+	table := testResTable(
+		[]string{"My App", "Mon App", "res/mipmap-mdpi/ic.png", "res/mipmap-xxhdpi/ic.png", "res/mipmap-anydpi/ic.xml"},
+		testResType(1, testConfig{}, resValue{resTypeReference, 0x7f010001}, resValue{resTypeString, 0}),
+		testResType(1, testConfig{language: "fr"}, resValue{resTypeReference, 0x7f010001}, resValue{resTypeString, 1}),
+		testResType(2, testConfig{density: 160}, resValue{resTypeString, 2}),
+		testResType(2, testConfig{density: 480}, resValue{resTypeString, 3}),
+		testResType(2, testConfig{density: 0xfffe}, resValue{resTypeString, 4}),
+	)
+	path := writeTestAPK(t, testZip(t, []testEntry{
+		{"AndroidManifest.xml", manifest},
+		{"resources.arsc", table},
+		{"lib/x86/libnative.so", []byte("so")},
+		{"lib/arm64-v8a/libnative.so", []byte("so")},
+		{"lib/armeabi-v7a/nested/libnative.so", []byte("so")},
+		{"classes.dex", []byte("dex")},
+	}))
+
+	info, err := InspectAPK(path)
+	if err != nil {
+		t.Fatalf("InspectAPK() error = %v", err)
+	}
+	if info.PackageName != "com.example.app" || info.VersionCode != 42 || info.VersionName != "1.2.3" {
+		t.Fatalf("InspectAPK() package = %s %d %s", info.PackageName, info.VersionCode, info.VersionName)
+	}
+	if info.MinSDK != 21 || info.TargetSDK != 34 {
+		t.Fatalf("InspectAPK() sdk = %d/%d, want 21/34", info.MinSDK, info.TargetSDK)
+	}
+	if !reflect.DeepEqual(info.ABIs, []string{"arm64-v8a", "x86"}) || info.ABIMask != ABIArm64V8a|ABIX86 {
+		t.Fatalf("InspectAPK() abis = %v (%d)", info.ABIs, info.ABIMask)
+	}
+	if info.Label != "My App" {
+		t.Fatalf("InspectAPK() label = %q, want My App", info.Label)
+	}
+	if info.IconPath != "res/mipmap-xxhdpi/ic.png" {
+		t.Fatalf("InspectAPK() icon = %q, want res/mipmap-xxhdpi/ic.png", info.IconPath)
+	}
+	if info.IsWearOS {
+		t.Fatal("InspectAPK() reported a Wear OS app")
+	}
+}
+
+func TestResolveSelfReferencingTable(t *testing.T) {
+	var configs [][]byte
+	for i := 0; i < 8; i++ {
+		configs = append(configs, testResType(1, testConfig{density: uint16(120 + 40*i)}, resValue{resTypeReference, 0x7f010000}))
+	}
+	table, err := parseResourceTable(testResTable([]string{"unused"}, configs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := table.resolve(0x7f010000); len(got) != 0 {
+		t.Fatalf("resolve() = %v, want no entries", got)
+	}
+	if label := table.resolveString(0x7f010000); label != "" {
+		t.Fatalf("resolveString() = %q, want empty", label)
+	}
+}
+
+func TestResolveCapsFanOut(t *testing.T) {
+	var configs [][]byte
+	for i := 0; i < 8; i++ {
+		values := make([]resValue, 64)
+		for j := range values {
+			values[j] = resValue{resTypeReference, 0x7f010000 | uint32(j+1)%64}
+		}
+		values[63] = resValue{resTypeString, 0}
+		configs = append(configs, testResType(1, testConfig{density: uint16(120 + 40*i)}, values...))
+	}
+	table, err := parseResourceTable(testResTable([]string{"value"}, configs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := table.resolve(0x7f010000); len(got) == 0 || len(got) > maxResolvedEntries {
+		t.Fatalf("resolve() returned %d entries, want 1..%d", len(got), maxResolvedEntries)
+	}
+}
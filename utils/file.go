@@ -1,18 +1,18 @@
 package utils
 
 import (
-	"encoding/json"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"mime/multipart"
-	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/spf13/viper"
 )
 
@@ -31,58 +31,29 @@ func ValidateFileExtension(filename string, allowedExtensions []string) bool {
 }
 
 func SaveUploadedFile(file *multipart.FileHeader, destDir string) (string, error) {
-	ext := filepath.Ext(file.Filename)
-	newFileName := uuid.New().String() + ext
-
-	localBasePath := viper.GetString("storage.base_path")
-	localDestPath := filepath.Join(localBasePath, destDir)
-
-	if err := os.MkdirAll(localDestPath, os.ModePerm); err != nil {
-		return "", err
-	}
-	localFilePath := filepath.Join(localDestPath, newFileName)
-
 	src, err := file.Open()
 	if err != nil {
 		return "", err
 	}
 	defer src.Close()
 
-	dst, err := os.Create(localFilePath)
-	if err != nil {
-		return "", err
-	}
-	defer dst.Close()
-
-	if _, err = io.Copy(dst, src); err != nil {
-		return "", err
-	}
-
-	relativePath := filepath.ToSlash(filepath.Join(destDir, newFileName))
-	return relativePath, nil
+	return PutContent(destDir, filepath.Ext(file.Filename), src, file.Size, file.Header.Get("Content-Type"))
 }
 
-func DeleteFile(relativePath string) error {
-	localBasePath := viper.GetString("storage.base_path")
-	fullPath := filepath.Join(localBasePath, relativePath)
-
-	absBasePath, err := filepath.Abs(localBasePath)
-	if err != nil {
-		return err
-	}
-	absFullPath, err := filepath.Abs(fullPath)
-	if err != nil {
-		return err
+func PutContent(destDir, ext string, r io.ReadSeeker, size int64, contentType string) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
 	}
-	if !strings.HasPrefix(absFullPath, absBasePath) {
-		return fmt.Errorf("invalid file path for deletion: %s", relativePath)
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
 	}
+	key := filepath.ToSlash(filepath.Join(destDir, hex.EncodeToString(h.Sum(nil))+strings.ToLower(ext)))
 
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-		return nil
+	if err := DefaultStorage.Put(key, r, size, contentType); err != nil {
+		return "", err
 	}
-
-	return os.Remove(fullPath)
+	return key, nil
 }
 
 func FormatSizeUnits(bytes int64) string {
@@ -98,60 +69,63 @@ func FormatSizeUnits(bytes int64) string {
 	return fmt.Sprintf("%.2f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
 
-func GetUploadToken(path string) (string, error) {
-	apiURL := viper.GetString("file_server.api_url")
-	fullURL := fmt.Sprintf("%s/create/upload?path=%s", apiURL, url.QueryEscape(path))
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Get(fullURL)
+func DownloadFromStorage(key, destPath string) error {
+	src, err := DefaultStorage.Get(key)
 	if err != nil {
-		return "", fmt.Errorf("failed to connect to file server: %w", err)
+		return err
 	}
-	defer resp.Body.Close()
+	defer src.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("file server returned non-200 status: %d", resp.StatusCode)
+	dst, err := os.Create(destPath)
+	if err != nil {
+		return err
 	}
+	defer dst.Close()
 
-	var result struct {
-		Token string `json:"token"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", fmt.Errorf("failed to decode file server response: %w", err)
+	if _, err := io.Copy(dst, src); err != nil {
+		return fmt.Errorf("failed to read file from storage: %w", err)
 	}
+	return nil
+}
 
-	if result.Token == "" {
-		return "", fmt.Errorf("file server response did not contain a token")
+func FileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
 	}
+	defer f.Close()
 
-	return result.Token, nil
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-func GetDownloadToken(path string) (string, error) {
-	apiURL := viper.GetString("file_server.api_url")
-	fullURL := fmt.Sprintf("%s/create/download?path=%s", apiURL, url.QueryEscape(path))
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Get(fullURL)
-	if err != nil {
-		return "", fmt.Errorf("failed to connect to file server: %w", err)
-	}
-	defer resp.Body.Close()
+func SignFileServerCallback(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(viper.GetString("file_server.callback_secret")))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("file server returned non-200 status: %d", resp.StatusCode)
+func VerifyFileServerCallback(timestamp, signature string, body []byte) bool {
+	if viper.GetString("file_server.callback_secret") == "" || timestamp == "" || signature == "" {
+		return false
 	}
 
-	var result struct {
-		Token string `json:"token"`
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", fmt.Errorf("failed to decode file server response: %w", err)
+	tolerance := int64(viper.GetInt("file_server.callback_tolerance_seconds"))
+	if tolerance <= 0 {
+		tolerance = 300
 	}
-
-	if result.Token == "" {
-		return "", fmt.Errorf("file server response did not contain a token")
+	if diff := time.Now().Unix() - sent; diff > tolerance || diff < -tolerance {
+		return false
 	}
 
-	return result.Token, nil
+	return hmac.Equal([]byte(SignFileServerCallback(timestamp, body)), []byte(strings.ToLower(signature)))
 }
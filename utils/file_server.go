@@ -0,0 +1,409 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var ErrFileServerUnavailable = errors.New("file server is unavailable, circuit breaker open")
+
+type FileServerConfig struct {
+	BaseURL          string
+	Timeout          time.Duration
+	DownloadTimeout  time.Duration
+	Retries          int
+	RetryBackoff     time.Duration
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	TokenTTL         time.Duration
+	BatchConcurrency int
+}
+
+type FileServerStatusError struct {
+	Status int
+}
+
+func (e *FileServerStatusError) Error() string {
+	return fmt.Sprintf("file server returned non-200 status: %d", e.Status)
+}
+
+type cachedToken struct {
+	token   string
+	expires time.Time
+}
+
+type FileServerClient struct {
+	config   FileServerConfig
+	client   *http.Client
+	download *http.Client
+
+	mu               sync.Mutex
+	failures         int
+	openUntil        time.Time
+	probing          bool
+	tokens           map[string]cachedToken
+	batchUnsupported bool
+}
+
+var DefaultFileServer *FileServerClient
+
+func FileServerConfigured() bool {
+	return DefaultFileServer != nil
+}
+
+func fileServerDuration(key string, unit, def time.Duration) time.Duration {
+	if v := viper.GetInt("file_server." + key); v > 0 {
+		return time.Duration(v) * unit
+	}
+	return def
+}
+
+func InitFileServer() {
+	baseURL := viper.GetString("file_server.api_url")
+	if baseURL == "" {
+		DefaultFileServer = nil
+		return
+	}
+
+	retries := viper.GetInt("file_server.retries")
+	if !viper.IsSet("file_server.retries") {
+		retries = 2
+	}
+	DefaultFileServer = NewFileServerClient(FileServerConfig{
+		BaseURL:          baseURL,
+		Timeout:          fileServerDuration("timeout_seconds", time.Second, 10*time.Second),
+		DownloadTimeout:  fileServerDuration("download_timeout_minutes", time.Minute, 10*time.Minute),
+		Retries:          retries,
+		RetryBackoff:     fileServerDuration("retry_backoff_ms", time.Millisecond, 200*time.Millisecond),
+		BreakerThreshold: viper.GetInt("file_server.breaker_threshold"),
+		BreakerCooldown:  fileServerDuration("breaker_cooldown_seconds", time.Second, 30*time.Second),
+		TokenTTL:         fileServerDuration("token_ttl_seconds", time.Second, 5*time.Minute),
+		BatchConcurrency: viper.GetInt("file_server.batch_concurrency"),
+	})
+}
+
+func NewFileServerClient(config FileServerConfig) *FileServerClient {
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.DownloadTimeout <= 0 {
+		config.DownloadTimeout = 10 * time.Minute
+	}
+	if config.Retries < 0 {
+		config.Retries = 0
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = 200 * time.Millisecond
+	}
+	if config.BreakerThreshold <= 0 {
+		config.BreakerThreshold = 5
+	}
+	if config.BreakerCooldown <= 0 {
+		config.BreakerCooldown = 30 * time.Second
+	}
+	if config.TokenTTL <= 0 {
+		config.TokenTTL = 5 * time.Minute
+	}
+	if config.BatchConcurrency <= 0 {
+		config.BatchConcurrency = 4
+	}
+	return &FileServerClient{
+		config:   config,
+		client:   &http.Client{Timeout: config.Timeout},
+		download: &http.Client{Timeout: config.DownloadTimeout},
+		tokens:   map[string]cachedToken{},
+	}
+}
+
+func retryableFileServerError(err error) bool {
+	var status *FileServerStatusError
+	if errors.As(err, &status) {
+		return status.Status >= 500 || status.Status == http.StatusTooManyRequests
+	}
+	return !errors.Is(err, ErrFileServerUnavailable)
+}
+
+func (f *FileServerClient) allow() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.openUntil.IsZero() {
+		return nil
+	}
+	if time.Now().Before(f.openUntil) || f.probing {
+		return ErrFileServerUnavailable
+	}
+	f.probing = true
+	return nil
+}
+
+func (f *FileServerClient) record(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.probing = false
+	if err == nil || !retryableFileServerError(err) {
+		f.failures = 0
+		f.openUntil = time.Time{}
+		return
+	}
+	f.failures++
+	if f.failures >= f.config.BreakerThreshold {
+		f.openUntil = time.Now().Add(f.config.BreakerCooldown)
+	}
+}
+
+func (f *FileServerClient) BreakerOpen() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !f.openUntil.IsZero() && time.Now().Before(f.openUntil)
+}
+
+func (f *FileServerClient) endpoint(path string, query url.Values) string {
+	endpoint := f.config.BaseURL + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	return endpoint
+}
+
+func (f *FileServerClient) call(client *http.Client, method, path string, query url.Values, body []byte, handle func(*http.Response) error) error {
+	if err := f.allow(); err != nil {
+		return err
+	}
+
+	var err error
+	for attempt := 0; attempt <= f.config.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(f.config.RetryBackoff << (attempt - 1))
+		}
+		err = f.once(client, method, f.endpoint(path, query), body, handle)
+		if err == nil || !retryableFileServerError(err) {
+			break
+		}
+	}
+	f.record(err)
+	return err
+}
+
+func (f *FileServerClient) once(client *http.Client, method, endpoint string, body []byte, handle func(*http.Response) error) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, endpoint, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to connect to file server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		return &FileServerStatusError{Status: resp.StatusCode}
+	}
+	return handle(resp)
+}
+
+type fileServerTokenResponse struct {
+	Token     string `json:"token"`
+	ExpiresIn int64  `json:"expires_in"`
+}
+
+func (f *FileServerClient) tokenTTL(expiresIn int64) time.Duration {
+	ttl := f.config.TokenTTL
+	if expiresIn > 0 {
+		ttl = time.Duration(expiresIn) * time.Second
+	}
+	return ttl * 9 / 10
+}
+
+func (f *FileServerClient) requestToken(kind, path string) (fileServerTokenResponse, error) {
+	var result fileServerTokenResponse
+	err := f.call(f.client, http.MethodGet, "/create/"+kind, url.Values{"path": {path}}, nil, func(resp *http.Response) error {
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return fmt.Errorf("failed to decode file server response: %w", err)
+		}
+		if result.Token == "" {
+			return fmt.Errorf("file server response did not contain a token")
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (f *FileServerClient) UploadToken(path string) (string, error) {
+	result, err := f.requestToken("upload", path)
+	return result.Token, err
+}
+
+func (f *FileServerClient) cachedDownloadToken(path string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cached, ok := f.tokens[path]
+	if !ok || time.Now().After(cached.expires) {
+		delete(f.tokens, path)
+		return "", false
+	}
+	return cached.token, true
+}
+
+func (f *FileServerClient) cacheDownloadToken(path, token string, expiresIn int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tokens[path] = cachedToken{token: token, expires: time.Now().Add(f.tokenTTL(expiresIn))}
+}
+
+func (f *FileServerClient) ForgetDownloadToken(path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.tokens, path)
+}
+
+func (f *FileServerClient) DownloadToken(path string) (string, error) {
+	if token, ok := f.cachedDownloadToken(path); ok {
+		return token, nil
+	}
+	result, err := f.requestToken("download", path)
+	if err != nil {
+		return "", err
+	}
+	f.cacheDownloadToken(path, result.Token, result.ExpiresIn)
+	return result.Token, nil
+}
+
+func (f *FileServerClient) DownloadTokens(paths []string) (map[string]string, error) {
+	tokens := map[string]string{}
+	seen := map[string]bool{}
+	var missing []string
+	for _, path := range paths {
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		if token, ok := f.cachedDownloadToken(path); ok {
+			tokens[path] = token
+			continue
+		}
+		missing = append(missing, path)
+	}
+	if len(missing) == 0 {
+		return tokens, nil
+	}
+
+	f.mu.Lock()
+	batch := !f.batchUnsupported
+	f.mu.Unlock()
+	if batch {
+		err := f.batchDownloadTokens(missing, tokens)
+		var status *FileServerStatusError
+		if errors.As(err, &status) && (status.Status == http.StatusNotFound || status.Status == http.StatusMethodNotAllowed || status.Status == http.StatusNotImplemented) {
+			f.mu.Lock()
+			f.batchUnsupported = true
+			f.mu.Unlock()
+		} else {
+			return tokens, err
+		}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	sem := make(chan struct{}, f.config.BatchConcurrency)
+	for _, path := range missing {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(path string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			token, err := f.DownloadToken(path)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("%s: %w", path, err)
+				}
+				return
+			}
+			tokens[path] = token
+		}(path)
+	}
+	wg.Wait()
+	return tokens, firstErr
+}
+
+func (f *FileServerClient) batchDownloadTokens(paths []string, tokens map[string]string) error {
+	body, _ := json.Marshal(map[string][]string{"paths": paths})
+	var result struct {
+		Tokens    map[string]string `json:"tokens"`
+		ExpiresIn int64             `json:"expires_in"`
+	}
+	err := f.call(f.client, http.MethodPost, "/create/download/batch", nil, body, func(resp *http.Response) error {
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return fmt.Errorf("failed to decode file server response: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, path := range paths {
+		token := result.Tokens[path]
+		if token == "" {
+			missing = append(missing, path)
+			continue
+		}
+		tokens[path] = token
+		f.cacheDownloadToken(path, token, result.ExpiresIn)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("file server returned no token for %d of %d paths", len(missing), len(paths))
+	}
+	return nil
+}
+
+func (f *FileServerClient) DownloadURL(token string) string {
+	return f.endpoint("/download", url.Values{"token": {token}})
+}
+
+func (f *FileServerClient) Download(path, destPath string) error {
+	token, err := f.DownloadToken(path)
+	if err != nil {
+		return err
+	}
+
+	err = f.call(f.download, http.MethodGet, "/download", url.Values{"token": {token}}, nil, func(resp *http.Response) error {
+		dst, err := os.Create(destPath)
+		if err != nil {
+			return err
+		}
+		defer dst.Close()
+		if _, err := io.Copy(dst, resp.Body); err != nil {
+			return fmt.Errorf("failed to download file: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		f.ForgetDownloadToken(path)
+	}
+	return err
+}
@@ -0,0 +1,227 @@
+package utils
+
+import (
+	"errors"
+	"market-api/utils/filetest"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testFileServerClient(baseURL string) *FileServerClient {
+	return NewFileServerClient(FileServerConfig{BaseURL: baseURL, Retries: 2, RetryBackoff: time.Millisecond})
+}
+
+func TestFileServerRetriesTransientFailures(t *testing.T) {
+	fake := filetest.StartServer()
+	defer fake.Close()
+	client := NewFileServerClient(FileServerConfig{BaseURL: fake.URL, Retries: 2, RetryBackoff: time.Millisecond})
+
+	fake.FailNext(2)
+	token, err := client.UploadToken("apks/1.apk")
+	if err != nil || token == "" {
+		t.Fatalf("UploadToken() = %q, %v", token, err)
+	}
+	if fake.Requests() != 3 {
+		t.Fatalf("requests = %d, want 3", fake.Requests())
+	}
+
+	fake.FailNext(3)
+	_, err = client.UploadToken("apks/1.apk")
+	var status *FileServerStatusError
+	if !errors.As(err, &status) || status.Status != http.StatusServiceUnavailable {
+		t.Fatalf("UploadToken() error = %v, want 503", err)
+	}
+	if fake.Requests() != 6 {
+		t.Fatalf("requests = %d, want 6", fake.Requests())
+	}
+}
+
+func TestFileServerDoesNotRetryClientErrors(t *testing.T) {
+	fake := filetest.StartServer()
+	defer fake.Close()
+	client := NewFileServerClient(FileServerConfig{BaseURL: fake.URL, Retries: 2, RetryBackoff: time.Millisecond, BreakerThreshold: 1})
+
+	_, err := client.DownloadToken("apks/missing.apk")
+	var status *FileServerStatusError
+	if !errors.As(err, &status) || status.Status != http.StatusNotFound {
+		t.Fatalf("DownloadToken() error = %v, want 404", err)
+	}
+	if fake.Requests() != 1 {
+		t.Fatalf("requests = %d, want 1", fake.Requests())
+	}
+	if client.BreakerOpen() {
+		t.Fatal("client errors must not open the breaker")
+	}
+}
+
+func TestFileServerBreaker(t *testing.T) {
+	fake := filetest.StartServer()
+	defer fake.Close()
+	client := NewFileServerClient(FileServerConfig{
+		BaseURL:          fake.URL,
+		Retries:          0,
+		BreakerThreshold: 2,
+		BreakerCooldown:  50 * time.Millisecond,
+	})
+
+	fake.FailNext(2)
+	for i := 0; i < 2; i++ {
+		if _, err := client.UploadToken("apks/1.apk"); err == nil {
+			t.Fatalf("call %d succeeded, want failure", i+1)
+		}
+	}
+	if !client.BreakerOpen() {
+		t.Fatal("breaker should be open after reaching the threshold")
+	}
+	if _, err := client.UploadToken("apks/1.apk"); !errors.Is(err, ErrFileServerUnavailable) {
+		t.Fatalf("UploadToken() error = %v, want ErrFileServerUnavailable", err)
+	}
+	if fake.Requests() != 2 {
+		t.Fatalf("requests = %d, want 2 while the breaker is open", fake.Requests())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, err := client.UploadToken("apks/1.apk"); err != nil {
+		t.Fatalf("probe after cooldown failed: %v", err)
+	}
+	if client.BreakerOpen() {
+		t.Fatal("breaker should close after a successful probe")
+	}
+}
+
+func TestFileServerBreakerReopensOnFailedProbe(t *testing.T) {
+	fake := filetest.StartServer()
+	defer fake.Close()
+	client := NewFileServerClient(FileServerConfig{
+		BaseURL:          fake.URL,
+		Retries:          0,
+		BreakerThreshold: 1,
+		BreakerCooldown:  50 * time.Millisecond,
+	})
+
+	fake.FailNext(2)
+	client.UploadToken("apks/1.apk")
+	time.Sleep(60 * time.Millisecond)
+	if _, err := client.UploadToken("apks/1.apk"); err == nil || errors.Is(err, ErrFileServerUnavailable) {
+		t.Fatalf("probe error = %v, want server failure", err)
+	}
+	if !client.BreakerOpen() {
+		t.Fatal("breaker should reopen after a failed probe")
+	}
+}
+
+func TestFileServerDownloadTokenCache(t *testing.T) {
+	fake := filetest.StartServer()
+	defer fake.Close()
+	fake.Put("apks/1.apk", []byte("apk"))
+	client := testFileServerClient(fake.URL)
+
+	first, err := client.DownloadToken("apks/1.apk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := client.DownloadToken("apks/1.apk")
+	if err != nil || second != first {
+		t.Fatalf("DownloadToken() = %q, %v; want cached %q", second, err, first)
+	}
+	if fake.Requests() != 1 {
+		t.Fatalf("requests = %d, want 1", fake.Requests())
+	}
+
+	client.ForgetDownloadToken("apks/1.apk")
+	third, err := client.DownloadToken("apks/1.apk")
+	if err != nil || third == first {
+		t.Fatalf("DownloadToken() after forget = %q, %v; want a new token", third, err)
+	}
+	if fake.Requests() != 2 {
+		t.Fatalf("requests = %d, want 2", fake.Requests())
+	}
+}
+
+func TestFileServerDownloadTokenExpires(t *testing.T) {
+	fake := filetest.StartServer()
+	defer fake.Close()
+	fake.Put("apks/1.apk", []byte("apk"))
+	client := testFileServerClient(fake.URL)
+
+	client.DownloadToken("apks/1.apk")
+	client.mu.Lock()
+	client.tokens["apks/1.apk"] = cachedToken{token: "stale", expires: time.Now().Add(-time.Second)}
+	client.mu.Unlock()
+
+	token, err := client.DownloadToken("apks/1.apk")
+	if err != nil || token == "stale" {
+		t.Fatalf("DownloadToken() = %q, %v; want a fresh token", token, err)
+	}
+	if fake.Requests() != 2 {
+		t.Fatalf("requests = %d, want 2", fake.Requests())
+	}
+}
+
+func TestFileServerDownloadTokensBatch(t *testing.T) {
+	fake := filetest.StartServer()
+	defer fake.Close()
+	fake.Put("apks/1.apk", []byte("one"))
+	fake.Put("apks/2.apk", []byte("two"))
+	client := testFileServerClient(fake.URL)
+
+	cached, _ := client.DownloadToken("apks/1.apk")
+	tokens, err := client.DownloadTokens([]string{"apks/1.apk", "apks/2.apk", "apks/2.apk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens["apks/1.apk"] != cached || tokens["apks/2.apk"] == "" {
+		t.Fatalf("DownloadTokens() = %v", tokens)
+	}
+	if fake.Requests() != 2 {
+		t.Fatalf("requests = %d, want 2", fake.Requests())
+	}
+}
+
+func TestFileServerDownloadTokensFallsBackWithoutBatch(t *testing.T) {
+	fake := filetest.NewServer()
+	fake.Put("apks/1.apk", []byte("one"))
+	fake.Put("apks/2.apk", []byte("two"))
+	batchCalls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/create/download/batch" {
+			batchCalls++
+			http.NotFound(w, r)
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	client := NewFileServerClient(FileServerConfig{BaseURL: server.URL, Retries: 0})
+
+	for i := 0; i < 2; i++ {
+		client.ForgetDownloadToken("apks/1.apk")
+		client.ForgetDownloadToken("apks/2.apk")
+		tokens, err := client.DownloadTokens([]string{"apks/1.apk", "apks/2.apk"})
+		if err != nil || len(tokens) != 2 {
+			t.Fatalf("DownloadTokens() = %v, %v", tokens, err)
+		}
+	}
+	if batchCalls != 1 {
+		t.Fatalf("batch endpoint called %d times, want 1", batchCalls)
+	}
+}
+
+func TestFileServerDownload(t *testing.T) {
+	fake := filetest.StartServer()
+	defer fake.Close()
+	fake.Put("apks/1.apk", []byte("apk contents"))
+	client := testFileServerClient(fake.URL)
+
+	dest := filepath.Join(t.TempDir(), "1.apk")
+	if err := client.Download("apks/1.apk", dest); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(dest); string(data) != "apk contents" {
+		t.Fatalf("downloaded %q", data)
+	}
+}
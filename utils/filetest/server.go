@@ -0,0 +1,184 @@
+package filetest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type serverToken struct {
+	kind    string
+	path    string
+	expires time.Time
+}
+
+type Server struct {
+	URL      string
+	TokenTTL time.Duration
+
+	mu       sync.Mutex
+	files    map[string][]byte
+	tokens   map[string]serverToken
+	failNext int
+	requests int
+	server   *httptest.Server
+}
+
+func NewServer() *Server {
+	return &Server{
+		TokenTTL: 5 * time.Minute,
+		files:    map[string][]byte{},
+		tokens:   map[string]serverToken{},
+	}
+}
+
+func StartServer() *Server {
+	fake := NewServer()
+	fake.server = httptest.NewServer(fake)
+	fake.URL = fake.server.URL
+	return fake
+}
+
+func (s *Server) Close() {
+	if s.server != nil {
+		s.server.Close()
+	}
+}
+
+func (s *Server) Put(path string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[path] = append([]byte(nil), data...)
+}
+
+func (s *Server) File(path string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[path]
+	return data, ok
+}
+
+func (s *Server) FailNext(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failNext = n
+}
+
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *Server) issueToken(kind, path string) string {
+	token := uuid.New().String()
+	s.tokens[token] = serverToken{kind: kind, path: path, expires: time.Now().Add(s.TokenTTL)}
+	return token
+}
+
+func (s *Server) takeToken(kind, token string) (string, bool) {
+	t, ok := s.tokens[token]
+	if !ok || t.kind != kind || time.Now().After(t.expires) {
+		return "", false
+	}
+	if kind == "upload" {
+		delete(s.tokens, token)
+	}
+	return t.path, true
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests++
+	if s.failNext > 0 {
+		s.failNext--
+		s.mu.Unlock()
+		http.Error(w, "injected failure", http.StatusServiceUnavailable)
+		return
+	}
+	s.mu.Unlock()
+
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/create/upload":
+		s.mu.Lock()
+		token := s.issueToken("upload", query.Get("path"))
+		s.mu.Unlock()
+		s.writeJSON(w, map[string]interface{}{"token": token, "expires_in": int64(s.TokenTTL / time.Second)})
+
+	case r.Method == http.MethodGet && r.URL.Path == "/create/download":
+		s.mu.Lock()
+		_, exists := s.files[query.Get("path")]
+		token := ""
+		if exists {
+			token = s.issueToken("download", query.Get("path"))
+		}
+		s.mu.Unlock()
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		s.writeJSON(w, map[string]interface{}{"token": token, "expires_in": int64(s.TokenTTL / time.Second)})
+
+	case r.Method == http.MethodPost && r.URL.Path == "/create/download/batch":
+		var req struct {
+			Paths []string `json:"paths"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tokens := map[string]string{}
+		s.mu.Lock()
+		for _, path := range req.Paths {
+			if _, exists := s.files[path]; exists {
+				tokens[path] = s.issueToken("download", path)
+			}
+		}
+		s.mu.Unlock()
+		s.writeJSON(w, map[string]interface{}{"tokens": tokens, "expires_in": int64(s.TokenTTL / time.Second)})
+
+	case r.Method == http.MethodGet && r.URL.Path == "/download":
+		s.mu.Lock()
+		path, ok := s.takeToken("download", query.Get("token"))
+		data := s.files[path]
+		s.mu.Unlock()
+		if !ok {
+			http.Error(w, "invalid token", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(data)
+
+	case (r.Method == http.MethodPost || r.Method == http.MethodPut) && r.URL.Path == "/upload":
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		path, ok := s.takeToken("upload", query.Get("token"))
+		if ok {
+			s.files[path] = data
+		}
+		s.mu.Unlock()
+		if !ok {
+			http.Error(w, "invalid token", http.StatusForbidden)
+			return
+		}
+		s.writeJSON(w, map[string]interface{}{"path": path, "size": len(data)})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
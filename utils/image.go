@@ -0,0 +1,325 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/spf13/viper"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+var ErrInvalidImage = errors.New("invalid image")
+
+type ImageSpec struct {
+	Square    bool
+	MinWidth  int
+	MinHeight int
+	Widths    []int
+	WebP      bool
+}
+
+type ImageVariant struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Format string `json:"format"`
+	URL    string `json:"url"`
+}
+
+type ProcessedImage struct {
+	Key      string
+	URL      string
+	Width    int
+	Height   int
+	Format   string
+	Variants []ImageVariant
+}
+
+var imageFormats = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+	"image/webp": "webp",
+}
+
+var imageExtensions = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"webp": ".webp",
+}
+
+func imageInt(key string, def int) int {
+	if v := viper.GetInt("image." + key); v > 0 {
+		return v
+	}
+	return def
+}
+
+func imageWidths(key string, def []int) []int {
+	if widths := viper.GetIntSlice("image." + key); len(widths) > 0 {
+		return widths
+	}
+	return def
+}
+
+func IconImageSpec() ImageSpec {
+	size := imageInt("icon_min_size", 96)
+	return ImageSpec{
+		Square:    true,
+		MinWidth:  size,
+		MinHeight: size,
+		Widths:    imageWidths("icon_sizes", []int{48, 96, 192}),
+		WebP:      true,
+	}
+}
+
+func ScreenshotImageSpec() ImageSpec {
+	return ImageSpec{
+		MinWidth:  imageInt("screenshot_min_size", 200),
+		MinHeight: imageInt("screenshot_min_size", 200),
+		Widths:    imageWidths("screenshot_widths", []int{360, 720}),
+		WebP:      true,
+	}
+}
+
+func PlainImageSpec() ImageSpec {
+	return ImageSpec{}
+}
+
+func ProcessUploadedImage(file *multipart.FileHeader, destDir string, spec ImageSpec) (*ProcessedImage, error) {
+	maxBytes := int64(imageInt("max_upload_mb", 10)) << 20
+	if file.Size > maxBytes {
+		return nil, fmt.Errorf("%w: file larger than %d MB", ErrInvalidImage, maxBytes>>20)
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	data, err := io.ReadAll(io.LimitReader(src, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, fmt.Errorf("%w: file larger than %d MB", ErrInvalidImage, maxBytes>>20)
+	}
+
+	img, format, err := DecodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if width < spec.MinWidth || height < spec.MinHeight {
+		return nil, fmt.Errorf("%w: image is %dx%d, minimum is %dx%d", ErrInvalidImage, width, height, spec.MinWidth, spec.MinHeight)
+	}
+	if spec.Square && absInt(width-height)*100 > width {
+		return nil, fmt.Errorf("%w: image must be square, got %dx%d", ErrInvalidImage, width, height)
+	}
+
+	result := &ProcessedImage{Width: width, Height: height, Format: format}
+	put := func(img image.Image, format string) (string, error) {
+		encoded, err := encodeImage(img, format)
+		if err != nil {
+			return "", err
+		}
+		return PutContent(destDir, imageExtensions[format], bytes.NewReader(encoded), int64(len(encoded)), "image/"+format)
+	}
+
+	key, err := put(img, format)
+	if err != nil {
+		return nil, err
+	}
+	result.Key = key
+	result.URL = DefaultStorage.URL(key)
+	if spec.WebP && format != "webp" {
+		key, err := put(img, "webp")
+		if err != nil {
+			return nil, err
+		}
+		result.Variants = append(result.Variants, ImageVariant{Width: width, Height: height, Format: "webp", URL: DefaultStorage.URL(key)})
+	}
+
+	for _, target := range spec.Widths {
+		if target <= 0 || target >= width {
+			continue
+		}
+		resized := resizeImage(img, target, height*target/width)
+		size := resized.Bounds()
+		formats := []string{format}
+		if spec.WebP && format != "webp" {
+			formats = append(formats, "webp")
+		}
+		for _, variantFormat := range formats {
+			key, err := put(resized, variantFormat)
+			if err != nil {
+				return nil, err
+			}
+			result.Variants = append(result.Variants, ImageVariant{Width: size.Dx(), Height: size.Dy(), Format: variantFormat, URL: DefaultStorage.URL(key)})
+		}
+	}
+
+	return result, nil
+}
+
+func DecodeImage(data []byte) (image.Image, string, error) {
+	format, ok := imageFormats[http.DetectContentType(data)]
+	if !ok {
+		return nil, "", fmt.Errorf("%w: unsupported content type %s", ErrInvalidImage, http.DetectContentType(data))
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+	maxPixels := imageInt("max_pixels", 40000000)
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxPixels {
+		return nil, "", fmt.Errorf("%w: image dimensions %dx%d not allowed", ErrInvalidImage, config.Width, config.Height)
+	}
+
+	img, decodedFormat, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+	if decodedFormat != format {
+		return nil, "", fmt.Errorf("%w: content type %s does not match decoded format %s", ErrInvalidImage, format, decodedFormat)
+	}
+	if format == "jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+	return img, format, nil
+}
+
+func encodeImage(img image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: imageInt("jpeg_quality", 88)})
+	case "png":
+		err = png.Encode(&buf, img)
+	case "webp":
+		err = nativewebp.Encode(&buf, img, nil)
+	default:
+		err = fmt.Errorf("unsupported output format %s", format)
+	}
+	return buf.Bytes(), err
+}
+
+func resizeImage(img image.Image, width, height int) image.Image {
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return dst
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && len(segment) > 14 && string(segment[:6]) == "Exif\x00\x00" {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := int(order.Uint32(tiff[4:]))
+	if offset+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if v := int(order.Uint16(tiff[entry+8:])); v >= 1 && v <= 8 {
+				return v
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,298 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var (
+	testRed  = color.NRGBA{R: 255, A: 255}
+	testBlue = color.NRGBA{B: 255, A: 255}
+)
+
+func testSplitImage(width, height int) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if x < width/2 {
+				img.Set(x, y, testRed)
+			} else {
+				img.Set(x, y, testBlue)
+			}
+		}
+	}
+	return img
+}
+
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testSplitImage(width, height)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testJPEG(t *testing.T, width, height, orientation int, order binary.ByteOrder) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testSplitImage(width, height), &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if orientation == 0 {
+		return data
+	}
+
+	tiff := make([]byte, 26)
+	if order == binary.BigEndian {
+		copy(tiff, "MM")
+	} else {
+		copy(tiff, "II")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], 0x0112)
+	order.PutUint16(tiff[12:], 3)
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], uint16(orientation))
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+	return append(append(append([]byte{}, data[:2]...), app1...), data[2:]...)
+}
+
+func testFileHeader(t *testing.T, name, contentType string, data []byte) *multipart.FileHeader {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	header := make(map[string][]string)
+	header["Content-Disposition"] = []string{`form-data; name="file"; filename="` + name + `"`}
+	header["Content-Type"] = []string{contentType}
+	part, err := w.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	w.Close()
+
+	form, err := multipart.NewReader(&body, w.Boundary()).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { form.RemoveAll() })
+	return form.File["file"][0]
+}
+
+func useTestStorage(t *testing.T) string {
+	t.Helper()
+	base := t.TempDir()
+	previous := DefaultStorage
+	DefaultStorage = NewLocalStorage(base, "http://localhost/storage")
+	t.Cleanup(func() { DefaultStorage = previous })
+	return base
+}
+
+func sameColor(c color.Color, want color.NRGBA) bool {
+	r, g, b, _ := c.RGBA()
+	wr, wg, wb, _ := want.RGBA()
+	near := func(a, b uint32) bool { return a>>8 <= b>>8+24 && b>>8 <= a>>8+24 }
+	return near(r, wr) && near(g, wg) && near(b, wb)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"no exif", testJPEG(t, 8, 8, 0, nil), 1},
+		{"little endian", testJPEG(t, 8, 8, 6, binary.LittleEndian), 6},
+		{"big endian", testJPEG(t, 8, 8, 8, binary.BigEndian), 8},
+		{"out of range", testJPEG(t, 8, 8, 9, binary.LittleEndian), 1},
+		{"png", testPNG(t, 8, 8), 1},
+		{"truncated", testJPEG(t, 8, 8, 6, binary.LittleEndian)[:20], 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := jpegOrientation(tc.data); got != tc.want {
+				t.Fatalf("jpegOrientation() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDecodeImage(t *testing.T) {
+	cases := []struct {
+		name   string
+		data   []byte
+		format string
+		width  int
+		height int
+		top    color.NRGBA
+		bottom color.NRGBA
+	}{
+		{"png", testPNG(t, 32, 16), "png", 32, 16, testRed, testRed},
+		{"jpeg", testJPEG(t, 32, 16, 0, nil), "jpeg", 32, 16, testRed, testRed},
+		{"jpeg rotated 90", testJPEG(t, 32, 16, 6, binary.LittleEndian), "jpeg", 16, 32, testRed, testBlue},
+		{"jpeg rotated 270", testJPEG(t, 32, 16, 8, binary.BigEndian), "jpeg", 16, 32, testBlue, testRed},
+		{"jpeg rotated 180", testJPEG(t, 32, 16, 3, binary.LittleEndian), "jpeg", 32, 16, testBlue, testBlue},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			img, format, err := DecodeImage(tc.data)
+			if err != nil {
+				t.Fatalf("DecodeImage() error = %v", err)
+			}
+			b := img.Bounds()
+			if format != tc.format || b.Dx() != tc.width || b.Dy() != tc.height {
+				t.Fatalf("DecodeImage() = %s %dx%d, want %s %dx%d", format, b.Dx(), b.Dy(), tc.format, tc.width, tc.height)
+			}
+			if top := img.At(b.Min.X+2, b.Min.Y+2); !sameColor(top, tc.top) {
+				t.Fatalf("top left pixel = %v, want %v", top, tc.top)
+			}
+			if bottom := img.At(b.Min.X+2, b.Max.Y-3); !sameColor(bottom, tc.bottom) {
+				t.Fatalf("bottom left pixel = %v, want %v", bottom, tc.bottom)
+			}
+		})
+	}
+}
+
+func TestDecodeImageRejects(t *testing.T) {
+	pngData := testPNG(t, 16, 16)
+	var gif bytes.Buffer
+	gif.WriteString("GIF89a")
+	gif.Write(make([]byte, 32))
+
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{"html", []byte("<!DOCTYPE html><html><body>not an image</body></html>")},
+		{"gif", gif.Bytes()},
+		{"truncated png", pngData[:40]},
+		{"corrupt jpeg", append([]byte{0xFF, 0xD8, 0xFF, 0xE0}, bytes.Repeat([]byte{0x00}, 64)...)},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, _, err := DecodeImage(tc.data); !errors.Is(err, ErrInvalidImage) {
+				t.Fatalf("DecodeImage() error = %v, want ErrInvalidImage", err)
+			}
+		})
+	}
+}
+
+func TestProcessUploadedImage(t *testing.T) {
+	type variant struct {
+		width  int
+		format string
+	}
+	cases := []struct {
+		name        string
+		filename    string
+		contentType string
+		data        []byte
+		spec        ImageSpec
+		err         bool
+		format      string
+		ext         string
+		variants    []variant
+	}{
+		{
+			name: "icon png", filename: "icon.png", contentType: "image/png",
+			data: testPNG(t, 200, 200), spec: IconImageSpec(), format: "png", ext: ".png",
+			variants: []variant{{200, "webp"}, {48, "png"}, {48, "webp"}, {96, "png"}, {96, "webp"}, {192, "png"}, {192, "webp"}},
+		},
+		{
+			name: "png renamed to jpg", filename: "icon.jpg", contentType: "image/jpeg",
+			data: testPNG(t, 100, 100), spec: IconImageSpec(), format: "png", ext: ".png",
+			variants: []variant{{100, "webp"}, {48, "png"}, {48, "webp"}, {96, "png"}, {96, "webp"}},
+		},
+		{
+			name: "nearly square icon", filename: "icon.png", contentType: "image/png",
+			data: testPNG(t, 101, 100), spec: IconImageSpec(), format: "png", ext: ".png",
+			variants: []variant{{101, "webp"}, {48, "png"}, {48, "webp"}, {96, "png"}, {96, "webp"}},
+		},
+		{
+			name: "screenshot jpeg", filename: "shot.jpeg", contentType: "image/jpeg",
+			data: testJPEG(t, 800, 400, 0, nil), spec: ScreenshotImageSpec(), format: "jpeg", ext: ".jpg",
+			variants: []variant{{800, "webp"}, {360, "jpeg"}, {360, "webp"}, {720, "jpeg"}, {720, "webp"}},
+		},
+		{
+			name: "plain image", filename: "banner.png", contentType: "image/png",
+			data: testPNG(t, 40, 20), spec: PlainImageSpec(), format: "png", ext: ".png",
+		},
+		{name: "not square", filename: "icon.png", contentType: "image/png", data: testPNG(t, 200, 150), spec: IconImageSpec(), err: true},
+		{name: "too small", filename: "icon.png", contentType: "image/png", data: testPNG(t, 64, 64), spec: IconImageSpec(), err: true},
+		{name: "screenshot too small", filename: "shot.png", contentType: "image/png", data: testPNG(t, 400, 150), spec: ScreenshotImageSpec(), err: true},
+		{name: "html labelled as png", filename: "icon.png", contentType: "image/png", data: []byte("<html><body>icon</body></html>"), spec: PlainImageSpec(), err: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			base := useTestStorage(t)
+			result, err := ProcessUploadedImage(testFileHeader(t, tc.filename, tc.contentType, tc.data), "images/test", tc.spec)
+			if tc.err {
+				if !errors.Is(err, ErrInvalidImage) {
+					t.Fatalf("ProcessUploadedImage() error = %v, want ErrInvalidImage", err)
+				}
+				if entries, _ := os.ReadDir(filepath.Join(base, "images/test")); len(entries) != 0 {
+					t.Fatalf("rejected upload left %d files behind", len(entries))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ProcessUploadedImage() error = %v", err)
+			}
+			if result.Format != tc.format || filepath.Ext(result.Key) != tc.ext || !strings.HasPrefix(result.Key, "images/test/") {
+				t.Fatalf("ProcessUploadedImage() = %s %s", result.Format, result.Key)
+			}
+			if result.URL != "http://localhost/storage/"+result.Key {
+				t.Fatalf("URL = %s", result.URL)
+			}
+			stored, err := os.ReadFile(filepath.Join(base, result.Key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mime := http.DetectContentType(stored); mime != "image/"+tc.format {
+				t.Fatalf("stored original sniffs as %s", mime)
+			}
+
+			if len(result.Variants) != len(tc.variants) {
+				t.Fatalf("variants = %+v, want %d", result.Variants, len(tc.variants))
+			}
+			for i, want := range tc.variants {
+				got := result.Variants[i]
+				wantHeight := result.Height * want.width / result.Width
+				if got.Width != want.width || got.Height != wantHeight || got.Format != want.format {
+					t.Fatalf("variant %d = %+v, want %dx%d %s", i, got, want.width, wantHeight, want.format)
+				}
+				key := strings.TrimPrefix(got.URL, "http://localhost/storage/")
+				if filepath.Ext(key) != imageExtensions[want.format] {
+					t.Fatalf("variant %d key = %s", i, key)
+				}
+				data, err := os.ReadFile(filepath.Join(base, key))
+				if err != nil {
+					t.Fatal(err)
+				}
+				config, format, err := image.DecodeConfig(bytes.NewReader(data))
+				if err != nil || format != want.format || config.Width != got.Width || config.Height != got.Height {
+					t.Fatalf("variant %d decodes as %s %dx%d, %v", i, format, config.Width, config.Height, err)
+				}
+			}
+		})
+	}
+}
@@ -1,6 +1,10 @@
 package utils
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"market-api/models"
@@ -10,16 +14,34 @@ import (
 	"github.com/spf13/viper"
 )
 
-var jwtSecret = []byte(viper.GetString("jwt.secret"))
+const (
+	TwoFactorChallengePurpose = "2fa_challenge"
+	ChallengeTokenLifetime    = 5 * time.Minute
+)
 
 type Claims struct {
-	UserID int `json:"user_id"`
+	UserID  int    `json:"user_id"`
+	Purpose string `json:"purpose,omitempty"`
 	jwt.RegisteredClaims
 }
 
+func AccessTokenLifetime() time.Duration {
+	expireMinutes := viper.GetInt("jwt.access_expire_minutes")
+	if expireMinutes <= 0 {
+		expireMinutes = 15
+	}
+	return time.Duration(expireMinutes) * time.Minute
+}
+
+func MaxSignedTokenLifetime() time.Duration {
+	if lifetime := AccessTokenLifetime(); lifetime > ChallengeTokenLifetime {
+		return lifetime
+	}
+	return ChallengeTokenLifetime
+}
+
 func GenerateToken(user *models.User, tokenID int) (string, error) {
-	expireHours := viper.GetInt("jwt.expire_hours")
-	expirationTime := time.Now().Add(time.Duration(expireHours) * time.Hour)
+	expirationTime := time.Now().Add(AccessTokenLifetime())
 
 	claims := &Claims{
 		UserID: user.ID,
@@ -31,17 +53,40 @@ func GenerateToken(user *models.User, tokenID int) (string, error) {
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return signClaims(claims)
+}
+
+func GenerateChallengeToken(user *models.User) (string, error) {
+	claims := &Claims{
+		UserID:  user.ID,
+		Purpose: TwoFactorChallengePurpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ChallengeTokenLifetime)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Issuer:    "sine-market",
+		},
+	}
+
+	return signClaims(claims)
+}
+
+func GenerateOpaqueToken() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	return token, HashOpaqueToken(token), nil
+}
+
+func HashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
 
 func ParseToken(tokenString string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return jwtSecret, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, verificationKey,
+		jwt.WithValidMethods(SupportedJWTAlgorithms))
 
 	if err != nil {
 		return nil, err
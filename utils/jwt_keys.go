@@ -0,0 +1,188 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"market-api/models"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const LegacyJWTKeyID = "legacy"
+
+var SupportedJWTAlgorithms = []string{"HS256", "EdDSA", "RS256"}
+
+type signingKey struct {
+	kid       string
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+type jwtKeyring struct {
+	mu     sync.RWMutex
+	keys   map[string]*signingKey
+	active *signingKey
+}
+
+var keyring = &jwtKeyring{keys: map[string]*signingKey{}}
+
+func GenerateJWTKeyMaterial(algorithm string) (string, string, error) {
+	switch algorithm {
+	case "HS256":
+		secret := make([]byte, 64)
+		if _, err := rand.Read(secret); err != nil {
+			return "", "", err
+		}
+		return base64.StdEncoding.EncodeToString(secret), "", nil
+	case "EdDSA":
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", "", err
+		}
+		return encodeKeyPair(priv, pub)
+	case "RS256":
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return "", "", err
+		}
+		return encodeKeyPair(priv, &priv.PublicKey)
+	}
+	return "", "", fmt.Errorf("unsupported jwt algorithm: %s", algorithm)
+}
+
+func encodeKeyPair(priv, pub interface{}) (string, string, error) {
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return "", "", err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", "", err
+	}
+	privPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER})
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+	return string(privPEM), string(pubPEM), nil
+}
+
+func parseSigningKey(row models.JWTKey) (*signingKey, error) {
+	key := &signingKey{kid: row.Kid}
+
+	switch row.Algorithm {
+	case "HS256":
+		secret, err := base64.StdEncoding.DecodeString(row.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(secret) == 0 {
+			return nil, errors.New("empty hmac secret")
+		}
+		key.method = jwt.SigningMethodHS256
+		key.signKey = secret
+		key.verifyKey = secret
+		return key, nil
+	case "EdDSA", "RS256":
+		block, _ := pem.Decode([]byte(row.PrivateKey))
+		if block == nil {
+			return nil, errors.New("invalid private key pem")
+		}
+		priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch k := priv.(type) {
+		case ed25519.PrivateKey:
+			if row.Algorithm != "EdDSA" {
+				return nil, errors.New("key type does not match algorithm")
+			}
+			key.method = jwt.SigningMethodEdDSA
+			key.signKey = k
+			key.verifyKey = k.Public()
+		case *rsa.PrivateKey:
+			if row.Algorithm != "RS256" {
+				return nil, errors.New("key type does not match algorithm")
+			}
+			key.method = jwt.SigningMethodRS256
+			key.signKey = k
+			key.verifyKey = &k.PublicKey
+		default:
+			return nil, errors.New("unsupported private key type")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported jwt algorithm: %s", row.Algorithm)
+}
+
+func SetJWTKeys(rows []models.JWTKey) error {
+	keys := map[string]*signingKey{}
+	var active *signingKey
+
+	for _, row := range rows {
+		if row.Status == 0 {
+			continue
+		}
+		key, err := parseSigningKey(row)
+		if err != nil {
+			return fmt.Errorf("jwt key %s: %w", row.Kid, err)
+		}
+		keys[row.Kid] = key
+		if row.Status == 1 {
+			active = key
+		}
+	}
+
+	if active == nil {
+		return errors.New("no active jwt signing key")
+	}
+
+	keyring.mu.Lock()
+	keyring.keys = keys
+	keyring.active = active
+	keyring.mu.Unlock()
+	return nil
+}
+
+func activeSigningKey() (*signingKey, error) {
+	keyring.mu.RLock()
+	defer keyring.mu.RUnlock()
+	if keyring.active == nil {
+		return nil, errors.New("jwt keyring is not loaded")
+	}
+	return keyring.active, nil
+}
+
+func signClaims(claims jwt.Claims) (string, error) {
+	key, err := activeSigningKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.signKey)
+}
+
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = LegacyJWTKeyID
+	}
+
+	keyring.mu.RLock()
+	key, ok := keyring.keys[kid]
+	keyring.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key: %s", kid)
+	}
+
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.verifyKey, nil
+}
@@ -0,0 +1,210 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type PasswordHasher interface {
+	Name() string
+	Hash(password string) (string, error)
+	Verify(password, encoded string) bool
+	Matches(encoded string) bool
+	NeedsRehash(encoded string) bool
+}
+
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Name() string {
+	return "bcrypt"
+}
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (h BcryptHasher) Verify(password, encoded string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)) == nil
+}
+
+func (h BcryptHasher) Matches(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (h BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+func (h Argon2idHasher) Name() string {
+	return "argon2id"
+}
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h Argon2idHasher) Verify(password, encoded string) bool {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+func (h Argon2idHasher) Matches(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (h Argon2idHasher) NeedsRehash(encoded string) bool {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return params.Memory != h.Memory || params.Iterations != h.Iterations || params.Parallelism != h.Parallelism ||
+		uint32(len(salt)) != h.SaltLength || uint32(len(key)) != h.KeyLength
+}
+
+func decodeArgon2id(encoded string) (Argon2idHasher, []byte, []byte, error) {
+	var params Argon2idHasher
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, errors.New("invalid argon2id hash format")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, err
+	}
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version: %d", version)
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, err
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+
+	return params, salt, key, nil
+}
+
+type LegacyMD5Hasher struct{}
+
+func (h LegacyMD5Hasher) Name() string {
+	return "md5"
+}
+
+func (h LegacyMD5Hasher) Hash(password string) (string, error) {
+	return MD5(password), nil
+}
+
+func (h LegacyMD5Hasher) Verify(password, encoded string) bool {
+	return subtle.ConstantTimeCompare([]byte(MD5(password)), []byte(strings.ToLower(encoded))) == 1
+}
+
+func (h LegacyMD5Hasher) Matches(encoded string) bool {
+	return len(encoded) == 32 && !strings.HasPrefix(encoded, "$")
+}
+
+func (h LegacyMD5Hasher) NeedsRehash(encoded string) bool {
+	return true
+}
+
+func passwordHashers() []PasswordHasher {
+	argon := Argon2idHasher{
+		Memory:      uint32(viper.GetInt("password.argon2id.memory")),
+		Iterations:  uint32(viper.GetInt("password.argon2id.iterations")),
+		Parallelism: uint8(viper.GetInt("password.argon2id.parallelism")),
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+	if argon.Memory == 0 {
+		argon.Memory = 64 * 1024
+	}
+	if argon.Iterations == 0 {
+		argon.Iterations = 3
+	}
+	if argon.Parallelism == 0 {
+		argon.Parallelism = 2
+	}
+
+	cost := viper.GetInt("password.bcrypt.cost")
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+
+	return []PasswordHasher{argon, BcryptHasher{Cost: cost}, LegacyMD5Hasher{}}
+}
+
+func activePasswordHasher() PasswordHasher {
+	name := viper.GetString("password.algorithm")
+	hashers := passwordHashers()
+	for _, h := range hashers {
+		if h.Name() == name && h.Name() != "md5" {
+			return h
+		}
+	}
+	return hashers[0]
+}
+
+func HashPassword(password string) (string, error) {
+	return activePasswordHasher().Hash(password)
+}
+
+func VerifyPassword(password, encoded string) (ok bool, needsRehash bool) {
+	active := activePasswordHasher()
+	for _, h := range passwordHashers() {
+		if !h.Matches(encoded) {
+			continue
+		}
+		if !h.Verify(password, encoded) {
+			return false, false
+		}
+		if h.Name() != active.Name() {
+			return true, true
+		}
+		return true, h.NeedsRehash(encoded)
+	}
+	return false, false
+}
@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var ErrStorageNotFound = errors.New("storage object not found")
+
+type Storage interface {
+	Put(key string, r io.Reader, size int64, contentType string) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+	URL(key string) string
+	Exists(key string) (bool, error)
+}
+
+type StorageObject struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+type StorageWalker interface {
+	Walk(prefix string, fn func(StorageObject) error) error
+}
+
+var DefaultStorage Storage
+
+func InitStorage() error {
+	switch driver := viper.GetString("storage.driver"); driver {
+	case "", "local":
+		DefaultStorage = NewLocalStorage(viper.GetString("storage.base_path"), viper.GetString("server.base_url"))
+	case "s3":
+		s3, err := NewS3Storage(S3Config{
+			Endpoint:  viper.GetString("storage.s3.endpoint"),
+			Region:    viper.GetString("storage.s3.region"),
+			Bucket:    viper.GetString("storage.s3.bucket"),
+			AccessKey: viper.GetString("storage.s3.access_key"),
+			SecretKey: viper.GetString("storage.s3.secret_key"),
+			PublicURL: viper.GetString("storage.s3.public_url"),
+			PathStyle: viper.GetBool("storage.s3.path_style"),
+		})
+		if err != nil {
+			return err
+		}
+		DefaultStorage = s3
+	default:
+		return fmt.Errorf("unknown storage driver: %s", driver)
+	}
+	return nil
+}
+
+func StorageKeyFromURL(url string) (string, bool) {
+	prefix := strings.TrimSuffix(DefaultStorage.URL(""), "/") + "/"
+	if !strings.HasPrefix(url, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(url, prefix), true
+}
+
+type LocalStorage struct {
+	basePath string
+	baseURL  string
+}
+
+func NewLocalStorage(basePath, baseURL string) *LocalStorage {
+	return &LocalStorage{basePath: basePath, baseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+func (s *LocalStorage) path(key string) (string, error) {
+	absBasePath, err := filepath.Abs(s.basePath)
+	if err != nil {
+		return "", err
+	}
+	absFullPath, err := filepath.Abs(filepath.Join(s.basePath, key))
+	if err != nil {
+		return "", err
+	}
+	if absFullPath == absBasePath || !strings.HasPrefix(absFullPath, absBasePath+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid storage key: %s", key)
+	}
+	return absFullPath, nil
+}
+
+func (s *LocalStorage) Put(key string, r io.Reader, size int64, contentType string) error {
+	fullPath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	dst, err := os.CreateTemp(filepath.Dir(fullPath), ".put-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, r); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(dst.Name())
+		return err
+	}
+	if err := os.Chmod(dst.Name(), 0644); err != nil {
+		os.Remove(dst.Name())
+		return err
+	}
+	if err := os.Rename(dst.Name(), fullPath); err != nil {
+		os.Remove(dst.Name())
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStorage) Get(key string) (io.ReadCloser, error) {
+	fullPath, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fullPath)
+	if os.IsNotExist(err) {
+		return nil, ErrStorageNotFound
+	}
+	return f, err
+}
+
+func (s *LocalStorage) Delete(key string) error {
+	fullPath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStorage) URL(key string) string {
+	return fmt.Sprintf("%s/%s", s.baseURL, key)
+}
+
+func (s *LocalStorage) Exists(key string) (bool, error) {
+	fullPath, err := s.path(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(fullPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *LocalStorage) Walk(prefix string, fn func(StorageObject) error) error {
+	root, err := s.path(prefix)
+	if err != nil {
+		return err
+	}
+	absBasePath, err := filepath.Abs(s.basePath)
+	if err != nil {
+		return err
+	}
+
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(absBasePath, path)
+		if err != nil {
+			return err
+		}
+		return fn(StorageObject{Key: filepath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime()})
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPutContentRefreshesExistingObject(t *testing.T) {
+	base := t.TempDir()
+	previous := DefaultStorage
+	DefaultStorage = NewLocalStorage(base, "http://localhost")
+	defer func() { DefaultStorage = previous }()
+
+	content := []byte("icon")
+	key, err := PutContent("icons", ".PNG", bytes.NewReader(content), int64(len(content)), "image/png")
+	if err != nil {
+		t.Fatalf("PutContent() error = %v", err)
+	}
+	if filepath.Dir(key) != "icons" || filepath.Ext(key) != ".png" {
+		t.Fatalf("PutContent() key = %s", key)
+	}
+
+	fullPath := filepath.Join(base, key)
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	if err := os.Chtimes(fullPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := PutContent("icons", ".png", bytes.NewReader(content), int64(len(content)), "image/png")
+	if err != nil || again != key {
+		t.Fatalf("PutContent() = %s, %v; want %s", again, err, key)
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().After(old.Add(time.Hour)) {
+		t.Fatalf("modification time not refreshed: %v", info.ModTime())
+	}
+	if data, _ := os.ReadFile(fullPath); !bytes.Equal(data, content) {
+		t.Fatalf("content = %q", data)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(base, "icons", ".put-*")); len(leftovers) != 0 {
+		t.Fatalf("temporary files left behind: %v", leftovers)
+	}
+}
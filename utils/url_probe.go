@@ -0,0 +1,188 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const probeSniffBytes = 512
+
+var ErrNonPublicAddress = errors.New("destination address is not public")
+
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+type ProbeResult struct {
+	StatusCode    int
+	ContentLength int64
+	ContentType   string
+	Latency       time.Duration
+	LooksHTML     bool
+	LooksAPK      bool
+	Err           error
+}
+
+func (r ProbeResult) OK() bool {
+	return r.Err == nil && r.StatusCode >= 200 && r.StatusCode < 300
+}
+
+func isPublicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr)
+}
+
+func publicAddressOnly(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !isPublicAddress(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", ErrNonPublicAddress, addrPort.Addr())
+	}
+	return nil
+}
+
+func NewProbeClient(timeout time.Duration, maxRedirects int) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: publicAddressOnly}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, address)
+			},
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+			MaxIdleConnsPerHost:   2,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("unsupported redirect scheme %q", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+func ProbeDownloadURL(client *http.Client, url string) ProbeResult {
+	start := time.Now()
+	result := probeHead(client, url)
+	if !result.OK() || result.ContentLength < 0 || !result.LooksAPK {
+		result = probeRange(client, url)
+	}
+	result.Latency = time.Since(start)
+	return result
+}
+
+func probeHead(client *http.Client, url string) ProbeResult {
+	result := ProbeResult{ContentLength: -1}
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	resp.Body.Close()
+
+	result.StatusCode = resp.StatusCode
+	result.ContentLength = resp.ContentLength
+	result.ContentType = resp.Header.Get("Content-Type")
+	result.LooksHTML = isHTMLContentType(result.ContentType)
+	result.LooksAPK = isAPKContentType(result.ContentType)
+	return result
+}
+
+func probeRange(client *http.Client, url string) ProbeResult {
+	result := ProbeResult{ContentLength: -1}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", probeSniffBytes-1))
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer resp.Body.Close()
+
+	result.StatusCode = resp.StatusCode
+	result.ContentType = resp.Header.Get("Content-Type")
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		result.ContentLength = contentRangeTotal(resp.Header.Get("Content-Range"))
+	case http.StatusOK:
+		result.ContentLength = resp.ContentLength
+	}
+
+	head, err := io.ReadAll(io.LimitReader(resp.Body, probeSniffBytes))
+	if err != nil && len(head) == 0 {
+		result.Err = err
+		return result
+	}
+	result.LooksAPK = bytes.HasPrefix(head, []byte("PK\x03\x04"))
+	result.LooksHTML = !result.LooksAPK && (isHTMLContentType(result.ContentType) ||
+		strings.HasPrefix(http.DetectContentType(head), "text/html"))
+	return result
+}
+
+func contentRangeTotal(header string) int64 {
+	slash := strings.LastIndex(header, "/")
+	if slash < 0 {
+		return -1
+	}
+	total, err := strconv.ParseInt(strings.TrimSpace(header[slash+1:]), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return total
+}
+
+func isHTMLContentType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "text/html" || mediaType == "application/xhtml+xml"
+}
+
+func isAPKContentType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/vnd.android.package-archive"
+}
+
+func ParseSizeUnits(size string) (int64, bool) {
+	fields := strings.Fields(size)
+	if len(fields) != 2 {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, false
+	}
+	if fields[1] == "B" {
+		return int64(value), true
+	}
+	exp := strings.Index("KMGTPE", strings.TrimSuffix(fields[1], "B"))
+	if exp < 0 || len(fields[1]) != 2 {
+		return 0, false
+	}
+	for i := 0; i <= exp; i++ {
+		value *= 1024
+	}
+	return int64(value), true
+}
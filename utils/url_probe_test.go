@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestIsPublicAddress(t *testing.T) {
+	cases := []struct {
+		addr   string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"2606:4700::1111", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"224.0.0.1", false},
+	}
+	for _, tc := range cases {
+		if got := isPublicAddress(netip.MustParseAddr(tc.addr)); got != tc.public {
+			t.Errorf("isPublicAddress(%s) = %v, want %v", tc.addr, got, tc.public)
+		}
+	}
+}
+
+func TestProbeClientRejectsLoopback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	result := ProbeDownloadURL(NewProbeClient(time.Second, 5), server.URL)
+	if !errors.Is(result.Err, ErrNonPublicAddress) {
+		t.Fatalf("ProbeDownloadURL() error = %v, want ErrNonPublicAddress", result.Err)
+	}
+}
+
+func TestProbeClientRedirectLimit(t *testing.T) {
+	hops := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hops++
+		http.Redirect(w, r, "/next", http.StatusFound)
+	}))
+	defer server.Close()
+
+	client := NewProbeClient(time.Second, 3)
+	client.Transport = http.DefaultTransport
+	resp, err := client.Get(server.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("expected redirect limit error")
+	}
+	if hops != 4 {
+		t.Fatalf("server saw %d requests, want 4", hops)
+	}
+}
+
+func TestProbeDownloadURL(t *testing.T) {
+	apk := append([]byte("PK\x03\x04"), make([]byte, 2044)...)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/apk", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.android.package-archive")
+		w.Header().Set("Content-Length", fmt.Sprint(len(apk)))
+		if r.Method == http.MethodGet {
+			w.Write(apk)
+		}
+	})
+	mux.HandleFunc("/range-only", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", probeSniffBytes-1, len(apk)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(apk[:probeSniffBytes])
+	})
+	mux.HandleFunc("/landing", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if r.Method == http.MethodGet {
+			w.Write([]byte("<!DOCTYPE html><html><body>download</body></html>"))
+		}
+	})
+	mux.HandleFunc("/html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<html></html>"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	cases := []struct {
+		path          string
+		ok            bool
+		status        int
+		contentLength int64
+		looksAPK      bool
+		looksHTML     bool
+	}{
+		{"/apk", true, http.StatusOK, int64(len(apk)), true, false},
+		{"/range-only", true, http.StatusPartialContent, int64(len(apk)), true, false},
+		{"/landing", true, http.StatusOK, -1, false, true},
+		{"/html", true, http.StatusOK, 13, false, true},
+		{"/missing", false, http.StatusNotFound, -1, false, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.path, func(t *testing.T) {
+			result := ProbeDownloadURL(server.Client(), server.URL+tc.path)
+			if result.OK() != tc.ok || result.StatusCode != tc.status || result.LooksAPK != tc.looksAPK || result.LooksHTML != tc.looksHTML {
+				t.Fatalf("ProbeDownloadURL() = %+v", result)
+			}
+			if tc.contentLength >= 0 && result.ContentLength != tc.contentLength {
+				t.Fatalf("ContentLength = %d, want %d", result.ContentLength, tc.contentLength)
+			}
+		})
+	}
+
+	if result := ProbeDownloadURL(server.Client(), "http://127.0.0.1:0/apk"); result.Err == nil || result.OK() {
+		t.Fatalf("ProbeDownloadURL() on closed port = %+v, want error", result)
+	}
+}